@@ -1 +1,158 @@
 package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/webhook"
+)
+
+// Body of the override request, the coordinates are required. The expiry
+// is optional and can be given either as a point in time or as a duration
+// from now
+type overrideRequest struct {
+	geo.Geolocation
+	Lat       *float64   `json:"lat"`
+	Lon       *float64   `json:"lon"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	ExpiresIn string     `json:"expires_in"`
+}
+
+// Current location, locate interval and provider budgets
+func (s *Server) handleGetStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.loc.Status())
+}
+
+// Current location, pinned or computed
+func (s *Server) handleGetLocation(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.loc.Current())
+}
+
+// Modem, network and sim of the device
+func (s *Server) handleGetModem(c echo.Context) error {
+	m := s.loc.Modem()
+	if m == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no modem")
+	}
+	return c.JSON(http.StatusOK, m.Status())
+}
+
+// Locate right away instead of waiting for the next tick
+func (s *Server) handleRelocate(c echo.Context) error {
+	s.loc.Relocate()
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (s *Server) handleGetOverride(c echo.Context) error {
+	o, ok := s.loc.GetOverride()
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no location override")
+	}
+	return c.JSON(http.StatusOK, o)
+}
+
+// Pin the location reported by the server
+func (s *Server) handlePutOverride(c echo.Context) error {
+	var req overrideRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Lat == nil || req.Lon == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "lat and lon are required")
+	}
+	if *req.Lat < -90 || *req.Lat > 90 || *req.Lon < -180 || *req.Lon > 180 {
+		return echo.NewHTTPError(http.StatusBadRequest, "coordinates out of range")
+	}
+	req.Geolocation.Lat, req.Geolocation.Lon = *req.Lat, *req.Lon
+
+	var expiresAt time.Time
+	switch {
+	case req.ExpiresAt != nil && req.ExpiresIn != "":
+		return echo.NewHTTPError(http.StatusBadRequest, "expires_at and expires_in are exclusive")
+	case req.ExpiresAt != nil:
+		expiresAt = *req.ExpiresAt
+	case req.ExpiresIn != "":
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid expires_in")
+		}
+		expiresAt = time.Now().Add(d)
+	}
+	if !expiresAt.IsZero() && expiresAt.Before(time.Now()) {
+		return echo.NewHTTPError(http.StatusBadRequest, "expiry is in the past")
+	}
+
+	o := s.loc.SetOverride(req.Geolocation, expiresAt)
+	return c.JSON(http.StatusOK, o)
+}
+
+// Go back to reporting the computed location
+func (s *Server) handleDeleteOverride(c echo.Context) error {
+	s.loc.ClearOverride()
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Reload the configuration, same as sending SIGHUP to the daemon
+func (s *Server) handleReload(c echo.Context) error {
+	res, err := s.loc.Reload()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// Fixes accepted since the daemon started, oldest first
+func (s *Server) handleGetHistory(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.loc.History())
+}
+
+// Locations known by the locator
+func (s *Server) handleGetCache(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.loc.Cache())
+}
+
+func (s *Server) handleDeleteCache(c echo.Context) error {
+	n := s.loc.PurgeCache()
+	return c.JSON(http.StatusOK, map[string]int{"purged": n})
+}
+
+// Pending entries and delivery counters of every outbox sink
+func (s *Server) handleGetOutbox(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.box.Stats())
+}
+
+// Webhook deliveries that failed every attempt, oldest first
+func (s *Server) handleGetDeadLetters(c echo.Context) error {
+	if s.hooks == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no webhook configured")
+	}
+	return c.JSON(http.StatusOK, s.hooks.DeadLetters())
+}
+
+func (s *Server) handleReplayDeadLetters(c echo.Context) error {
+	if s.hooks == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no webhook configured")
+	}
+	n, err := s.hooks.ReplayAll()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusAccepted, map[string]int{"replayed": n})
+}
+
+func (s *Server) handleReplayDeadLetter(c echo.Context) error {
+	if s.hooks == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no webhook configured")
+	}
+	err := s.hooks.Replay(c.Param("id"))
+	if errors.Is(err, webhook.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+	return c.NoContent(http.StatusAccepted)
+}
@@ -1,28 +1,53 @@
 package api
 
 import (
-	"context"
-
 	"github.com/labstack/echo/v4"
 	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/metrics"
+	"github.com/mircearem/locater/outbox"
+	"github.com/mircearem/locater/webhook"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Server struct {
 	loc        *geo.Server
+	hooks      *webhook.Dispatcher // nil when no webhook is configured
+	box        *outbox.Outbox
 	e          *echo.Echo
 	listenAddr string
 }
 
-func NewServer(listenAddr string, ctx context.Context) *Server {
+func NewServer(listenAddr string, loc *geo.Server, hooks *webhook.Dispatcher, box *outbox.Outbox) *Server {
+	e := echo.New()
+	e.HideBanner = true
 	return &Server{
-		loc:        geo.NewServer(ctx),
-		e:          echo.New(),
+		loc:        loc,
+		hooks:      hooks,
+		box:        box,
+		e:          e,
 		listenAddr: listenAddr,
 	}
 }
 
-func (s *Server) Run() {
+func (s *Server) Run() error {
+	// Register the routes
+	s.e.GET("/status", s.handleGetStatus)
+	s.e.GET("/location", s.handleGetLocation)
+	s.e.GET("/modem", s.handleGetModem)
+	s.e.POST("/location/relocate", s.handleRelocate)
+	s.e.GET("/location/override", s.handleGetOverride)
+	s.e.PUT("/location/override", s.handlePutOverride)
+	s.e.DELETE("/location/override", s.handleDeleteOverride)
+	s.e.GET("/history", s.handleGetHistory)
+	s.e.GET("/cache", s.handleGetCache)
+	s.e.DELETE("/cache", s.handleDeleteCache)
+	s.e.POST("/admin/reload", s.handleReload)
+	s.e.GET("/outbox", s.handleGetOutbox)
+	s.e.GET("/webhooks/deadletters", s.handleGetDeadLetters)
+	s.e.POST("/webhooks/deadletters/replay", s.handleReplayDeadLetters)
+	s.e.POST("/webhooks/deadletters/:id/replay", s.handleReplayDeadLetter)
+	s.e.GET("/metrics", echo.WrapHandler(promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})))
 
 	// Run echo server
-
+	return s.e.Start(s.listenAddr)
 }
@@ -0,0 +1,28 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "quota.json")
+	for _, content := range []string{"old", "new"} {
+		if err := WriteFile(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "new" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+	// No temporary file left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d files in the directory", len(entries))
+	}
+
+	if err := WriteFile(filepath.Join(dir, "missing", "quota.json"), nil); err == nil {
+		t.Fatal("written in a missing directory")
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/fakeapi"
+	"github.com/mircearem/locater/geo"
+	"github.com/sirupsen/logrus"
+)
+
+// Flag set of a command, every command accepts -config
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", "", "configuration file")
+	return fs, path
+}
+
+// Read the configuration for a one-shot command, it is not validated as
+// the command may only need part of it
+func readConfig(path string) (*config.Config, error) {
+	if path == "" {
+		return config.Read(nil)
+	}
+	return config.Read([]string{"-config", path})
+}
+
+// Split the remaining arguments into the action and its flags
+func action(name string, args []string, actions ...string) (string, []string, error) {
+	if len(args) > 0 {
+		for _, a := range actions {
+			if args[0] == a {
+				return a, args[1:], nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("usage: locater %s %v", name, actions)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printLocation(geo geo.Geolocation) {
+	fmt.Printf("%s  %s  %.6f,%.6f", geo.FixTime().Format(time.RFC3339), geo.Source, geo.Lat, geo.Lon)
+	if geo.Accuracy > 0 {
+		fmt.Printf(" ±%.0fm", geo.Accuracy)
+	}
+	fmt.Printf("  %s, %s, %s\n", geo.AddressLine1, geo.City, geo.Country)
+}
+
+// Locate the device using the geo package directly, without the daemon
+func locate(args []string) error {
+	fs, path := newFlagSet("locate")
+	once := fs.Bool("once", false, "locate once and exit")
+	source := fs.String("source", "", "cell, ip, wifi, static or simulated, the daemon source by default")
+	asJSON := fs.Bool("json", false, "print the location as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := readConfig(*path)
+	if err != nil {
+		return err
+	}
+	if *source == "" {
+		*source = geo.DefaultSource(cfg)
+	}
+
+	ctx := context.Background()
+	for {
+		loc, err := geo.Locate(ctx, cfg, *source)
+		if err != nil {
+			if *once {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, err)
+		} else if *asJSON {
+			if err := printJSON(loc); err != nil {
+				return err
+			}
+		} else {
+			printLocation(loc)
+		}
+		if *once {
+			return nil
+		}
+		time.Sleep(cfg.Interval)
+	}
+}
+
+// Read the modem information once
+func modemCommand(args []string) error {
+	_, args, err := action("modem", args, "status")
+	if err != nil {
+		return err
+	}
+	fs, path := newFlagSet("modem status")
+	asJSON := fs.Bool("json", false, "print the status as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := readConfig(*path)
+	if err != nil {
+		return err
+	}
+
+	m, err := geo.OpenModem(context.Background(), cfg)
+	if err != nil {
+		return fmt.Errorf("no modem: %s", err)
+	}
+	if err := m.Init(); err != nil {
+		return err
+	}
+	st := m.Status()
+	if *asJSON {
+		return printJSON(st)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Modem\t%s %s (%s)\n", st.Info.Manufacturer, st.Info.Model, st.Info.Version)
+	fmt.Fprintf(w, "IMEI\t%s\n", st.Info.Imei)
+	fmt.Fprintf(w, "State\t%s\n", st.Info.State)
+	fmt.Fprintf(w, "SIM\t%s (PIN %s, %d retries)\n", st.Sim.State, st.Sim.PinState, st.Sim.PinRetries)
+	fmt.Fprintf(w, "ICCID\t%s\n", st.Sim.Iccid)
+	fmt.Fprintf(w, "IMSI\t%s\n", st.Sim.Imsi)
+	fmt.Fprintf(w, "Home operator\t%s (%s, %s)\n", st.Sim.HomeOperator, st.Sim.HomeNetwork, st.Sim.HomeCountry)
+	fmt.Fprintf(w, "Operator\t%s (%s, %s)\n", st.Network.Operator, st.Network.Plmn, st.Network.Country)
+	roaming := "no"
+	if st.Network.Roaming {
+		roaming = "yes"
+	}
+	if st.Network.HomeNetwork != "" {
+		roaming += " (home network " + st.Network.HomeNetwork + ")"
+	}
+	fmt.Fprintf(w, "Registration\t%s\n", st.Network.State)
+	fmt.Fprintf(w, "Roaming\t%s\n", roaming)
+	fmt.Fprintf(w, "Technology\t%s\n", st.Network.Technology)
+	fmt.Fprintf(w, "Cell\t%s\n", st.Network.Cell)
+	fmt.Fprintf(w, "Signal\t%d dBm (%d%%)\n", st.Network.SignalRssi, st.Network.SignalStrength)
+	fmt.Fprintf(w, "APN\t%s (%s)\n", st.Wireless.Apn, st.Wireless.State)
+	fmt.Fprintf(w, "IP\t%s\n", st.Wireless.IP)
+	return w.Flush()
+}
+
+// Show or empty the caches of the running daemon
+func cacheCommand(args []string) error {
+	act, args, err := action("cache", args, "list", "purge")
+	if err != nil {
+		return err
+	}
+	fs, path := newFlagSet("cache " + act)
+	asJSON := fs.Bool("json", false, "print the result as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := readConfig(*path)
+	if err != nil {
+		return err
+	}
+
+	if act == "purge" {
+		var res map[string]int
+		if err := daemonRequest(cfg, http.MethodDelete, "/cache", &res); err != nil {
+			return err
+		}
+		fmt.Printf("%d entries purged\n", res["purged"])
+		return nil
+	}
+
+	var entries []geo.CacheEntry
+	if err := daemonRequest(cfg, http.MethodGet, "/cache", &entries); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(entries)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tCOORDINATES\tLOCATION")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%.6f,%.6f\t%s, %s\n", e.Ip, e.Coordinates.Lat, e.Coordinates.Lon, e.Location.AddressLine1, e.Location.City)
+	}
+	return w.Flush()
+}
+
+// Export the fixes accepted by the running daemon
+func historyCommand(args []string) error {
+	_, args, err := action("history", args, "export")
+	if err != nil {
+		return err
+	}
+	fs, path := newFlagSet("history export")
+	format := fs.String("format", "json", "json or csv")
+	output := fs.String("output", "", "file to write, stdout by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	cfg, err := readConfig(*path)
+	if err != nil {
+		return err
+	}
+
+	var fixes []geo.Geolocation
+	if err := daemonRequest(cfg, http.MethodGet, "/history", &fixes); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(fixes)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"timestamp", "source", "lat", "lon", "accuracy", "address", "city", "country"})
+	for _, f := range fixes {
+		cw.Write([]string{
+			f.FixTime().Format(time.RFC3339),
+			f.Source,
+			strconv.FormatFloat(f.Lat, 'f', 6, 64),
+			strconv.FormatFloat(f.Lon, 'f', 6, 64),
+			strconv.FormatFloat(f.Accuracy, 'f', 0, 64),
+			f.AddressLine1,
+			f.City,
+			f.Country,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Call every provider once and report the latency and the errors
+func providersCommand(args []string) error {
+	_, args, err := action("providers", args, "test")
+	if err != nil {
+		return err
+	}
+	fs, path := newFlagSet("providers test")
+	asJSON := fs.Bool("json", false, "print the results as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := readConfig(*path)
+	if err != nil {
+		return err
+	}
+
+	results, err := geo.CheckProviders(cfg)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(results)
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROVIDER\tLATENCY\tRESULT")
+	for _, r := range results {
+		result := "ok"
+		if r.Error != "" {
+			result = r.Error
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Provider, r.Latency.Round(time.Millisecond), result)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d providers failed", failed, len(results))
+	}
+	return nil
+}
+
+// Serve fakes of the provider apis, to run the daemon without network
+func fakeapiCommand(args []string) error {
+	fs := flag.NewFlagSet("fakeapi", flag.ContinueOnError)
+	listen := fs.String("listen", "localhost:8089", "address of the fake apis")
+	path := fs.String("scenario", "", "scenario file, a device in Cluj-Napoca by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	scenario := fakeapi.Default()
+	if *path != "" {
+		s, err := fakeapi.LoadScenario(*path)
+		if err != nil {
+			return err
+		}
+		scenario = s
+	}
+	host, port, err := net.SplitHostPort(*listen)
+	if err != nil {
+		return fmt.Errorf("-listen: %s", err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	// Environment pointing the daemon at the fake
+	p := fakeapi.Providers("http://"+net.JoinHostPort(host, port), scenario.Key)
+	fmt.Printf("IPIFY_API_URI=%s\n", p.Ipify.URI)
+	fmt.Printf("IPLOCATION_API_URI=%s\nIPLOCATION_API_KEY=%s\n", p.IP2Loc.URI, p.IP2Loc.Key)
+	fmt.Printf("OPENCELLID_API_URI=%s\nOPENCELLID_API_KEY=%s\n", p.OpenCellID.URI, p.OpenCellID.Key)
+	fmt.Printf("WIFILOCATION_API_URI=%s\nWIFILOCATION_API_KEY=%s\n", p.Geolocate.URI, p.Geolocate.Key)
+	fmt.Printf("GEOCODING_API_URI=%s\nGEOCODING_API_KEY=%s\n", p.Geoapify.URI, p.Geoapify.Key)
+
+	logrus.Printf("fake provider apis listening on %s", *listen)
+	return http.ListenAndServe(*listen, fakeapi.NewHandler(scenario))
+}
+
+// Call the api of the running daemon and decode the response
+func daemonRequest(cfg *config.Config, method, path string, v any) error {
+	host, port, err := net.SplitHostPort(cfg.API.ListenAddr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(host, port), path)
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("daemon not reachable: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("daemon response: " + res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
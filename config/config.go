@@ -0,0 +1,917 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/mircearem/locater/cron"
+	"github.com/mircearem/locater/plmn"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration file read when no other path is given
+const DEFAULT_CONFIG_FILE = "locater.yaml"
+
+// Api endpoint and credentials of a provider, and the calls allowed by
+// its plan
+type Provider struct {
+	URI           string `yaml:"uri"`
+	Key           string `yaml:"key"`
+	DailyBudget   int    `yaml:"daily_budget"`   // 0 for no limit
+	MonthlyBudget int    `yaml:"monthly_budget"` // 0 for no limit
+}
+
+type Providers struct {
+	Ipify      Provider `yaml:"ipify"`      // public ip address
+	IP2Loc     Provider `yaml:"ip2loc"`     // ip address -> coordinates
+	OpenCellID Provider `yaml:"opencellid"` // cell -> coordinates
+	Geolocate  Provider `yaml:"geolocate"`  // wifi access points -> coordinates
+	Geoapify   Provider `yaml:"geoapify"`   // coordinates -> address
+}
+
+type namedProvider struct {
+	Provider
+	name string
+}
+
+// Providers by their name in the configuration file
+func (p Providers) ByName() map[string]Provider {
+	m := make(map[string]Provider)
+	for _, np := range p.list() {
+		m[np.name] = np.Provider
+	}
+	return m
+}
+
+// Providers in a stable order, named as in the configuration file
+func (p Providers) list() []namedProvider {
+	return []namedProvider{
+		{p.Ipify, "ipify"},
+		{p.IP2Loc, "ip2loc"},
+		{p.OpenCellID, "opencellid"},
+		{p.Geolocate, "geolocate"},
+		{p.Geoapify, "geoapify"},
+	}
+}
+
+// Client of the provider apis. Every attempt has the timeout, the
+// transient failures are retried with a growing, jittered delay
+type HTTP struct {
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+	Proxy       string        `yaml:"proxy"` // the HTTPS_PROXY environment variable is used when empty
+	TLS         TLS           `yaml:"tls"`
+	Record      string        `yaml:"record"` // jsonl file receiving the requests and responses, keys redacted
+	Replay      string        `yaml:"replay"` // jsonl recording answering the requests, without network
+}
+
+// Calls to the providers, counted per utc day and month and kept across
+// restarts. Past slowdown_at of a budget the locate interval is
+// multiplied by slowdown_factor, a provider that spent its budget is no
+// longer called until the next period
+type Quota struct {
+	Path           string  `yaml:"path"`
+	SlowdownAt     float64 `yaml:"slowdown_at"` // share of a budget
+	SlowdownFactor int     `yaml:"slowdown_factor"`
+}
+
+type Store struct {
+	Addr string `yaml:"addr"`
+}
+
+type API struct {
+	ListenAddr string `yaml:"listen_addr"`
+}
+
+type Modem struct {
+	Command     string `yaml:"command"`
+	HomeNetwork string `yaml:"home_network"` // mccmnc of the sim, roaming is flagged on other networks
+	SimFile     string `yaml:"sim_file"`     // iccid of the last sim, to detect the swaps across restarts
+}
+
+type WiFi struct {
+	Interface   string `yaml:"interface"`
+	ScanCommand string `yaml:"scan_command"`
+}
+
+type TLS struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// MQTT publisher, disabled when no broker is set. Topics and the client id
+// accept the {device} and {imei} placeholders
+type MQTT struct {
+	Broker        string        `yaml:"broker"`
+	ClientID      string        `yaml:"client_id"`
+	Username      string        `yaml:"username"`
+	Password      string        `yaml:"password"`
+	QoS           byte          `yaml:"qos"`
+	LocationTopic string        `yaml:"location_topic"`
+	ModemTopic    string        `yaml:"modem_topic"`
+	StatusTopic   string        `yaml:"status_topic"`
+	Retain        bool          `yaml:"retain"`         // keep the last known location on the broker
+	ModemInterval time.Duration `yaml:"modem_interval"` // between modem snapshots
+	BufferSize    int           `yaml:"buffer_size"`    // messages kept while offline, 0 for the outbox limit
+	TLS           TLS           `yaml:"tls"`
+}
+
+// Sparkplug B edge node, using the connection settings of the MQTT
+// publisher. The edge node id accepts the {device} placeholder
+type Sparkplug struct {
+	Enabled    bool   `yaml:"enabled"`
+	GroupID    string `yaml:"group_id"`
+	EdgeNodeID string `yaml:"edge_node_id"`
+	DeviceID   string `yaml:"device_id"`
+}
+
+// Modbus TCP server for the PLC, disabled when no address is set
+type Modbus struct {
+	ListenAddr string        `yaml:"listen_addr"`
+	MaxFixAge  time.Duration `yaml:"max_fix_age"` // older fixes are flagged invalid, 0 to never expire
+}
+
+// gpsd compatible JSON server, disabled when no address is set
+type Gpsd struct {
+	ListenAddr string        `yaml:"listen_addr"`
+	MaxFixAge  time.Duration `yaml:"max_fix_age"` // older fixes are reported without a fix, 0 to never expire
+}
+
+// NMEA 0183 output, disabled when no output is set. The address is the
+// one to listen on for tcp and the destination, possibly a broadcast
+// address, for udp. The pty is linked from the given path
+type NMEA struct {
+	Output    string        `yaml:"output"` // tcp, udp or pty
+	Addr      string        `yaml:"addr"`
+	Link      string        `yaml:"link"`
+	Rate      time.Duration `yaml:"rate"`   // between two sets of sentences
+	Talker    string        `yaml:"talker"` // prefix of the sentence types
+	MaxFixAge time.Duration `yaml:"max_fix_age"`
+}
+
+// Endpoint receiving the location events. Without events or sources
+// every event is sent. The body is the event as JSON unless a template is
+// given, signed with HMAC-SHA256 when there is a secret. The name keeps
+// the pending deliveries of the endpoint when the list is reordered, the
+// position in the list is used without it
+type Webhook struct {
+	Name        string        `yaml:"name"`
+	URL         string        `yaml:"url"`
+	Events      []string      `yaml:"events"`
+	Sources     []string      `yaml:"sources"`
+	Template    string        `yaml:"template"` // text/template of the body, with the event as data
+	Secret      string        `yaml:"secret"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"` // before the first retry, doubled after each one
+}
+
+// Deliveries that failed every attempt are kept in the dead letter file
+// until they are replayed
+type Webhooks struct {
+	Endpoints      []Webhook `yaml:"endpoints"`
+	DeadLetterFile string    `yaml:"dead_letter_file"`
+}
+
+// Traccar server receiving the fixes with the OsmAnd protocol, disabled
+// when no url is set. The id accepts the {device} and {imei} placeholders
+type Traccar struct {
+	URL        string        `yaml:"url"`
+	ID         string        `yaml:"id"`
+	Timeout    time.Duration `yaml:"timeout"`
+	BufferSize int           `yaml:"buffer_size"` // fixes kept while the server is unreachable, 0 for the outbox limit
+}
+
+// Persistent queue of the outbound messages, shared by the store posts
+// and the publishers. The limits apply to every sink
+type Outbox struct {
+	Path       string        `yaml:"path"`
+	MaxEntries int           `yaml:"max_entries"` // the oldest entries are dropped past this
+	MaxAge     time.Duration `yaml:"max_age"`     // older entries are dropped, 0 to keep them
+}
+
+// Traces of the locate cycles, disabled without an exporter. The otlp
+// exporter sends them to a collector over http, the stdout and file
+// exporters write them as JSON for the devices that are offline
+type Tracing struct {
+	Exporter    string  `yaml:"exporter"` // otlp, stdout or file
+	Endpoint    string  `yaml:"endpoint"` // url of the otlp collector
+	File        string  `yaml:"file"`
+	SampleRatio float64 `yaml:"sample_ratio"` // share of the cycles traced
+}
+
+// Simulated device for demos and tests. The track, a GPX or CSV file,
+// replaces the locators and is replayed as the device location. The
+// modem replays the config_mdmd-ng outputs recorded in a directory
+type Simulation struct {
+	Track         string        `yaml:"track"`
+	Speed         float64       `yaml:"speed"` // time scale of the track, 2 replays it twice as fast
+	Loop          bool          `yaml:"loop"`  // start over at the end of the track
+	Modem         string        `yaml:"modem"`
+	ModemInterval time.Duration `yaml:"modem_interval"` // between two readings of the recorded outputs
+}
+
+// Adaptive scheduling of the locate requests around the interval. The
+// interval doubles on every failed request, is shortened for a while
+// after a movement or a handover and stretched to the heartbeat once the
+// device is stationary. No request is scheduled in the quiet windows. A
+// zero duration turns the behavior off
+type Schedule struct {
+	MaxBackoff      time.Duration `yaml:"max_backoff"`
+	FastInterval    time.Duration `yaml:"fast_interval"`
+	FastFor         time.Duration `yaml:"fast_for"`
+	MoveDistance    float64       `yaml:"move_distance"` // meters between two fixes to count as a movement
+	Heartbeat       time.Duration `yaml:"heartbeat"`
+	StationaryAfter time.Duration `yaml:"stationary_after"`
+	Quiet           []string      `yaml:"quiet"` // cron expressions, like "* 22-23,0-5 * * *"
+}
+
+// Location of a permanently installed device, the coordinates are
+// pointers to tell an unset value from the equator
+type Static struct {
+	Lat     *float64 `yaml:"lat"`
+	Lon     *float64 `yaml:"lon"`
+	Address string   `yaml:"address"`
+}
+
+type Config struct {
+	DeviceID   string        `yaml:"device_id"`
+	Interval   time.Duration `yaml:"interval"`
+	Schedule   Schedule      `yaml:"schedule"`
+	Providers  Providers     `yaml:"providers"`
+	HTTP       HTTP          `yaml:"http"`
+	Quota      Quota         `yaml:"quota"`
+	Store      Store         `yaml:"store"`
+	API        API           `yaml:"api"`
+	Modem      Modem         `yaml:"modem"`
+	WiFi       WiFi          `yaml:"wifi"`
+	Static     Static        `yaml:"static"`
+	MQTT       MQTT          `yaml:"mqtt"`
+	Sparkplug  Sparkplug     `yaml:"sparkplug"`
+	Modbus     Modbus        `yaml:"modbus"`
+	Gpsd       Gpsd          `yaml:"gpsd"`
+	NMEA       NMEA          `yaml:"nmea"`
+	Webhooks   Webhooks      `yaml:"webhooks"`
+	Traccar    Traccar       `yaml:"traccar"`
+	Outbox     Outbox        `yaml:"outbox"`
+	Tracing    Tracing       `yaml:"tracing"`
+	Simulation Simulation    `yaml:"simulation"`
+
+	// File the configuration was read from, empty if none was found
+	Path string `yaml:"-"`
+	// Command line the configuration was loaded with, used to reload it
+	args []string
+}
+
+func Default() *Config {
+	hostname, _ := os.Hostname()
+	return &Config{
+		DeviceID: hostname,
+		Interval: 10 * time.Second,
+		Schedule: Schedule{
+			MaxBackoff:      10 * time.Minute,
+			FastInterval:    5 * time.Second,
+			FastFor:         2 * time.Minute,
+			MoveDistance:    100,
+			Heartbeat:       15 * time.Minute,
+			StationaryAfter: 10 * time.Minute,
+		},
+		Providers: Providers{
+			Ipify:      Provider{URI: "https://api.ipify.org?format=json"},
+			IP2Loc:     Provider{URI: "https://api.ip2loc.com"},
+			OpenCellID: Provider{URI: "https://opencellid.org/cell/get"},
+			Geolocate:  Provider{URI: "https://www.googleapis.com/geolocation/v1/geolocate"},
+			Geoapify:   Provider{URI: "https://api.geoapify.com/v1/geocode/reverse?"},
+		},
+		HTTP: HTTP{
+			Timeout:     10 * time.Second,
+			MaxAttempts: 3,
+			Backoff:     500 * time.Millisecond,
+			MaxBackoff:  10 * time.Second,
+		},
+		Quota: Quota{
+			Path:           "locater-quota.json",
+			SlowdownAt:     0.8,
+			SlowdownFactor: 4,
+		},
+		Store: Store{Addr: "localhost:7777"},
+		API:   API{ListenAddr: ":3000"},
+		Modem: Modem{Command: "/etc/config-tools/config_mdmd-ng", SimFile: "locater-sim"},
+		WiFi:  WiFi{ScanCommand: "iw dev {iface} scan"},
+		MQTT: MQTT{
+			ClientID:      "locater-{device}",
+			QoS:           1,
+			LocationTopic: "locater/{device}/location",
+			ModemTopic:    "locater/{device}/modem",
+			StatusTopic:   "locater/{device}/status",
+			Retain:        true,
+			ModemInterval: time.Minute,
+			BufferSize:    1000,
+		},
+		Sparkplug: Sparkplug{
+			GroupID:    "locater",
+			EdgeNodeID: "{device}",
+			DeviceID:   "location",
+		},
+		Modbus: Modbus{MaxFixAge: time.Hour},
+		Gpsd:   Gpsd{MaxFixAge: time.Hour},
+		NMEA: NMEA{
+			Link:      "/tmp/locater-nmea",
+			Rate:      time.Second,
+			Talker:    "GP",
+			MaxFixAge: time.Hour,
+		},
+		Webhooks: Webhooks{DeadLetterFile: "locater-deadletters.json"},
+		Traccar: Traccar{
+			ID:         "{device}",
+			Timeout:    10 * time.Second,
+			BufferSize: 1000,
+		},
+		Outbox: Outbox{
+			Path:       "locater-outbox.db",
+			MaxEntries: 10000,
+			MaxAge:     7 * 24 * time.Hour,
+		},
+		Tracing: Tracing{
+			Endpoint:    "http://localhost:4318",
+			File:        "locater-traces.json",
+			SampleRatio: 1,
+		},
+		Simulation: Simulation{
+			Speed:         1,
+			ModemInterval: 30 * time.Second,
+		},
+	}
+}
+
+// Load and validate the configuration
+func Load(args []string) (*Config, error) {
+	cfg, err := Read(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Read the configuration without validating it, each layer overrides the
+// previous one: defaults, configuration file, environment variables (and
+// the optional .env file), command line flags
+func Read(args []string) (*Config, error) {
+	cfg := Default()
+	cfg.args = args
+
+	fs := flag.NewFlagSet("locater", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	path := fs.String("config", "", "configuration file")
+	interval := fs.Duration("interval", 0, "interval between location updates")
+	listen := fs.String("listen", "", "api listen address")
+	store := fs.String("store", "", "store address")
+	modemCmd := fs.String("modem-command", "", "path of the mdmd configuration tool")
+	iface := fs.String("wifi-interface", "", "wireless interface used to scan access points")
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("invalid command line: %s", err)
+	}
+
+	// Configuration file, the default one is optional
+	if *path == "" {
+		*path = os.Getenv("LOCATER_CONFIG")
+	}
+	if *path != "" {
+		if err := cfg.readFile(*path); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(DEFAULT_CONFIG_FILE); err == nil {
+		if err := cfg.readFile(DEFAULT_CONFIG_FILE); err != nil {
+			return nil, err
+		}
+	}
+
+	// The .env file is optional, it does not override the environment. It
+	// is read on every load so that a reload picks up its changes
+	dotenv, err := godotenv.Read(".env")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("cannot read .env file: %s", err)
+	}
+	if err := cfg.readEnv(dotenv); err != nil {
+		return nil, err
+	}
+
+	// Only the flags given on the command line override the other layers
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "interval":
+			cfg.Interval = *interval
+		case "listen":
+			cfg.API.ListenAddr = *listen
+		case "store":
+			cfg.Store.Addr = *store
+		case "modem-command":
+			cfg.Modem.Command = *modemCmd
+		case "wifi-interface":
+			cfg.WiFi.Interface = *iface
+		}
+	})
+
+	return cfg, nil
+}
+
+func (c *Config) readFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read configuration file: %s", err)
+	}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("cannot parse configuration file %s: %s", path, err)
+	}
+	c.Path = path
+	return nil
+}
+
+// Environment variables, named as in sample.env
+func (c *Config) readEnv(dotenv map[string]string) error {
+	getenv := func(name string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		return dotenv[name]
+	}
+
+	strs := map[string]*string{
+		"IPIFY_API_URI":        &c.Providers.Ipify.URI,
+		"IPLOCATION_API_URI":   &c.Providers.IP2Loc.URI,
+		"IPLOCATION_API_KEY":   &c.Providers.IP2Loc.Key,
+		"OPENCELLID_API_URI":   &c.Providers.OpenCellID.URI,
+		"OPENCELLID_API_KEY":   &c.Providers.OpenCellID.Key,
+		"WIFILOCATION_API_URI": &c.Providers.Geolocate.URI,
+		"WIFILOCATION_API_KEY": &c.Providers.Geolocate.Key,
+		"GEOCODING_API_URI":    &c.Providers.Geoapify.URI,
+		"GEOCODING_API_KEY":    &c.Providers.Geoapify.Key,
+		"PROVIDERS_PROXY":      &c.HTTP.Proxy,
+		"QUOTA_PATH":           &c.Quota.Path,
+		"PROVIDERS_RECORD":     &c.HTTP.Record,
+		"PROVIDERS_REPLAY":     &c.HTTP.Replay,
+		"STORE_ADDR":           &c.Store.Addr,
+		"API_LISTEN_ADDR":      &c.API.ListenAddr,
+		"MODEM_COMMAND":        &c.Modem.Command,
+		"MODEM_HOME_NETWORK":   &c.Modem.HomeNetwork,
+		"MODEM_SIM_FILE":       &c.Modem.SimFile,
+		"WIFI_INTERFACE":       &c.WiFi.Interface,
+		"WIFI_SCAN_COMMAND":    &c.WiFi.ScanCommand,
+		"STATIC_ADDRESS":       &c.Static.Address,
+		"DEVICE_ID":            &c.DeviceID,
+		"MQTT_BROKER":          &c.MQTT.Broker,
+		"MQTT_USERNAME":        &c.MQTT.Username,
+		"MQTT_PASSWORD":        &c.MQTT.Password,
+		"MODBUS_LISTEN_ADDR":   &c.Modbus.ListenAddr,
+		"GPSD_LISTEN_ADDR":     &c.Gpsd.ListenAddr,
+		"NMEA_OUTPUT":          &c.NMEA.Output,
+		"NMEA_ADDR":            &c.NMEA.Addr,
+		"TRACCAR_URL":          &c.Traccar.URL,
+		"TRACCAR_ID":           &c.Traccar.ID,
+		"OUTBOX_PATH":          &c.Outbox.Path,
+		"TRACING_EXPORTER":     &c.Tracing.Exporter,
+		"TRACING_ENDPOINT":     &c.Tracing.Endpoint,
+		"TRACING_FILE":         &c.Tracing.File,
+		"SIMULATION_TRACK":     &c.Simulation.Track,
+		"SIMULATION_MODEM":     &c.Simulation.Modem,
+	}
+	for name, dst := range strs {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+
+	if v := getenv("LOCATE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("LOCATE_INTERVAL: %q is not a duration, use a value like 30s or 5m", v)
+		}
+		c.Interval = d
+	}
+
+	if v := getenv("SIMULATION_SPEED"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("SIMULATION_SPEED: %q is not a number", v)
+		}
+		c.Simulation.Speed = f
+	}
+	if v := getenv("SIMULATION_LOOP"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("SIMULATION_LOOP: %q is not true or false", v)
+		}
+		c.Simulation.Loop = b
+	}
+
+	floats := map[string]**float64{
+		"STATIC_LAT": &c.Static.Lat,
+		"STATIC_LON": &c.Static.Lon,
+	}
+	for name, dst := range floats {
+		v := getenv(name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", name, v)
+		}
+		*dst = &f
+	}
+	return nil
+}
+
+// Check the configuration, all the problems are reported at once
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Interval < time.Second {
+		fail("interval: %s is too short, use at least 1s (LOCATE_INTERVAL, -interval)", c.Interval)
+	}
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"max_backoff", c.Schedule.MaxBackoff},
+		{"fast_interval", c.Schedule.FastInterval},
+		{"fast_for", c.Schedule.FastFor},
+		{"heartbeat", c.Schedule.Heartbeat},
+		{"stationary_after", c.Schedule.StationaryAfter},
+	}
+	for _, s := range durations {
+		if s.d != 0 && s.d < time.Second {
+			fail("schedule.%s: %s is too short, use at least 1s or 0 to turn it off", s.name, s.d)
+		}
+	}
+	if c.Schedule.FastInterval != 0 && c.Schedule.FastFor == 0 {
+		fail("schedule.fast_for: empty, set how long to poll at the fast interval")
+	}
+	if c.Schedule.Heartbeat != 0 && c.Schedule.StationaryAfter == 0 {
+		fail("schedule.stationary_after: empty, set how long without movement before the heartbeat")
+	}
+	if c.Schedule.MoveDistance < 0 {
+		fail("schedule.move_distance: %f must not be negative", c.Schedule.MoveDistance)
+	}
+	for i, q := range c.Schedule.Quiet {
+		if _, err := cron.Parse(q); err != nil {
+			fail("schedule.quiet[%d]: %s", i, err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.API.ListenAddr); err != nil {
+		fail("api.listen_addr: %q is not a host:port address (API_LISTEN_ADDR, -listen)", c.API.ListenAddr)
+	}
+	if _, _, err := net.SplitHostPort(c.Store.Addr); err != nil {
+		fail("store.addr: %q is not a host:port address (STORE_ADDR, -store)", c.Store.Addr)
+	}
+	if c.DeviceID == "" {
+		fail("device_id: empty, set an id for this device (DEVICE_ID)")
+	}
+	if c.Modem.Command == "" {
+		fail("modem.command: empty, set the path of config_mdmd-ng (MODEM_COMMAND, -modem-command)")
+	}
+	if c.Modem.HomeNetwork != "" {
+		if _, err := plmn.Parse(c.Modem.HomeNetwork); err != nil {
+			fail("modem.home_network: %s (MODEM_HOME_NETWORK)", err)
+		}
+	}
+
+	for _, p := range c.Providers.list() {
+		u, err := url.Parse(p.URI)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("providers.%s.uri: %q is not an http(s) url", p.name, p.URI)
+		}
+		if p.DailyBudget < 0 || p.MonthlyBudget < 0 {
+			fail("providers.%s: the budgets can not be negative", p.name)
+		}
+	}
+	if c.Quota.Path == "" {
+		fail("quota.path: empty, set the file of the provider counters (QUOTA_PATH)")
+	}
+	if c.Quota.SlowdownAt <= 0 || c.Quota.SlowdownAt > 1 {
+		fail("quota.slowdown_at: %f is out of range (0, 1]", c.Quota.SlowdownAt)
+	}
+	if c.Quota.SlowdownFactor < 1 {
+		fail("quota.slowdown_factor: %d must be at least 1", c.Quota.SlowdownFactor)
+	}
+	if c.HTTP.Timeout <= 0 {
+		fail("http.timeout: %s is not positive", c.HTTP.Timeout)
+	}
+	if c.HTTP.MaxAttempts < 1 {
+		fail("http.max_attempts: %d must be at least 1", c.HTTP.MaxAttempts)
+	}
+	if c.HTTP.Backoff < 0 || c.HTTP.MaxBackoff < c.HTTP.Backoff {
+		fail("http: backoff %s must not be negative or over max_backoff %s", c.HTTP.Backoff, c.HTTP.MaxBackoff)
+	}
+	if c.HTTP.Proxy != "" {
+		u, err := url.Parse(c.HTTP.Proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			fail("http.proxy: %q is not a proxy url like http://host:3128 (PROVIDERS_PROXY)", c.HTTP.Proxy)
+		}
+	}
+	if (c.HTTP.TLS.CertFile == "") != (c.HTTP.TLS.KeyFile == "") {
+		fail("http.tls: cert_file and key_file go together")
+	}
+	if c.HTTP.Record != "" && c.HTTP.Replay != "" {
+		fail("http: record and replay are exclusive (PROVIDERS_RECORD, PROVIDERS_REPLAY)")
+	}
+
+	if c.MQTT.Broker != "" {
+		u, err := url.Parse(c.MQTT.Broker)
+		if err != nil || u.Host == "" {
+			fail("mqtt.broker: %q is not a broker url like tcp://host:1883 (MQTT_BROKER)", c.MQTT.Broker)
+		} else if s := u.Scheme; s != "tcp" && s != "ssl" && s != "tls" && s != "mqtt" && s != "mqtts" && s != "ws" && s != "wss" {
+			fail("mqtt.broker: unsupported scheme %q, use tcp, ssl, ws or wss", s)
+		}
+		if c.MQTT.QoS > 2 {
+			fail("mqtt.qos: %d is not 0, 1 or 2", c.MQTT.QoS)
+		}
+		if c.MQTT.LocationTopic == "" || c.MQTT.ModemTopic == "" || c.MQTT.StatusTopic == "" {
+			fail("mqtt: the location, modem and status topics are required")
+		}
+		if c.MQTT.ModemInterval < time.Second {
+			fail("mqtt.modem_interval: %s is too short, use at least 1s", c.MQTT.ModemInterval)
+		}
+		if c.MQTT.BufferSize < 0 {
+			fail("mqtt.buffer_size: %d is negative", c.MQTT.BufferSize)
+		}
+		if (c.MQTT.TLS.CertFile == "") != (c.MQTT.TLS.KeyFile == "") {
+			fail("mqtt.tls: cert_file and key_file go together")
+		}
+	}
+
+	if c.Sparkplug.Enabled {
+		if c.MQTT.Broker == "" {
+			fail("sparkplug: enabled without a broker, set mqtt.broker (MQTT_BROKER)")
+		}
+		ids := map[string]string{
+			"group_id":     c.Sparkplug.GroupID,
+			"edge_node_id": c.Sparkplug.EdgeNodeID,
+			"device_id":    c.Sparkplug.DeviceID,
+		}
+		for _, name := range []string{"group_id", "edge_node_id", "device_id"} {
+			if id := ids[name]; id == "" || strings.ContainsAny(id, "/+#") {
+				fail("sparkplug.%s: %q must be non empty and without /, + or #", name, id)
+			}
+		}
+	}
+
+	if c.Modbus.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Modbus.ListenAddr); err != nil {
+			fail("modbus.listen_addr: %q is not a host:port address like :502 (MODBUS_LISTEN_ADDR)", c.Modbus.ListenAddr)
+		}
+		if c.Modbus.MaxFixAge < 0 {
+			fail("modbus.max_fix_age: %s is negative", c.Modbus.MaxFixAge)
+		}
+	}
+
+	if c.Gpsd.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Gpsd.ListenAddr); err != nil {
+			fail("gpsd.listen_addr: %q is not a host:port address like :2947 (GPSD_LISTEN_ADDR)", c.Gpsd.ListenAddr)
+		}
+		if c.Gpsd.MaxFixAge < 0 {
+			fail("gpsd.max_fix_age: %s is negative", c.Gpsd.MaxFixAge)
+		}
+	}
+
+	switch c.NMEA.Output {
+	case "":
+	case "tcp", "udp":
+		if _, _, err := net.SplitHostPort(c.NMEA.Addr); err != nil {
+			fail("nmea.addr: %q is not a host:port address like :10110 (NMEA_ADDR)", c.NMEA.Addr)
+		}
+	case "pty":
+	default:
+		fail("nmea.output: %q is not tcp, udp or pty (NMEA_OUTPUT)", c.NMEA.Output)
+	}
+	if c.NMEA.Output != "" {
+		if c.NMEA.Rate < 100*time.Millisecond {
+			fail("nmea.rate: %s is too short, use at least 100ms", c.NMEA.Rate)
+		}
+		if len(c.NMEA.Talker) != 2 {
+			fail("nmea.talker: %q is not a two letter talker id like GP", c.NMEA.Talker)
+		}
+		if c.NMEA.MaxFixAge < 0 {
+			fail("nmea.max_fix_age: %s is negative", c.NMEA.MaxFixAge)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, w := range c.Webhooks.Endpoints {
+		if w.Name != "" {
+			if names[w.Name] {
+				fail("webhooks.endpoints[%d].name: %q is already the name of another endpoint", i, w.Name)
+			}
+			names[w.Name] = true
+		}
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("webhooks.endpoints[%d].url: %q is not an http(s) url", i, w.URL)
+		}
+		if w.Timeout < 0 || w.MaxAttempts < 0 || w.Backoff < 0 {
+			fail("webhooks.endpoints[%d]: timeout, max_attempts and backoff can not be negative", i)
+		}
+	}
+	if len(c.Webhooks.Endpoints) > 0 && c.Webhooks.DeadLetterFile == "" {
+		fail("webhooks.dead_letter_file: empty, the failed deliveries need a file")
+	}
+
+	if c.Traccar.URL != "" {
+		u, err := url.Parse(c.Traccar.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("traccar.url: %q is not an http(s) url like http://host:5055 (TRACCAR_URL)", c.Traccar.URL)
+		}
+		if c.Traccar.ID == "" {
+			fail("traccar.id: empty, set the identifier of the device in traccar (TRACCAR_ID)")
+		}
+		if c.Traccar.Timeout <= 0 {
+			fail("traccar.timeout: %s is not positive", c.Traccar.Timeout)
+		}
+		if c.Traccar.BufferSize < 0 {
+			fail("traccar.buffer_size: %d is negative", c.Traccar.BufferSize)
+		}
+	}
+
+	if c.Outbox.Path == "" {
+		fail("outbox.path: empty, set the file of the outbound queue (OUTBOX_PATH)")
+	}
+	if c.Outbox.MaxEntries < 1 {
+		fail("outbox.max_entries: %d must be at least 1", c.Outbox.MaxEntries)
+	}
+	if c.Outbox.MaxAge < 0 {
+		fail("outbox.max_age: %s is negative", c.Outbox.MaxAge)
+	}
+
+	switch c.Tracing.Exporter {
+	case "":
+	case "otlp":
+		u, err := url.Parse(c.Tracing.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("tracing.endpoint: %q is not an http(s) url like http://host:4318 (TRACING_ENDPOINT)", c.Tracing.Endpoint)
+		}
+	case "stdout":
+	case "file":
+		if c.Tracing.File == "" {
+			fail("tracing.file: empty, set the file of the traces (TRACING_FILE)")
+		}
+	default:
+		fail("tracing.exporter: %q is not one of otlp, stdout or file (TRACING_EXPORTER)", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sample_ratio: %f is out of range [0, 1]", c.Tracing.SampleRatio)
+	}
+
+	if c.Simulation.Track != "" {
+		if ext := strings.ToLower(filepath.Ext(c.Simulation.Track)); ext != ".gpx" && ext != ".csv" {
+			fail("simulation.track: %q is not a .gpx or .csv file (SIMULATION_TRACK)", c.Simulation.Track)
+		}
+		if c.Simulation.Speed <= 0 {
+			fail("simulation.speed: %f is not positive (SIMULATION_SPEED)", c.Simulation.Speed)
+		}
+	}
+	if c.Simulation.Modem != "" {
+		if fi, err := os.Stat(c.Simulation.Modem); err != nil || !fi.IsDir() {
+			fail("simulation.modem: %q is not a directory of recorded outputs (SIMULATION_MODEM)", c.Simulation.Modem)
+		}
+		if c.Simulation.ModemInterval < time.Second {
+			fail("simulation.modem_interval: %s is too short, use at least 1s", c.Simulation.ModemInterval)
+		}
+	}
+
+	// Static location, both coordinates or none
+	if (c.Static.Lat == nil) != (c.Static.Lon == nil) {
+		fail("static: both lat and lon are required (STATIC_LAT, STATIC_LON)")
+	}
+	if c.Static.Lat != nil && (*c.Static.Lat < -90 || *c.Static.Lat > 90) {
+		fail("static.lat: %f is out of range [-90, 90]", *c.Static.Lat)
+	}
+	if c.Static.Lon != nil && (*c.Static.Lon < -180 || *c.Static.Lon > 180) {
+		fail("static.lon: %f is out of range [-180, 180]", *c.Static.Lon)
+	}
+
+	// Keys of the providers the selected locator will call, the simulated
+	// track is only geocoded when there is a key
+	static := c.Static.Lat != nil && c.Static.Lon != nil
+	simulated := c.Simulation.Track != ""
+	if !simulated && (!static || c.Static.Address == "") {
+		if c.Providers.Geoapify.Key == "" {
+			fail("providers.geoapify.key: empty, it is needed to look up addresses (GEOCODING_API_KEY)")
+		}
+	}
+	if c.WiFi.Interface != "" && len(strings.Fields(c.WiFi.ScanCommand)) == 0 {
+		fail("wifi.scan_command: empty, it is needed to scan the access points of %s (WIFI_SCAN_COMMAND)", c.WiFi.Interface)
+	}
+	located := static || simulated
+	if !located && c.WiFi.Interface != "" && c.Providers.Geolocate.Key == "" {
+		fail("providers.geolocate.key: empty, it is needed by the wifi locator (WIFILOCATION_API_KEY)")
+	}
+	if !located && c.WiFi.Interface == "" {
+		if c.HasModem() {
+			if c.Providers.OpenCellID.Key == "" {
+				fail("providers.opencellid.key: empty, it is needed by the cellular locator (OPENCELLID_API_KEY)")
+			}
+		} else if c.Providers.IP2Loc.Key == "" {
+			fail("providers.ip2loc.key: empty, it is needed by the lan locator (IPLOCATION_API_KEY)")
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Check if the modem configuration tool is installed, or a simulated
+// modem is configured
+func (c *Config) HasModem() bool {
+	if c.Simulation.Modem != "" {
+		return true
+	}
+	_, err := os.Stat(c.Modem.Command)
+	return err == nil
+}
+
+// Read the configuration again from the same file, environment and flags
+func (c *Config) Reload() (*Config, error) {
+	return Load(c.args)
+}
+
+// Setting that differs between two configurations
+type Change struct {
+	Setting string `json:"setting"`
+	Restart bool   `json:"restart"` // the daemon must be restarted to apply it
+}
+
+// Compare two configurations, secrets are never part of the report
+func Diff(old, new *Config) []Change {
+	changes := make([]Change, 0)
+	add := func(changed bool, setting string, restart bool) {
+		if changed {
+			changes = append(changes, Change{Setting: setting, Restart: restart})
+		}
+	}
+
+	add(old.Interval != new.Interval, "interval", false)
+	add(!reflect.DeepEqual(old.Schedule, new.Schedule), "schedule", true)
+	add(old.HTTP != new.HTTP, "http", true)
+	add(old.Quota != new.Quota, "quota", true)
+	oldp, newp := old.Providers.list(), new.Providers.list()
+	for i := range oldp {
+		add(oldp[i].URI != newp[i].URI, "providers."+oldp[i].name+".uri", false)
+		add(oldp[i].Key != newp[i].Key, "providers."+oldp[i].name+".key", false)
+		add(oldp[i].DailyBudget != newp[i].DailyBudget, "providers."+oldp[i].name+".daily_budget", false)
+		add(oldp[i].MonthlyBudget != newp[i].MonthlyBudget, "providers."+oldp[i].name+".monthly_budget", false)
+	}
+	add(old.Store != new.Store, "store.addr", true)
+	add(old.API != new.API, "api.listen_addr", true)
+	add(old.Modem.Command != new.Modem.Command, "modem.command", true)
+	add(old.Modem.HomeNetwork != new.Modem.HomeNetwork, "modem.home_network", true)
+	add(old.Modem.SimFile != new.Modem.SimFile, "modem.sim_file", true)
+	add(old.WiFi.Interface != new.WiFi.Interface, "wifi.interface", true)
+	add(old.WiFi.ScanCommand != new.WiFi.ScanCommand, "wifi.scan_command", true)
+	add(!equalFloat(old.Static.Lat, new.Static.Lat), "static.lat", true)
+	add(!equalFloat(old.Static.Lon, new.Static.Lon), "static.lon", true)
+	add(old.Static.Address != new.Static.Address, "static.address", true)
+	add(old.DeviceID != new.DeviceID, "device_id", true)
+	add(old.MQTT != new.MQTT, "mqtt", true)
+	// The edge node connects with the mqtt settings
+	add(old.Sparkplug != new.Sparkplug || old.MQTT != new.MQTT && old.Sparkplug.Enabled, "sparkplug", true)
+	add(old.Modbus != new.Modbus, "modbus", true)
+	add(old.Gpsd != new.Gpsd, "gpsd", true)
+	add(old.NMEA != new.NMEA, "nmea", true)
+	add(!reflect.DeepEqual(old.Webhooks, new.Webhooks), "webhooks", true)
+	add(old.Traccar != new.Traccar, "traccar", true)
+	add(old.Outbox != new.Outbox, "outbox", true)
+	add(old.Tracing != new.Tracing, "tracing", true)
+	add(old.Simulation != new.Simulation, "simulation", true)
+
+	return changes
+}
+
+func equalFloat(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+interval: 20s
+providers:
+  ip2loc:
+    key: file-key
+  geoapify:
+    key: file-key
+api:
+  listen_addr: :4000
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "locater.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	t.Setenv("MODEM_COMMAND", filepath.Join(t.TempDir(), "config_mdmd-ng"))
+	t.Setenv("LOCATE_INTERVAL", "30s")
+	t.Setenv("GEOCODING_API_KEY", "env-key")
+
+	cfg, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Environment over file, file over defaults
+	if cfg.Interval != 30*time.Second {
+		t.Fatalf("expected the interval from the environment, got %s", cfg.Interval)
+	}
+	if cfg.Providers.Geoapify.Key != "env-key" {
+		t.Fatalf("expected the key from the environment, got %q", cfg.Providers.Geoapify.Key)
+	}
+	if cfg.Providers.IP2Loc.Key != "file-key" || cfg.API.ListenAddr != ":4000" {
+		t.Fatalf("expected the values from the file, got %+v", cfg)
+	}
+	if cfg.Store.Addr != "localhost:7777" {
+		t.Fatalf("expected the default store address, got %q", cfg.Store.Addr)
+	}
+
+	// Flags over everything
+	cfg, err = Load([]string{"-config", path, "-interval", "40s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Interval != 40*time.Second {
+		t.Fatalf("expected the interval from the flags, got %s", cfg.Interval)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	lat := 95.0
+	cfg := Default()
+	cfg.Modem.Command = filepath.Join(t.TempDir(), "config_mdmd-ng")
+	cfg.Interval = 0
+	cfg.API.ListenAddr = "3000"
+	cfg.Static.Lat = &lat
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected the configuration to be invalid")
+	}
+	for _, want := range []string{"interval", "api.listen_addr", "static: both", "static.lat", "geoapify.key", "ip2loc.key"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected an error about %s, got:\n%s", want, err)
+		}
+	}
+
+	// A blank scan command has no program to run
+	cfg = Default()
+	cfg.WiFi.Interface = "wlan0"
+	cfg.WiFi.ScanCommand = "  "
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "wifi.scan_command") {
+		t.Errorf("expected an error about wifi.scan_command, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := Default()
+	new := Default()
+	new.Interval = time.Minute
+	new.Providers.Geoapify.Key = "rotated"
+	new.API.ListenAddr = ":4000"
+
+	changes := Diff(old, new)
+	want := []Change{
+		{Setting: "interval", Restart: false},
+		{Setting: "providers.geoapify.key", Restart: false},
+		{Setting: "api.listen_addr", Restart: true},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d changes, got %+v", len(want), changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("expected %+v, got %+v", want[i], changes[i])
+		}
+	}
+}
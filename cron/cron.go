@@ -0,0 +1,111 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bounds of the fields, minute hour day-of-month month day-of-week. The
+// day of the week 7 is sunday like 0
+var fields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Expression like "* 22-23,0-5 * * *", matching the minutes of a window.
+// The fields accept *, values, ranges, lists and steps like */15 or 1-5/2
+type Expr struct {
+	src    string
+	sets   [5]map[int]bool
+	anyDay [2]bool // day of month and day of week are *
+}
+
+func Parse(s string) (*Expr, error) {
+	parts := strings.Fields(s)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron %q: want 5 fields, minute hour day month weekday", s)
+	}
+	e := &Expr{src: s}
+	for i, p := range parts {
+		set, err := parseField(p, fields[i].min, fields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %s %s", s, fields[i].name, err)
+		}
+		e.sets[i] = set
+	}
+	if e.sets[4][7] {
+		e.sets[4][0] = true
+	}
+	e.anyDay = [2]bool{parts[2] == "*", parts[4] == "*"}
+	return e, nil
+}
+
+// Values of a field
+func parseField(s string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, item := range strings.Split(s, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%q: the step must be a positive number", item)
+			}
+			rng, step = item[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			from, to, isRange := strings.Cut(rng, "-")
+			if lo, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("%q is not a number", from)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("%q is not a number", to)
+				}
+			} else if step > 1 {
+				// 5/10 is from 5 to the end
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q: out of %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// The minute of t is in the window. As with cron, when both days are
+// restricted either one matches
+func (e *Expr) Match(t time.Time) bool {
+	if !e.sets[0][t.Minute()] || !e.sets[1][t.Hour()] || !e.sets[3][int(t.Month())] {
+		return false
+	}
+	dom, dow := e.sets[2][t.Day()], e.sets[4][int(t.Weekday())]
+	switch {
+	case e.anyDay[0] && e.anyDay[1]:
+		return true
+	case e.anyDay[0]:
+		return dow
+	case e.anyDay[1]:
+		return dom
+	}
+	return dom || dow
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
@@ -0,0 +1,48 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	// Monday 2024-01-15
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* 22-23,0-5 * * *", at(15, 23, 30), true},
+		{"* 22-23,0-5 * * *", at(15, 5, 59), true},
+		{"* 22-23,0-5 * * *", at(15, 6, 0), false},
+		{"*/15 * * * *", at(15, 10, 45), true},
+		{"*/15 * * * *", at(15, 10, 46), false},
+		{"0-29/10 8 * * *", at(15, 8, 20), true},
+		{"* * * * 0,6", at(14, 12, 0), true}, // sunday
+		{"* * * * 7", at(14, 12, 0), true},
+		{"* * * * 1-5", at(14, 12, 0), false},
+		{"* * 1 * 1", at(15, 12, 0), true}, // either day matches
+		{"* * 1 * 2", at(15, 12, 0), false},
+		{"* * * 2 *", at(15, 12, 0), false},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.Match(tt.t); got != tt.want {
+			t.Errorf("%q at %s: %v, want %v", tt.expr, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "* * 0 * *", "a * * * *", "* * * * 8"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q accepted", expr)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package fakeapi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Apis served by the fake, named as the providers in the configuration
+const (
+	API_IPIFY      = "ipify"
+	API_IP2LOC     = "ip2loc"
+	API_OPENCELLID = "opencellid"
+	API_GEOLOCATE  = "geolocate"
+	API_GEOAPIFY   = "geoapify"
+)
+
+var apis = []string{API_IPIFY, API_IP2LOC, API_OPENCELLID, API_GEOLOCATE, API_GEOAPIFY}
+
+// Answered by ipify when the scenario has no ip addresses
+const DEFAULT_IP = "192.0.2.1"
+
+// Answers of the fake apis
+type Scenario struct {
+	Key         string           `yaml:"key"`     // required by every api but ipify, any key when empty
+	Latency     time.Duration    `yaml:"latency"` // added to every answer
+	IPs         []string         `yaml:"ips"`     // answered by ipify in turn, the last one is repeated
+	IPLocations map[string]Point `yaml:"ip_locations"`
+	Cells       []Cell           `yaml:"cells"`
+	WiFi        *Point           `yaml:"wifi"` // answered to every geolocate request, not found when empty
+	Addresses   []Address        `yaml:"addresses"`
+	Quota       map[string]int   `yaml:"quota"` // calls answered by an api before a 429, by api name
+	Errors      []Fault          `yaml:"errors"`
+}
+
+// Coordinates answered by an api
+type Point struct {
+	Lat      float64 `yaml:"lat"`
+	Lon      float64 `yaml:"lon"`
+	Accuracy float64 `yaml:"accuracy"`
+}
+
+// Cell known to OpenCellID, the lac is the tracking area of lte and nr
+// cells. A cell without a radio matches any radio
+type Cell struct {
+	Radio string  `yaml:"radio"`
+	MCC   int     `yaml:"mcc"`
+	MNC   int     `yaml:"mnc"`
+	LAC   int     `yaml:"lac"`
+	CID   int64   `yaml:"cid"`
+	Lat   float64 `yaml:"lat"`
+	Lon   float64 `yaml:"lon"`
+	Range float64 `yaml:"range"`
+}
+
+// Address known to Geoapify, the nearest one is answered
+type Address struct {
+	Lat          float64 `yaml:"lat"`
+	Lon          float64 `yaml:"lon"`
+	Name         string  `yaml:"name"`
+	Country      string  `yaml:"country"`
+	CountryCode  string  `yaml:"country_code"`
+	City         string  `yaml:"city"`
+	Postcode     string  `yaml:"postcode"`
+	District     string  `yaml:"district"`
+	Suburb       string  `yaml:"suburb"`
+	Street       string  `yaml:"street"`
+	AddressLine1 string  `yaml:"address_line1"`
+	Category     string  `yaml:"category"`
+}
+
+// Error injected in the answers of an api. The calls after the first
+// After ones fail, Count of them or all when 0. With a latency and no
+// status the calls are only slowed down
+type Fault struct {
+	API     string        `yaml:"api"`
+	After   int           `yaml:"after"`
+	Count   int           `yaml:"count"`
+	Status  int           `yaml:"status"`
+	Message string        `yaml:"message"`
+	Latency time.Duration `yaml:"latency"`
+	Drop    bool          `yaml:"drop"` // close the connection without an answer
+}
+
+// Read a scenario file
+func LoadScenario(path string) (Scenario, error) {
+	var s Scenario
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, fmt.Errorf("cannot read the scenario: %s", err)
+	}
+	if err := yaml.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("cannot parse the scenario %s: %s", path, err)
+	}
+	return s, s.Validate()
+}
+
+// Check the api names and the counts
+func (s Scenario) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	for api, n := range s.Quota {
+		if !known(api) {
+			fail("quota: unknown api %q", api)
+		}
+		if n < 0 {
+			fail("quota.%s: %d is negative", api, n)
+		}
+	}
+	for i, f := range s.Errors {
+		if !known(f.API) {
+			fail("errors[%d]: unknown api %q, use one of %v", i, f.API, apis)
+		}
+		if f.After < 0 || f.Count < 0 {
+			fail("errors[%d]: after and count cannot be negative", i)
+		}
+		if f.Status != 0 && (f.Status < 100 || f.Status > 599) {
+			fail("errors[%d]: %d is not an http status", i, f.Status)
+		}
+		if f.Status == 0 && !f.Drop && f.Latency == 0 {
+			fail("errors[%d]: set a status, drop or a latency", i)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid scenario:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func known(api string) bool {
+	for _, a := range apis {
+		if a == api {
+			return true
+		}
+	}
+	return false
+}
+
+// Default scenario, a device in Cluj-Napoca on every api
+func Default() Scenario {
+	return Scenario{
+		IPs: []string{"203.0.113.10"},
+		IPLocations: map[string]Point{
+			"203.0.113.10": {Lat: 46.7712, Lon: 23.6236},
+		},
+		Cells: []Cell{
+			{MCC: 226, MNC: 1, LAC: 1, CID: 1, Lat: 46.7700, Lon: 23.5900, Range: 1000},
+		},
+		WiFi: &Point{Lat: 46.7705, Lon: 23.5920, Accuracy: 25},
+		Addresses: []Address{{
+			Lat:          46.7700,
+			Lon:          23.5900,
+			Name:         "Piața Unirii",
+			Country:      "Romania",
+			CountryCode:  "ro",
+			City:         "Cluj-Napoca",
+			Postcode:     "400000",
+			Street:       "Piața Unirii",
+			AddressLine1: "Piața Unirii",
+			Category:     "tourism",
+		}},
+	}
+}
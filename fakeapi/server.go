@@ -0,0 +1,282 @@
+package fakeapi
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mircearem/locater/config"
+)
+
+// Key configured for the fake when the scenario accepts any key
+const ANY_KEY = "fake"
+
+// Fake of the subset of the provider apis called by the geo package,
+// answering from a scenario. It can be served by httptest in the tests
+type Handler struct {
+	s   Scenario
+	mux *http.ServeMux
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func NewHandler(s Scenario) *Handler {
+	h := &Handler{
+		s:     s,
+		mux:   http.NewServeMux(),
+		calls: make(map[string]int),
+	}
+	h.mux.HandleFunc("/ipify", h.api(API_IPIFY, h.handleIpify))
+	h.mux.HandleFunc("/ip2loc/", h.api(API_IP2LOC, h.handleIP2Loc))
+	h.mux.HandleFunc("/opencellid", h.api(API_OPENCELLID, h.handleOpenCellID))
+	h.mux.HandleFunc("/geolocate", h.api(API_GEOLOCATE, h.handleGeolocate))
+	h.mux.HandleFunc("/geoapify", h.api(API_GEOAPIFY, h.handleGeoapify))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Calls received by an api, the failed ones included
+func (h *Handler) Calls(api string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls[api]
+}
+
+// Provider configuration pointing at a fake served on base, like
+// http://localhost:8089
+func Providers(base, key string) config.Providers {
+	base = strings.TrimSuffix(base, "/")
+	if key == "" {
+		key = ANY_KEY
+	}
+	return config.Providers{
+		Ipify:      config.Provider{URI: base + "/ipify?format=json"},
+		IP2Loc:     config.Provider{URI: base + "/ip2loc", Key: key},
+		OpenCellID: config.Provider{URI: base + "/opencellid", Key: key},
+		Geolocate:  config.Provider{URI: base + "/geolocate", Key: key},
+		Geoapify:   config.Provider{URI: base + "/geoapify?", Key: key},
+	}
+}
+
+// Count the call and apply the latency, the injected errors, the key and
+// the quota before the answer of the api
+func (h *Handler) api(name string, answer func(w http.ResponseWriter, r *http.Request, key string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		h.calls[name]++
+		n := h.calls[name]
+		h.mu.Unlock()
+
+		time.Sleep(h.s.Latency)
+		for _, f := range h.s.Errors {
+			if f.API != name || n <= f.After || (f.Count > 0 && n > f.After+f.Count) {
+				continue
+			}
+			time.Sleep(f.Latency)
+			if f.Drop {
+				drop(w)
+				return
+			}
+			if f.Status != 0 {
+				writeError(w, f.Status, f.Message)
+				return
+			}
+		}
+
+		key := r.URL.Query().Get("key")
+		if name == API_IP2LOC {
+			key, _, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/ip2loc/"), "/")
+		} else if name == API_GEOAPIFY {
+			key = r.URL.Query().Get("apiKey")
+		}
+		if name != API_IPIFY && h.s.Key != "" && key != h.s.Key {
+			writeError(w, http.StatusUnauthorized, "invalid api key")
+			return
+		}
+		if quota, ok := h.s.Quota[name]; ok && n > quota {
+			writeError(w, http.StatusTooManyRequests, "quota exceeded")
+			return
+		}
+		answer(w, r, key)
+	}
+}
+
+// The ip addresses in turn, the last one is repeated
+func (h *Handler) handleIpify(w http.ResponseWriter, r *http.Request, _ string) {
+	ip := DEFAULT_IP
+	if len(h.s.IPs) > 0 {
+		n := h.Calls(API_IPIFY)
+		ip = h.s.IPs[min(n, len(h.s.IPs))-1]
+	}
+	writeJSON(w, map[string]string{"ip": ip})
+}
+
+// GET /ip2loc/{key}/{ip}
+func (h *Handler) handleIP2Loc(w http.ResponseWriter, r *http.Request, key string) {
+	ip := strings.TrimPrefix(r.URL.Path, "/ip2loc/"+key+"/")
+	p, ok := h.s.IPLocations[ip]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ip address not found")
+		return
+	}
+	var res struct {
+		Connection struct {
+			IP string `json:"ip"`
+		} `json:"connection"`
+		Location struct {
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+		} `json:"location"`
+		Success bool `json:"success"`
+	}
+	res.Connection.IP = ip
+	res.Location.Latitude, res.Location.Longitude = p.Lat, p.Lon
+	res.Success = true
+	writeJSON(w, res)
+}
+
+// GET /opencellid?key&mcc&mnc&lac&cellid&radio
+func (h *Handler) handleOpenCellID(w http.ResponseWriter, r *http.Request, _ string) {
+	q := r.URL.Query()
+	param := func(name string) int {
+		v, _ := strconv.Atoi(q.Get(name))
+		return v
+	}
+	mcc, mnc, lac := param("mcc"), param("mnc"), param("lac")
+	cid, _ := strconv.ParseInt(q.Get("cellid"), 10, 64)
+	radio := q.Get("radio")
+	for _, c := range h.s.Cells {
+		if c.Radio != "" && radio != "" && !strings.EqualFold(c.Radio, radio) {
+			continue
+		}
+		if c.MCC == mcc && c.MNC == mnc && c.LAC == lac && c.CID == cid {
+			writeJSON(w, map[string]any{
+				"lat":    c.Lat,
+				"lon":    c.Lon,
+				"mcc":    c.MCC,
+				"mnc":    c.MNC,
+				"lac":    c.LAC,
+				"cellid": c.CID,
+				"range":  c.Range,
+			})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "cell not found")
+}
+
+// POST /geolocate?key, the same location whatever the access points
+func (h *Handler) handleGeolocate(w http.ResponseWriter, r *http.Request, _ string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if h.s.WiFi == nil {
+		writeError(w, http.StatusNotFound, "location not found")
+		return
+	}
+	var res struct {
+		Location struct {
+			Lat float64 `json:"lat"`
+			Lng float64 `json:"lng"`
+		} `json:"location"`
+		Accuracy float64 `json:"accuracy"`
+	}
+	res.Location.Lat, res.Location.Lng = h.s.WiFi.Lat, h.s.WiFi.Lon
+	res.Accuracy = h.s.WiFi.Accuracy
+	writeJSON(w, res)
+}
+
+type geoapifyResult struct {
+	Name         string  `json:"name,omitempty"`
+	Country      string  `json:"country,omitempty"`
+	CountryCode  string  `json:"country_code,omitempty"`
+	City         string  `json:"city,omitempty"`
+	Postcode     string  `json:"postcode,omitempty"`
+	District     string  `json:"district,omitempty"`
+	Suburb       string  `json:"suburb,omitempty"`
+	Street       string  `json:"street,omitempty"`
+	AddressLine1 string  `json:"address_line1,omitempty"`
+	Category     string  `json:"category,omitempty"`
+	Lat          float64 `json:"lat"`
+	Lon          float64 `json:"lon"`
+}
+
+// GET /geoapify?lat&lon&apiKey, the nearest address or no results
+func (h *Handler) handleGeoapify(w http.ResponseWriter, r *http.Request, _ string) {
+	q := r.URL.Query()
+	lat, err1 := strconv.ParseFloat(q.Get("lat"), 64)
+	lon, err2 := strconv.ParseFloat(q.Get("lon"), 64)
+	if err1 != nil || err2 != nil {
+		writeError(w, http.StatusBadRequest, "lat and lon are required")
+		return
+	}
+
+	results := []geoapifyResult{}
+	best := math.Inf(1)
+	for _, a := range h.s.Addresses {
+		if d := distance(lat, lon, a.Lat, a.Lon); d < best {
+			best = d
+			results = []geoapifyResult{{
+				Name:         a.Name,
+				Country:      a.Country,
+				CountryCode:  a.CountryCode,
+				City:         a.City,
+				Postcode:     a.Postcode,
+				District:     a.District,
+				Suburb:       a.Suburb,
+				Street:       a.Street,
+				AddressLine1: a.AddressLine1,
+				Category:     a.Category,
+				Lat:          a.Lat,
+				Lon:          a.Lon,
+			}}
+		}
+	}
+	writeJSON(w, map[string]any{"results": results})
+}
+
+// Distance in degrees, enough to compare the addresses
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	dx := (lon2 - lon1) * math.Cos((lat1+lat2)/2*math.Pi/180)
+	dy := lat2 - lat1
+	return math.Hypot(dx, dy)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Error body in the shape parsed by the provider client
+func writeError(w http.ResponseWriter, status int, message string) {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"code": status, "message": message},
+	})
+}
+
+// Close the connection without an answer, a network error for the client
+func drop(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
@@ -0,0 +1,91 @@
+package fakeapi
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/provider"
+)
+
+func newTestConfig(t *testing.T, base string) *config.Config {
+	cfg, err := config.Read(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Providers = Providers(base, "")
+	cfg.HTTP = config.HTTP{
+		Timeout:     time.Second,
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+	}
+	return cfg
+}
+
+func TestLocateSampleScenario(t *testing.T) {
+	s, err := LoadScenario("../sample-scenario.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Latency = 0
+	h := NewHandler(s)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	cfg := newTestConfig(t, srv.URL)
+
+	// The ip addresses change between the calls, the addresses follow
+	for _, want := range []string{"Cluj-Napoca", "București"} {
+		loc, err := geo.Locate(context.Background(), cfg, geo.SourceIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.City != want {
+			t.Errorf("located in %q, want %q", loc.City, want)
+		}
+	}
+	if h.Calls(API_IPIFY) != 2 || h.Calls(API_GEOAPIFY) != 2 {
+		t.Errorf("%d ipify and %d geoapify calls, want 2 of each", h.Calls(API_IPIFY), h.Calls(API_GEOAPIFY))
+	}
+}
+
+func TestInjectedErrors(t *testing.T) {
+	s := Default()
+	s.Key = "s3cr3t"
+	s.Quota = map[string]int{API_GEOAPIFY: 1}
+	s.Errors = []Fault{
+		{API: API_IPIFY, Count: 1, Status: 503},
+		{API: API_IP2LOC, Count: 1, Drop: true},
+	}
+	h := NewHandler(s)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	cfg := newTestConfig(t, srv.URL)
+
+	// A wrong key is refused
+	if _, err := geo.Locate(context.Background(), cfg, geo.SourceIP); !errors.Is(err, provider.ErrUnauthorized) {
+		t.Errorf("error %v with a wrong key, want unauthorized", err)
+	}
+
+	// The 503 and the dropped connection are retried, the second
+	// geocoding is over the quota
+	cfg.Providers = Providers(srv.URL, s.Key)
+	if _, err := geo.Locate(context.Background(), cfg, geo.SourceIP); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geo.Locate(context.Background(), cfg, geo.SourceIP); !errors.Is(err, provider.ErrQuotaExceeded) {
+		t.Errorf("error %v over the quota, want quota exceeded", err)
+	}
+	if h.Calls(API_IPIFY) != 4 {
+		t.Errorf("%d ipify calls, want 4 with the retry", h.Calls(API_IPIFY))
+	}
+
+	s.Errors = append(s.Errors, Fault{API: "nominatim", Status: 500})
+	if err := s.Validate(); err == nil {
+		t.Error("unknown api accepted")
+	}
+}
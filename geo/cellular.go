@@ -1,41 +1,41 @@
 package geo
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
-	"os"
 	"sync"
 
 	"github.com/mircearem/locater/modem"
-	"github.com/mircearem/storer/store"
-)
-
-var (
-	OPENCELLID_API_URI string
-	OPENCELLID_API_KEY string
 )
 
 type CellularLocator struct {
 	m        *modem.Modem
-	db       *store.Client
-	c        Coordinates
+	db       Store
+	p        *Providers
 	Sendch   chan Geolocation
 	Locch    chan struct{}
-	latlonch chan struct{}
+	latlonch chan cellCoordinates // coordinates not in the map
 	mu       sync.RWMutex
 	locs     map[Coordinates]Geolocation
 }
 
-func NewCellLocator(m *modem.Modem, Sendch chan Geolocation, Locch chan struct{}) *CellularLocator {
-	client := store.NewClient("localhost:7777")
+// Coordinates of the serving cell, with the trace of the cycle
+type cellCoordinates struct {
+	ctx context.Context
+	c   Coordinates
+}
+
+func NewCellLocator(m *modem.Modem, p *Providers, db Store, Sendch chan Geolocation, Locch chan struct{}) *CellularLocator {
 	return &CellularLocator{
-		m:      m,
-		db:     client,
-		Sendch: Sendch,
-		Locch:  Locch,
+		m:        m,
+		db:       db,
+		p:        p,
+		Sendch:   Sendch,
+		Locch:    Locch,
+		latlonch: make(chan cellCoordinates),
+		locs:     make(map[Coordinates]Geolocation),
 	}
 }
 
@@ -44,95 +44,102 @@ func (l *CellularLocator) Run() {
 
 	for {
 		<-l.Locch
+		ctx := startLocate(SourceCell)
 		// Call the OpenCellId API
-		err := l.getLatLon()
+		c, err := l.getLatLon(ctx)
 		if err != nil {
+			endLocate(ctx, err)
 			continue
 		}
 		// Check if the location is already in the map
 		l.mu.RLock()
-		if _, ok := l.locs[l.c]; !ok {
-			l.latlonch <- struct{}{}
-			l.mu.RUnlock()
-			continue
-		}
+		geo, ok := l.locs[c]
 		l.mu.RUnlock()
-		log.Printf("Coordinates already in map: %+v\n", l.c)
-		// Get the location using the Geocoding API
-		geo, err := l.getGeolocation(l.c)
-		if err != nil {
+		cacheLookup(ctx, "cell_locs", ok)
+		if !ok {
+			l.latlonch <- cellCoordinates{ctx: ctx, c: c}
 			continue
 		}
-		// Send the new geolocation back to the server
-		l.Sendch <- geo
+		log.Printf("Coordinates already in map: %+v\n", c)
+		// Send the known geolocation back to the server
+		l.Sendch <- traced(ctx, geo)
+		endLocate(ctx, nil)
 	}
 }
 
-// Geolocate
+// Geolocate the coordinates of a new cell
 func (l *CellularLocator) geolocate() {
 	for {
-		<-l.latlonch
-		// New registered ip, get coordinates and put it in the map
-		err := l.getLatLon()
-		if err != nil {
-			log.Println(err)
+		req := <-l.latlonch
+		ctx, c := req.ctx, req.c
+		// Geolocate
+		geo, err := reverseGeocode(ctx, l.p, c)
+		if errors.Is(err, ErrNoAddress) {
+			// Reported, but not stored so that the address is looked up
+			// again on the next request
+			geo.Source = SourceCell
+			l.Sendch <- traced(ctx, geo)
+			endLocate(ctx, nil)
 			continue
 		}
-		// Geolocate
-		geo, err := l.getGeolocation(l.c)
 		if err != nil {
 			log.Println(err)
+			endLocate(ctx, err)
 			continue
 		}
-		// // Add the new data to the map
-		// l.mu.Lock()
-		// l.locs[l.c] = geo
-		// l.mu.Unlock()
-		// Format the data to {"key": "value"} maybe use function
-		// Add the new location to tha database
-		err = l.db.Post("locations", nil)
+		geo.Source = SourceCell
+		// Add the new data to the map
+		l.mu.Lock()
+		l.locs[c] = geo
+		l.mu.Unlock()
+		// Add the new location to the database, a failed post does not
+		// hold back the location
+		str, err := dbGeolocationInsertString(c, geo)
+		if err == nil {
+			err = storeWrite(ctx, l.db, "locations", []byte(str))
+		}
 		if err != nil {
 			log.Println(err)
-			continue
 		}
-		l.Sendch <- geo
+		l.Sendch <- traced(ctx, geo)
+		endLocate(ctx, nil)
 	}
 }
 
-// Get the geolocation using the geocoding api
-func (l *CellularLocator) getGeolocation(c Coordinates) (Geolocation, error) {
-	API_URI := os.Getenv("GEOCODING_API_URI")
-	API_KEY := os.Getenv("GEOCODING_API_KEY")
-	url := fmt.Sprintf("%slat=%f&lon=%f&format=json&apiKey=%s", API_URI, c.Lat, c.Lon, API_KEY)
-	// Call the api
-	// @TODO: add a client other the DefaultClient
-	res, err := http.Get(url)
-	if err != nil {
-		msg := fmt.Sprintf("geolocation response fail: %s", err.Error())
-		return Geolocation{}, errors.New(msg)
-	}
-	defer res.Body.Close()
-	// Decode the message
-	var loc geocodingResponse
-	if err := json.NewDecoder(res.Body).Decode(&loc); err != nil {
-		msg := fmt.Sprintf("cannot parse API response: %s", err)
-		return Geolocation{}, errors.New(msg)
+// Get the location coordinates using the OpenCellId API
+func (l *CellularLocator) getLatLon(ctx context.Context) (c Coordinates, err error) {
+	ctx, done := providerCall(ctx, "geolocation", "opencellid")
+	defer func() { done(err) }()
+	p := l.p.Get().OpenCellID
+	n := l.m.Status().Network
+	// The lac is the tracking area for lte and nr, the radio tells the
+	// database how to read the cell id
+	url := fmt.Sprintf(`%s?key=%s&mcc=%d&mnc=%d&lac=%d&cellid=%d&format=json`, p.URI, p.Key, n.Mcc, n.Mnc, n.Cell.Area(), n.Cell.ID)
+	if n.Cell.Radio != "" {
+		url += "&radio=" + n.Cell.Radio
 	}
-	geo := loc.Results[0]
-	return geo, nil
+	err = l.p.Client().Get(ctx, "opencellid", url, &c)
+	return c, err
 }
 
-// Get the location coordinates using the OpenCellId API
-func (l *CellularLocator) getLatLon() error {
-	url := fmt.Sprintf(`%s?key=%s&mcc=%d&mnc=%d&lac=%d&cellid=%d&format=json`, OPENCELLID_API_URI, OPENCELLID_API_KEY, l.m.Network.Mcc, l.m.Network.Mnc, l.m.Network.Lac, l.m.Network.Cid)
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	// Parse the response
-	if err := json.NewDecoder(resp.Body).Decode(&l.c); err != nil {
-		return err
+// Known coordinates and their locations
+func (l *CellularLocator) cacheEntries() []CacheEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries := make([]CacheEntry, 0, len(l.locs))
+	for c, geo := range l.locs {
+		entries = append(entries, CacheEntry{
+			Coordinates: c,
+			Location:    geo,
+		})
 	}
-	return nil
+	return entries
+}
+
+func (l *CellularLocator) purgeCache() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.locs)
+	l.locs = make(map[Coordinates]Geolocation)
+	return n
 }
@@ -0,0 +1,69 @@
+package geo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/provider"
+)
+
+// A cell is looked up once per cycle, its address comes from the cache
+// after the first one
+func TestCellLocatorCache(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/geoapify":
+			w.Write([]byte(`{"results":[{"name":"Piața Unirii","city":"Cluj-Napoca"}]}`))
+		default:
+			w.Write([]byte(`{"lat":46.7712,"lon":23.6236}`))
+		}
+	}))
+	defer srv.Close()
+
+	client, err := provider.NewClient(config.Default().HTTP, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProviders(config.Providers{
+		OpenCellID: config.Provider{URI: srv.URL + "/opencellid", Key: "key"},
+		Geoapify:   config.Provider{URI: srv.URL + "/geoapify?", Key: "key"},
+	}, client)
+
+	m := &modem.Modem{}
+	m.Network.Mcc, m.Network.Mnc = 226, 1
+	m.Network.Cell = modem.NewCell(modem.RADIO_GSM, 1, 1)
+	locch, sendch := make(chan struct{}), make(chan Geolocation)
+	l := NewCellLocator(m, p, &fakeStore{}, sendch, locch)
+	go l.Run()
+
+	for i := 0; i < 2; i++ {
+		locch <- struct{}{}
+		select {
+		case geo := <-sendch:
+			if geo.City != "Cluj-Napoca" || geo.Source != SourceCell {
+				t.Fatalf("location %+v, want the address of the cell", geo)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no location")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["/opencellid"] != 2 || calls["/geoapify"] != 1 {
+		t.Errorf("calls %v, want one opencellid call per cycle and one geoapify call", calls)
+	}
+	if n := len(l.cacheEntries()); n != 1 {
+		t.Errorf("%d cache entries, want the cell cached", n)
+	}
+}
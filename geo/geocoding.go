@@ -0,0 +1,56 @@
+package geo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mircearem/locater/provider"
+	"github.com/sirupsen/logrus"
+)
+
+// Returned with the coordinates alone while the geocoding budget is spent.
+// The locators still report them, but do not cache or store them so that
+// the address is looked up once the budget is renewed
+var ErrNoAddress = errors.New("no address")
+
+// Get the geolocation for a pair of coordinates using the geocoding api,
+// shared by every locator
+func reverseGeocode(ctx context.Context, providers *Providers, c Coordinates) (_ Geolocation, err error) {
+	ctx, done := providerCall(ctx, "reverse geocoding", "geoapify")
+	defer func() { done(err) }()
+	p := providers.Get().Geoapify
+	url := fmt.Sprintf("%slat=%f&lon=%f&format=json&apiKey=%s", p.URI, c.Lat, c.Lon, p.Key)
+	// Call the api
+	var loc geocodingResponse
+	err = providers.Client().Get(ctx, "geoapify", url, &loc)
+	if errors.Is(err, provider.ErrBudgetExhausted) {
+		// Report the coordinates without an address until the budget is
+		// renewed, rather than no location at all
+		logrus.Println(err)
+		return Geolocation{Lat: c.Lat, Lon: c.Lon}, fmt.Errorf("%w: %s", ErrNoAddress, err)
+	}
+	if err != nil {
+		return Geolocation{}, err
+	}
+	if len(loc.Results) == 0 {
+		return Geolocation{}, errors.New("geolocation response has no results")
+	}
+	r := loc.Results[0]
+	return Geolocation{
+		Name:         r.Name,
+		Country:      r.Country,
+		CountryCode:  r.CountryCode,
+		City:         r.City,
+		Postcode:     r.Postcode,
+		District:     r.District,
+		Suburb:       r.Suburb,
+		Street:       r.Street,
+		AddressLine1: r.AddressLine1,
+		Category:     r.Category,
+		// Keep the coordinates that were looked up, not the ones of the
+		// nearest address returned by the api
+		Lat: c.Lat,
+		Lon: c.Lon,
+	}, nil
+}
@@ -0,0 +1,40 @@
+package geo
+
+import "sync"
+
+// Number of fixes kept in memory by the server
+const HISTORY_SIZE = 1000
+
+// Ring buffer of the last accepted fixes
+type History struct {
+	mu    sync.RWMutex
+	fixes []Geolocation
+	next  int
+	full  bool
+}
+
+func NewHistory(size int) *History {
+	return &History{
+		fixes: make([]Geolocation, size),
+	}
+}
+
+func (h *History) add(geo Geolocation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fixes[h.next] = geo
+	h.next = (h.next + 1) % len(h.fixes)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Fixes in the order they were accepted
+func (h *History) List() []Geolocation {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.full {
+		return append([]Geolocation{}, h.fixes[:h.next]...)
+	}
+	return append(append([]Geolocation{}, h.fixes[h.next:]...), h.fixes[:h.next]...)
+}
@@ -0,0 +1,20 @@
+package geo
+
+import "testing"
+
+func TestHistoryWraps(t *testing.T) {
+	h := NewHistory(3)
+	for _, city := range []string{"Arad", "Brasov", "Cluj", "Deva"} {
+		h.add(Geolocation{City: city})
+	}
+
+	fixes := h.List()
+	if len(fixes) != 3 {
+		t.Fatalf("expected 3 fixes, got %d", len(fixes))
+	}
+	for i, city := range []string{"Brasov", "Cluj", "Deva"} {
+		if fixes[i].City != city {
+			t.Fatalf("expected %s at %d, got %s", city, i, fixes[i].City)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package geo
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/mircearem/locater/tracing"
+)
 
 type Locator interface {
 	Run()
@@ -8,6 +14,19 @@ type Locator interface {
 	// PutLocation()
 }
 
+// Implemented by the locators that keep known locations in memory
+type cache interface {
+	cacheEntries() []CacheEntry
+	purgeCache() int
+}
+
+// Known location, with the ip address it was found for if there is one
+type CacheEntry struct {
+	Ip          string      `json:"ip,omitempty"`
+	Coordinates Coordinates `json:"coordinates"`
+	Location    Geolocation `json:"location"`
+}
+
 type Coordinates struct {
 	Lat float64 `json:"lat"`
 	Lon float64 `json:"lon"`
@@ -15,30 +34,66 @@ type Coordinates struct {
 
 type geocodingResponse struct {
 	Results []struct {
-		Name         string `json:"name"`
-		Country      string `json:"country"`
-		CountryCode  string `json:"country_code"`
-		City         string `json:"city"`
-		Postcode     string `json:"postcode"`
-		District     string `json:"district"`
-		Suburb       string `json:"suburb"`
-		Street       string `json:"street"`
-		AddressLine1 string `json:"address_line1"`
-		Category     string `json:"category"`
+		Name         string  `json:"name"`
+		Country      string  `json:"country"`
+		CountryCode  string  `json:"country_code"`
+		City         string  `json:"city"`
+		Postcode     string  `json:"postcode"`
+		District     string  `json:"district"`
+		Suburb       string  `json:"suburb"`
+		Street       string  `json:"street"`
+		AddressLine1 string  `json:"address_line1"`
+		Category     string  `json:"category"`
+		Lat          float64 `json:"lat"`
+		Lon          float64 `json:"lon"`
 	} `json:"results"`
 }
 
+// Sources a geolocation can be computed from
+const (
+	SourceIP   = "ip"
+	SourceCell = "cell"
+	SourceWiFi = "wifi"
+	// Configured for a permanently installed device
+	SourceStatic = "static"
+	// Pinned by an operator through the api
+	SourceManual = "manual"
+	// Replayed from a recorded track
+	SourceSimulated = "simulated"
+)
+
 type Geolocation struct {
-	Name         string `json:"name"`
-	Country      string `json:"country"`
-	CountryCode  string `json:"country_code"`
-	City         string `json:"city"`
-	Postcode     string `json:"postcode"`
-	District     string `json:"district"`
-	Suburb       string `json:"suburb"`
-	Street       string `json:"street"`
-	AddressLine1 string `json:"address_line1"`
-	Category     string `json:"category"`
+	Name         string     `json:"name"`
+	Country      string     `json:"country"`
+	CountryCode  string     `json:"country_code"`
+	City         string     `json:"city"`
+	Postcode     string     `json:"postcode"`
+	District     string     `json:"district"`
+	Suburb       string     `json:"suburb"`
+	Street       string     `json:"street"`
+	AddressLine1 string     `json:"address_line1"`
+	Category     string     `json:"category"`
+	Lat          float64    `json:"lat"`
+	Lon          float64    `json:"lon"`
+	Accuracy     float64    `json:"accuracy,omitempty"` // radius in meters, when known
+	Source       string     `json:"source,omitempty"`
+	Timestamp    *time.Time `json:"timestamp,omitempty"` // when the fix was accepted, nil without a fix
+
+	traceparent string // of the locate cycle
+}
+
+// Time the fix was accepted, zero when there is no fix
+func (g Geolocation) FixTime() time.Time {
+	if g.Timestamp == nil {
+		return time.Time{}
+	}
+	return *g.Timestamp
+}
+
+// Context continuing the trace of the locate cycle of the location, for
+// the sinks queuing it
+func (g Geolocation) TraceContext() context.Context {
+	return tracing.WithTraceparent(context.Background(), g.traceparent)
 }
 
 // Format {"key":..., "value":...} string with key being the ip address
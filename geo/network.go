@@ -1,14 +1,12 @@
 package geo
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
-	"os"
 	"sync"
 
-	"github.com/mircearem/storer/store"
 	"github.com/sirupsen/logrus"
 )
 
@@ -52,27 +50,30 @@ type LanLocator struct {
 	Ip     string
 	Locch  chan struct{}    // channel that signals that it is time to check for a location change
 	Sendch chan Geolocation // channel used to update the location on the server
-	db     *store.Client    // database that stores locations
+	db     Store            // database that stores locations
+	p      *Providers
 	// channels signaling that the ip has been updated from the api
-	newipch chan struct{} // a new ip, not priorly found in the cache or in the db
-	mapipch chan struct{} // a new ip that is found in the map
-	dbipch  chan struct{} // a new ip that is found in the db
+	// with the trace of the locate cycle
+	newipch chan context.Context // a new ip, not priorly found in the cache or in the db
+	mapipch chan context.Context // a new ip that is found in the map
+	dbipch  chan context.Context // a new ip that is found in the db
 	// Caches of known ips and locations
 	mu   sync.RWMutex
 	ips  map[string]Coordinates
 	locs map[Coordinates]Geolocation
 }
 
-func NewLanLocator(locch chan struct{}, sendch chan Geolocation) *LanLocator {
-	client := store.NewClient("localhost:7777")
+func NewLanLocator(p *Providers, db Store, locch chan struct{}, sendch chan Geolocation) *LanLocator {
 	return &LanLocator{
-		db:      client,
+		db:      db,
+		p:       p,
 		Locch:   locch,
 		Sendch:  sendch,
 		ips:     make(map[string]Coordinates),
 		locs:    make(map[Coordinates]Geolocation),
-		newipch: make(chan struct{}),
-		mapipch: make(chan struct{}),
+		newipch: make(chan context.Context),
+		mapipch: make(chan context.Context),
+		dbipch:  make(chan context.Context),
 	}
 }
 
@@ -82,21 +83,25 @@ func (l *LanLocator) Run() {
 
 	for {
 		<-l.Locch
-		err := l.getIpAddress()
+		ctx := startLocate(SourceIP)
+		err := l.getIpAddress(ctx)
 		if err != nil {
+			endLocate(ctx, err)
 			continue
 		}
 		l.mu.RLock()
 		// Ip is in the map, it was already registered; retrieve
 		// the coordinates and the geolocation from the map
-		if _, ok := l.ips[l.Ip]; ok {
-			l.mapipch <- struct{}{}
+		_, ok := l.ips[l.Ip]
+		cacheLookup(ctx, "lan_ips", ok)
+		if ok {
+			l.mapipch <- ctx
 			l.mu.RUnlock()
 			continue
 		}
 		l.mu.RUnlock()
 		// Ip is not in the map, go check the database
-		l.dbipch <- struct{}{}
+		l.dbipch <- ctx
 	}
 }
 
@@ -105,32 +110,36 @@ func (l *LanLocator) Run() {
 func (l *LanLocator) handleOldLocation() {
 	for {
 		select {
-		case <-l.mapipch:
+		case ctx := <-l.mapipch:
 			// Ip address was found in the map
 			// get the relevant information from the map
 			l.mu.RLock()
 			c := l.ips[l.Ip]
-			geo := l.locs[c]
+			geo, ok := l.locs[c]
 			l.mu.RUnlock()
-			l.Sendch <- geo
-		case <-l.dbipch:
+			cacheLookup(ctx, "lan_locs", ok)
+			l.Sendch <- traced(ctx, geo)
+			endLocate(ctx, nil)
+		case ctx := <-l.dbipch:
 			// Ip address was not found in the map, go check the database
-			latlon, err := l.db.Get("remoteaddr", l.Ip)
+			latlon, err := storeLookup(ctx, l.db, "remoteaddr", l.Ip)
 			if err != nil || latlon == "" {
-				l.newipch <- struct{}{}
+				l.newipch <- ctx
 				continue
 			}
 			// Ip address found in the database, use the coordinates to get the geolocation
-			c, err := l.db.Get("locations", latlon)
+			c, err := storeLookup(ctx, l.db, "locations", latlon)
 			if err != nil || c == "" {
-				l.newipch <- struct{}{}
+				l.newipch <- ctx
 				continue
 			}
 			var geo Geolocation
 			if err := json.Unmarshal([]byte(c), &geo); err != nil {
+				endLocate(ctx, err)
 				continue
 			}
-			l.Sendch <- geo
+			l.Sendch <- traced(ctx, geo)
+			endLocate(ctx, nil)
 		}
 	}
 }
@@ -139,92 +148,70 @@ func (l *LanLocator) handleOldLocation() {
 // signal received through the <-newipch
 func (l *LanLocator) handleNewLocation() {
 	for {
-		<-l.newipch
+		ctx := <-l.newipch
 		// New registered ip, get coordinates and put it in the map
 		// and the database
-		c, err := l.getLatLon()
+		c, err := l.getLatLon(ctx)
 		if err != nil {
 			logrus.Println(err)
+			endLocate(ctx, err)
 			continue
 		}
 		// Geolocate
-		geo, err := l.getGeolocation(c)
+		geo, err := reverseGeocode(ctx, l.p, c)
+		if errors.Is(err, ErrNoAddress) {
+			// Reported, but looked up again on the next request
+			geo.Source = SourceIP
+			l.Sendch <- traced(ctx, geo)
+			endLocate(ctx, nil)
+			continue
+		}
 		if err != nil {
 			logrus.Println(err)
+			endLocate(ctx, err)
 			continue
 		}
+		geo.Source = SourceIP
 		// Add the new data to the map - use map as cache backup to not query the db so often
 		l.mu.Lock()
 		l.ips[l.Ip] = c
 		l.locs[c] = geo
 		l.mu.Unlock()
-		// Add the data to the database
+		// Add the data to the database, a failed post does not hold back
+		// the location
 		// Format key value pair for ip - coordinates
 		str, err := dbIpAddressInsertString(l.Ip, c)
-		if err != nil {
-			logrus.Println(err)
-			continue
+		if err == nil {
+			// Insert the ip - coordinates pair in the db
+			err = storeWrite(ctx, l.db, "remoteaddr", []byte(str))
 		}
-		// Insert the ip - coordinates pair in the db
-		if err = l.db.Post("remoteaddr", []byte(str)); err != nil {
+		if err != nil {
 			logrus.Println(err)
-			continue
 		}
 		// Format key value pair for coordinates - geolocation
 		str, err = dbGeolocationInsertString(c, geo)
-		if err != nil {
-			logrus.Println(err)
-			continue
+		if err == nil {
+			// Insert the coordinates - geolocation pair in the db
+			err = storeWrite(ctx, l.db, "geolocation", []byte(str))
 		}
-		// Insert the coordinates - geolocation pair in the db
-		if err = l.db.Post("geolocation", []byte(str)); err != nil {
+		if err != nil {
 			logrus.Println(err)
-			continue
 		}
-		l.Sendch <- geo
+		l.Sendch <- traced(ctx, geo)
+		endLocate(ctx, nil)
 	}
 }
 
-// Get the geolocation using
-func (l *LanLocator) getGeolocation(c Coordinates) (Geolocation, error) {
-	API_URI := os.Getenv("GEOCODING_API_URI")
-	API_KEY := os.Getenv("GEOCODING_API_KEY")
-	url := fmt.Sprintf("%slat=%f&lon=%f&format=json&apiKey=%s", API_URI, c.Lat, c.Lon, API_KEY)
-	// Call the api
-	// @TODO: add a client other the DefaultClient
-	res, err := http.Get(url)
-	if err != nil {
-		msg := fmt.Sprintf("geolocation response fail: %s", err.Error())
-		return Geolocation{}, errors.New(msg)
-	}
-	defer res.Body.Close()
-	// Decode the message
-	var loc geocodingResponse
-	if err := json.NewDecoder(res.Body).Decode(&loc); err != nil {
-		msg := fmt.Sprintf("cannot parse API response: %s", err)
-		return Geolocation{}, errors.New(msg)
-	}
-	geo := loc.Results[0]
-	return geo, nil
-}
-
 // Get location using ip2loc
-func (l *LanLocator) getLatLon() (Coordinates, error) {
-	API_URI := os.Getenv("IPLOCATION_API_URI")
-	API_KEY := os.Getenv("IPLOCATION_API_KEY")
-	url := fmt.Sprintf("%s/%s/%s", API_URI, API_KEY, l.Ip)
+func (l *LanLocator) getLatLon(ctx context.Context) (_ Coordinates, err error) {
+	ctx, done := providerCall(ctx, "geolocation", "ip2loc")
+	defer func() { done(err) }()
+	p := l.p.Get().IP2Loc
+	url := fmt.Sprintf("%s/%s/%s", p.URI, p.Key, l.Ip)
 
-	res, err := http.Get(url)
-	if err != nil {
-		msg := fmt.Sprintf("ip2loc response fail: %s", err.Error())
-		return Coordinates{}, errors.New(msg)
-	}
-	defer res.Body.Close()
-	// Decode the message
 	latlon := new(Ip2LocStruct)
-	if err := json.NewDecoder(res.Body).Decode(latlon); err != nil {
-		msg := fmt.Sprintf("cannot parse API response: %s", err)
-		return Coordinates{}, errors.New(msg)
+	if err := l.p.Client().Get(ctx, "ip2loc", url, latlon); err != nil {
+		return Coordinates{}, err
 	}
 	return Coordinates{
 		Lat: latlon.Location.Latitude,
@@ -233,34 +220,48 @@ func (l *LanLocator) getLatLon() (Coordinates, error) {
 }
 
 // Get the IP address using ipify
-func (l *LanLocator) getIpAddress() error {
+func (l *LanLocator) getIpAddress(ctx context.Context) (err error) {
+	ctx, done := providerCall(ctx, "ip lookup", "ipify")
+	defer func() { done(err) }()
 	// Get the IP address of the server
-	API_URI := os.Getenv("IPIFY_API_URI")
-	res, err := http.Get(API_URI)
-
-	// Check for request errors
-	if err != nil {
-		return fmt.Errorf("ipify response fail: %s", err.Error())
+	var res struct {
+		IP string `json:"ip"`
 	}
-	defer res.Body.Close()
-
-	// Check error when reading body
-	if err != nil {
-		return fmt.Errorf("ipify response parsing fail: %s", err.Error())
+	if err := l.p.Client().Get(ctx, "ipify", l.p.Get().Ipify.URI, &res); err != nil {
+		return err
 	}
-	respJson := make(map[string]interface{})
-
-	err = json.NewDecoder(res.Body).Decode(&respJson)
-	// Check error when unmarshalling json
-	if err != nil {
-		return fmt.Errorf("json unmarshall error: %s", err.Error())
+	if res.IP == "" {
+		return errors.New("ipify response has no ip address")
 	}
-	ip := respJson["ip"].(string)
-	l.Ip = ip
+	l.Ip = res.IP
 
 	return nil
 }
 
+// Known ip addresses and their locations
+func (l *LanLocator) cacheEntries() []CacheEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entries := make([]CacheEntry, 0, len(l.ips))
+	for ip, c := range l.ips {
+		entries = append(entries, CacheEntry{
+			Ip:          ip,
+			Coordinates: c,
+			Location:    l.locs[c],
+		})
+	}
+	return entries
+}
+
+func (l *LanLocator) purgeCache() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.ips)
+	l.ips = make(map[string]Coordinates)
+	l.locs = make(map[Coordinates]Geolocation)
+	return n
+}
+
 // Run these functions as go routines in the background
 // listening to channels to begin querying the database
 // for information
@@ -0,0 +1,94 @@
+package geo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/provider"
+)
+
+type fakeStore struct {
+	mu    sync.Mutex
+	posts int
+}
+
+func (s *fakeStore) Get(collection, key string) (string, error) { return "", nil }
+
+func (s *fakeStore) Post(collection string, data []byte) error {
+	s.mu.Lock()
+	s.posts++
+	s.mu.Unlock()
+	return nil
+}
+
+func TestLanLocatorNoAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ipify":
+			w.Write([]byte(`{"ip":"203.0.113.10"}`))
+		case "/geoapify":
+			w.Write([]byte(`{"results":[{"name":"Piața Unirii","city":"Cluj-Napoca"}]}`))
+		default:
+			w.Write([]byte(`{"location":{"latitude":46.7712,"longitude":23.6236},"success":true}`))
+		}
+	}))
+	defer srv.Close()
+
+	// The geocoding budget is spent
+	quota, err := provider.OpenQuota(config.Quota{Path: filepath.Join(t.TempDir(), "quota.json"), SlowdownAt: 0.8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota.Count("geoapify")
+	client, err := provider.NewClient(config.Default().HTTP, quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Providers{
+		Ipify:    config.Provider{URI: srv.URL + "/ipify"},
+		IP2Loc:   config.Provider{URI: srv.URL + "/ip2loc", Key: "key"},
+		Geoapify: config.Provider{URI: srv.URL + "/geoapify?", Key: "key", DailyBudget: 1},
+	}
+	p := NewProviders(cfg, client)
+
+	db := &fakeStore{}
+	locch, sendch := make(chan struct{}), make(chan Geolocation)
+	l := NewLanLocator(p, db, locch, sendch)
+	go l.Run()
+
+	locate := func() Geolocation {
+		t.Helper()
+		locch <- struct{}{}
+		select {
+		case geo := <-sendch:
+			return geo
+		case <-time.After(5 * time.Second):
+			t.Fatal("no location")
+		}
+		return Geolocation{}
+	}
+
+	// Reported without an address, neither cached nor stored
+	geo := locate()
+	if geo.Lat != 46.7712 || geo.City != "" || geo.Source != SourceIP {
+		t.Errorf("location %+v, want the coordinates alone", geo)
+	}
+	if n := len(l.cacheEntries()); n != 0 || db.posts != 0 {
+		t.Errorf("%d cache entries and %d posts without an address", n, db.posts)
+	}
+
+	// Looked up again once the budget is renewed
+	cfg.Geoapify.DailyBudget = 0
+	p.Set(cfg)
+	if geo := locate(); geo.City != "Cluj-Napoca" {
+		t.Errorf("location %+v, want the address", geo)
+	}
+	if n := len(l.cacheEntries()); n != 1 {
+		t.Errorf("%d cache entries, want the address cached", n)
+	}
+}
@@ -0,0 +1,189 @@
+package geo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/provider"
+	"github.com/mircearem/storer/store"
+)
+
+// Source used by the daemon for this configuration
+func DefaultSource(cfg *config.Config) string {
+	switch {
+	case cfg.Simulation.Track != "":
+		return SourceSimulated
+	case cfg.Static.Lat != nil && cfg.Static.Lon != nil:
+		return SourceStatic
+	case cfg.WiFi.Interface != "":
+		return SourceWiFi
+	case cfg.HasModem():
+		return SourceCell
+	}
+	return SourceIP
+}
+
+// Locate the device once using a single source, bypassing the caches
+func Locate(ctx context.Context, cfg *config.Config, source string) (Geolocation, error) {
+	// The provider counters belong to the daemon, a single call is not
+	// counted against the budgets
+	client, err := provider.NewClient(cfg.HTTP, nil)
+	if err != nil {
+		return Geolocation{}, err
+	}
+	p := NewProviders(cfg.Providers, client)
+
+	var c Coordinates
+	var accuracy float64
+	switch source {
+	case SourceStatic:
+		if cfg.Static.Lat == nil || cfg.Static.Lon == nil {
+			return Geolocation{}, errors.New("no static location configured")
+		}
+		c = Coordinates{Lat: *cfg.Static.Lat, Lon: *cfg.Static.Lon}
+		if cfg.Static.Address != "" {
+			now := time.Now()
+			return Geolocation{
+				Name:         cfg.Static.Address,
+				AddressLine1: cfg.Static.Address,
+				Lat:          c.Lat,
+				Lon:          c.Lon,
+				Source:       SourceStatic,
+				Timestamp:    &now,
+			}, nil
+		}
+	case SourceIP:
+		l := NewLanLocator(p, store.NewClient(cfg.Store.Addr), nil, nil)
+		if err := l.getIpAddress(ctx); err != nil {
+			return Geolocation{}, err
+		}
+		latlon, err := l.getLatLon(ctx)
+		if err != nil {
+			return Geolocation{}, err
+		}
+		c = latlon
+	case SourceSimulated:
+		if cfg.Simulation.Track == "" {
+			return Geolocation{}, errors.New("no simulated track configured")
+		}
+		l, err := NewSimulatedLocator(cfg.Simulation, cfg.Interval, p, nil, nil)
+		if err != nil {
+			return Geolocation{}, err
+		}
+		// The start of the track
+		return l.locate(ctx), nil
+	case SourceCell:
+		m, err := OpenModem(ctx, cfg)
+		if err != nil {
+			return Geolocation{}, fmt.Errorf("no modem: %s", err)
+		}
+		if err := m.Init(); err != nil {
+			return Geolocation{}, err
+		}
+		l := NewCellLocator(m, p, store.NewClient(cfg.Store.Addr), nil, nil)
+		if c, err = l.getLatLon(ctx); err != nil {
+			return Geolocation{}, err
+		}
+	case SourceWiFi:
+		// The serving cell is added when a modem is present
+		m, err := OpenModem(ctx, cfg)
+		if err == nil && m.Init() != nil {
+			m = nil
+		}
+		l := NewWiFiLocator(cfg.WiFi, p, m, nil, nil)
+		aps, err := l.scan(ctx)
+		if err != nil {
+			return Geolocation{}, err
+		}
+		latlon, acc, err := l.getLatLon(ctx, aps, l.cellTowers())
+		if err != nil {
+			return Geolocation{}, err
+		}
+		c, accuracy = latlon, acc
+	default:
+		return Geolocation{}, fmt.Errorf("unknown source %q", source)
+	}
+
+	geo, err := reverseGeocode(ctx, p, c)
+	if err != nil && !errors.Is(err, ErrNoAddress) {
+		return Geolocation{}, err
+	}
+	geo.Accuracy = accuracy
+	now := time.Now()
+	geo.Source = source
+	geo.Timestamp = &now
+	return geo, nil
+}
+
+// Outcome of a single call to a provider
+type ProviderCheck struct {
+	Provider string        `json:"provider"`
+	Latency  time.Duration `json:"latency"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Call every configured provider once with a known request, to check
+// the endpoints and the keys
+func CheckProviders(cfg *config.Config) ([]ProviderCheck, error) {
+	// A single attempt, the latency is the one of the provider
+	h := cfg.HTTP
+	h.MaxAttempts = 1
+	client, err := provider.NewClient(h, nil)
+	if err != nil {
+		return nil, err
+	}
+	p := NewProviders(cfg.Providers, client)
+	// Fixed request parameters, the answers are not relevant
+	sample := Coordinates{Lat: 46.7712, Lon: 23.6236}
+
+	lan := NewLanLocator(p, store.NewClient(cfg.Store.Addr), nil, nil)
+	cell := NewCellLocator(&modem.Modem{}, p, store.NewClient(cfg.Store.Addr), nil, nil)
+	cell.m.Network.Mcc, cell.m.Network.Mnc, cell.m.Network.Lac, cell.m.Network.Cid = 226, 1, 1, 1
+	cell.m.Network.Cell = modem.NewCell(modem.RADIO_GSM, 1, 1)
+	wifi := NewWiFiLocator(cfg.WiFi, p, nil, nil, nil)
+
+	checks := []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{"ipify", lan.getIpAddress},
+		{"ip2loc", func(ctx context.Context) error {
+			if lan.Ip == "" {
+				lan.Ip = "8.8.8.8"
+			}
+			_, err := lan.getLatLon(ctx)
+			return err
+		}},
+		{"opencellid", func(ctx context.Context) error {
+			_, err := cell.getLatLon(ctx)
+			return err
+		}},
+		{"geolocate", func(ctx context.Context) error {
+			_, _, err := wifi.getLatLon(ctx, nil, []CellTower{{MobileCountryCode: 226, MobileNetworkCode: 1, LocationAreaCode: 1, CellId: 1}})
+			return err
+		}},
+		{"geoapify", func(ctx context.Context) error {
+			_, err := reverseGeocode(ctx, p, sample)
+			return err
+		}},
+	}
+
+	results := make([]ProviderCheck, 0, len(checks))
+	for _, check := range checks {
+		start := time.Now()
+		err := check.call(context.Background())
+		res := ProviderCheck{
+			Provider: check.name,
+			Latency:  time.Since(start),
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
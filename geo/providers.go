@@ -0,0 +1,52 @@
+package geo
+
+import (
+	"sync"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/provider"
+)
+
+// Provider settings shared by the server and its locator, replaced when
+// the configuration is reloaded, and the client calling them
+type Providers struct {
+	mu     sync.RWMutex
+	p      config.Providers
+	client *provider.Client
+}
+
+func NewProviders(p config.Providers, client *provider.Client) *Providers {
+	providers := &Providers{client: client}
+	providers.Set(p)
+	return providers
+}
+
+func (p *Providers) Get() config.Providers {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.p
+}
+
+func (p *Providers) Set(providers config.Providers) {
+	p.mu.Lock()
+	p.p = providers
+	p.mu.Unlock()
+
+	keys := make([]string, 0)
+	for _, pr := range providers.ByName() {
+		keys = append(keys, pr.Key)
+	}
+	p.client.SetSecrets(keys)
+	if q := p.client.Quota(); q != nil {
+		budgets := make(map[string]provider.Budget)
+		for name, pr := range providers.ByName() {
+			budgets[name] = provider.Budget{Daily: pr.DailyBudget, Monthly: pr.MonthlyBudget}
+		}
+		q.SetBudgets(budgets)
+	}
+}
+
+// Http client of the provider apis
+func (p *Providers) Client() *provider.Client {
+	return p.client
+}
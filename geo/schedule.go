@@ -0,0 +1,150 @@
+package geo
+
+import (
+	"math"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/cron"
+)
+
+// Why the next locate request is at its time
+const (
+	SCHEDULE_BASE      = "base"
+	SCHEDULE_BACKOFF   = "backoff"   // after failed requests
+	SCHEDULE_FAST      = "fast"      // after a movement or a handover
+	SCHEDULE_HEARTBEAT = "heartbeat" // the device is stationary
+	SCHEDULE_QUIET     = "quiet"     // postponed to the end of a quiet window
+)
+
+// Longest quiet window that is skipped, a window matching every minute
+// would otherwise never end
+const MAX_QUIET = 7 * 24 * time.Hour
+
+// Mean radius of the earth in meters
+const EARTH_RADIUS = 6371000
+
+// Delay between the locate requests, adapted to the failures and the
+// movements of the device
+type Scheduler struct {
+	cfg       config.Schedule
+	base      time.Duration
+	quiet     []*cron.Expr
+	failures  int // consecutive failed requests
+	fastUntil time.Time
+	moved     time.Time // last movement, the start until the device moves
+	last      *Coordinates
+	cell      string // serving cell, to detect the handovers
+}
+
+func NewScheduler(base time.Duration, cfg config.Schedule, now time.Time) (*Scheduler, error) {
+	s := &Scheduler{
+		cfg:   cfg,
+		base:  base,
+		moved: now,
+	}
+	for _, q := range cfg.Quiet {
+		e, err := cron.Parse(q)
+		if err != nil {
+			return nil, err
+		}
+		s.quiet = append(s.quiet, e)
+	}
+	return s, nil
+}
+
+// Change the base interval, after a configuration reload
+func (s *Scheduler) SetBase(d time.Duration) {
+	s.base = d
+}
+
+// A request got no location
+func (s *Scheduler) Failed() {
+	s.failures++
+}
+
+// A location was received, it is a movement when it is farther than the
+// move distance from the previous one
+func (s *Scheduler) Located(geo Geolocation, now time.Time) {
+	s.failures = 0
+	c := Coordinates{Lat: geo.Lat, Lon: geo.Lon}
+	if s.last != nil && s.cfg.MoveDistance > 0 && distance(*s.last, c) > s.cfg.MoveDistance {
+		s.movement(now)
+	}
+	s.last = &c
+}
+
+// The modem is served by a cell, another one than the previous is a
+// handover and the device is likely moving
+func (s *Scheduler) Cell(cell string, now time.Time) {
+	if s.cell != "" && cell != s.cell {
+		s.movement(now)
+	}
+	s.cell = cell
+}
+
+func (s *Scheduler) movement(now time.Time) {
+	s.moved = now
+	s.fastUntil = now.Add(s.cfg.FastFor)
+}
+
+// Delay until the next request and why, the slowdown multiplies it while
+// a provider is close to its budget. The quiet windows are skipped
+func (s *Scheduler) Next(now time.Time, slowdown int) (time.Duration, string) {
+	d, reason := s.base, SCHEDULE_BASE
+	switch {
+	case s.failures > 0 && s.cfg.MaxBackoff > 0:
+		for i := 0; i < s.failures && d < s.cfg.MaxBackoff; i++ {
+			d *= 2
+		}
+		d = max(min(d, s.cfg.MaxBackoff), s.base)
+		reason = SCHEDULE_BACKOFF
+	case s.cfg.FastInterval > 0 && now.Before(s.fastUntil):
+		d, reason = s.cfg.FastInterval, SCHEDULE_FAST
+	case s.cfg.Heartbeat > 0 && now.Sub(s.moved) >= s.cfg.StationaryAfter:
+		d, reason = s.cfg.Heartbeat, SCHEDULE_HEARTBEAT
+	}
+	if slowdown > 1 {
+		d *= time.Duration(slowdown)
+	}
+	return s.skipQuiet(now, d, reason)
+}
+
+// Delay until the first request, right away unless it is in a quiet
+// window
+func (s *Scheduler) First(now time.Time) (time.Duration, string) {
+	return s.skipQuiet(now, 0, SCHEDULE_BASE)
+}
+
+// Postpone a request in a quiet window to the end of the window
+func (s *Scheduler) skipQuiet(now time.Time, d time.Duration, reason string) (time.Duration, string) {
+	at := now.Add(d)
+	if !s.isQuiet(at) {
+		return d, reason
+	}
+	// The first minute out of the window
+	at = at.Truncate(time.Minute)
+	for limit := at.Add(MAX_QUIET); s.isQuiet(at) && at.Before(limit); {
+		at = at.Add(time.Minute)
+	}
+	return at.Sub(now), SCHEDULE_QUIET
+}
+
+func (s *Scheduler) isQuiet(t time.Time) bool {
+	for _, q := range s.quiet {
+		if q.Match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Great circle distance in meters
+func distance(a, b Coordinates) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLon := (b.Lon - a.Lon) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EARTH_RADIUS * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,81 @@
+package geo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+)
+
+func TestScheduler(t *testing.T) {
+	start := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	cfg := config.Default().Schedule
+	s, err := NewScheduler(10*time.Second, cfg, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(now time.Time, want time.Duration, reason string) {
+		t.Helper()
+		if d, r := s.Next(now, 1); d != want || r != reason {
+			t.Errorf("next %s (%s), want %s (%s)", d, r, want, reason)
+		}
+	}
+	cluj := Geolocation{Lat: 46.7712, Lon: 23.6236}
+	next(start, 10*time.Second, SCHEDULE_BASE)
+
+	// Doubled on every failure, up to the max backoff
+	s.Failed()
+	s.Failed()
+	next(start, 40*time.Second, SCHEDULE_BACKOFF)
+	for i := 0; i < 10; i++ {
+		s.Failed()
+	}
+	next(start, cfg.MaxBackoff, SCHEDULE_BACKOFF)
+	s.Located(cluj, start)
+	next(start, 10*time.Second, SCHEDULE_BASE)
+	if d, _ := s.Next(start, 4); d != 40*time.Second {
+		t.Errorf("next %s with a slowdown of 4", d)
+	}
+
+	// Fast after a movement, for a while
+	now := start.Add(time.Minute)
+	s.Located(Geolocation{Lat: 46.7800, Lon: 23.6236}, now) // about 1km north
+	next(now, cfg.FastInterval, SCHEDULE_FAST)
+	now = now.Add(cfg.FastFor)
+	next(now, 10*time.Second, SCHEDULE_BASE)
+
+	// A close fix is not a movement, the heartbeat once stationary
+	s.Located(Geolocation{Lat: 46.7801, Lon: 23.6236}, now)
+	now = now.Add(cfg.StationaryAfter)
+	next(now, cfg.Heartbeat, SCHEDULE_HEARTBEAT)
+
+	// A handover is a movement
+	s.Cell("22610 LTE tac 10301 eci 1", now)
+	s.Cell("22610 LTE tac 10301 eci 2", now)
+	next(now, cfg.FastInterval, SCHEDULE_FAST)
+
+	// Postponed to the end of the quiet window
+	cfg.Quiet = []string{"* 22-23,0-5 * * *"}
+	s, err = NewScheduler(10*time.Second, cfg, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	night := time.Date(2024, 1, 15, 21, 59, 55, 0, time.UTC)
+	next(night, 8*time.Hour+5*time.Second, SCHEDULE_QUIET)
+
+	// The first request is right away, out of the quiet windows
+	if d, r := s.First(start); d != 0 || r != SCHEDULE_BASE {
+		t.Errorf("first request in %s (%s), want right away", d, r)
+	}
+	if d, r := s.First(night.Add(time.Hour)); d != 7*time.Hour+5*time.Second || r != SCHEDULE_QUIET {
+		t.Errorf("first request at night in %s (%s), want the end of the window", d, r)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	// Cluj-Napoca to Bucharest, about 325km
+	d := distance(Coordinates{Lat: 46.7712, Lon: 23.6236}, Coordinates{Lat: 44.4268, Lon: 26.1025})
+	if d < 320000 || d > 330000 {
+		t.Errorf("distance %.0fm", d)
+	}
+}
@@ -3,91 +3,521 @@ package geo
 import (
 	"context"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/metrics"
 	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/outbox"
+	"github.com/mircearem/locater/provider"
+	"github.com/mircearem/storer/store"
 )
 
 // Embed the database into the server
 type Server struct {
 	Location  Geolocation
+	mu        sync.RWMutex
+	override  *Override
+	locator   Locator
+	history   *History
+	subs      []chan Geolocation
 	ctx       context.Context
+	cfg       *config.Config
+	providers *Providers
+	interval  chan time.Duration // new interval after a configuration reload
+	reloadMu  sync.Mutex         // one reload at a time
+	reloaders map[string]ReloadFunc
 	m         *modem.Modem
+	box       *outbox.Outbox // store posts go through it, direct when nil
 	locRecvch chan Geolocation
 	locch     chan struct{}
+	requested time.Time // oldest locate request not answered yet
+	nextAt    time.Time // of the next scheduled request
+	reason    string    // of the next request, see the SCHEDULE constants
+	slowed    bool      // the next request is delayed to save the budgets
 	quitch    chan struct{}
 }
 
-func NewServer(ctx context.Context) *Server {
-	m, err := modem.NewModem(ctx)
-	// No modem is available, geolocation done using ip2loc solution
+func NewServer(ctx context.Context, cfg *config.Config, box *outbox.Outbox, quota *provider.Quota) (*Server, error) {
+	client, err := provider.NewClient(cfg.HTTP, quota)
 	if err != nil {
-		return &Server{
-			m:         nil,
-			ctx:       ctx,
-			locch:     make(chan struct{}),
-			locRecvch: make(chan Geolocation),
-			quitch:    make(chan struct{}),
-		}
+		return nil, err
 	}
-	// A modem is available, geolocation done using OpenCellId
-	return &Server{
-		m:         m,
+	s := &Server{
+		box:       box,
 		ctx:       ctx,
-		locch:     make(chan struct{}),
+		cfg:       cfg,
+		providers: NewProviders(cfg.Providers, client),
+		history:   NewHistory(HISTORY_SIZE),
+		interval:  make(chan time.Duration, 1),
+		reloaders: make(map[string]ReloadFunc),
+		reason:    SCHEDULE_BASE,
+		locch:     make(chan struct{}, 1),
 		locRecvch: make(chan Geolocation),
 		quitch:    make(chan struct{}),
 	}
+	// A modem is available, geolocation done using OpenCellId, otherwise
+	// using ip2loc
+	m, err := OpenModem(ctx, cfg)
+	if err == nil {
+		s.m = m
+	} else if cfg.Simulation.Modem != "" {
+		return nil, err
+	}
+	// Only the daemon keeps the sim, the commands would hide the swaps.
+	// The modem is read before the sinks are built, their topics and ids
+	// can hold the imei
+	if s.m != nil {
+		if err := s.m.SetSimFile(cfg.Modem.SimFile); err != nil {
+			return nil, err
+		}
+		if err := s.m.Init(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 // How to handle the geolocation
 func (s *Server) Start() error {
-	// Initialize the modem
-	// Modem present, normal case geolocate using OpenCellId
-	if s.m != nil {
-		// Initialize the modem
-		if err := s.m.Init(); err != nil {
+	var locator Locator
+	if s.cfg.Simulation.Track != "" {
+		// Demo or test, the device follows a recorded track. The modem,
+		// simulated or not, is still read for the status and the sinks
+		if s.m != nil {
+			go s.m.Run()
+		}
+		l, err := NewSimulatedLocator(s.cfg.Simulation, s.cfg.Interval, s.providers, s.locch, s.locRecvch)
+		if err != nil {
 			return err
 		}
-
-		locator := NewCellLocator(s.m, s.locRecvch, s.locch)
+		locator = l
+		log.Println("Starting Geolocation Server with Simulated Locator")
+	} else if st := s.cfg.Static; st.Lat != nil && st.Lon != nil {
+		// Location configured by the operator, the device never moves
+		c := Coordinates{Lat: *st.Lat, Lon: *st.Lon}
+		locator = NewStaticLocator(c, st.Address, s.providers, s.locch, s.locRecvch)
+		log.Println("Starting Geolocation Server with Static Locator")
+	} else if s.cfg.WiFi.Interface != "" {
+		// Wireless interface configured, geolocate using the visible access
+		// points, adding the serving cell when a modem is present
+		if s.m != nil {
+			go s.m.Run()
+		}
+		locator = NewWiFiLocator(s.cfg.WiFi, s.providers, s.m, s.locch, s.locRecvch)
+		log.Println("Starting Geolocation Server with WiFi Locator")
+	} else if s.m != nil {
+		// Modem present, normal case geolocate using OpenCellId, the modem
+		// was initialized with the server
+		db, err := s.store()
+		if err != nil {
+			return err
+		}
+		locator = NewCellLocator(s.m, s.providers, db, s.locRecvch, s.locch)
 
 		// run the modem
 		go s.m.Run()
-		// run the location service
-		go s.handleLocating(locator)
 		log.Println("Starting Geolocation Server with Cellular Locator")
 	} else {
 		// Modem not present, fallback case geolocate using ip
-		locator := NewLanLocator(s.locch, s.locRecvch)
-		go s.handleLocating(locator)
+		db, err := s.store()
+		if err != nil {
+			return err
+		}
+		locator = NewLanLocator(s.providers, db, s.locch, s.locRecvch)
 		log.Println("Starting Geolocation Server with LAN Locator")
 	}
 
-	// Send first request right away
-	s.locch <- struct{}{}
+	// run the location service
+	s.mu.Lock()
+	s.locator = locator
+	s.mu.Unlock()
+	go s.handleLocating(locator)
 
-	// Ticker that delays the requests
-	ticker := time.NewTicker(10 * time.Second)
+	// Timer of the next request, scheduled after every request and every
+	// location received. The first one is right away, out of the quiet
+	// windows
+	sched, err := NewScheduler(s.cfg.Interval, s.cfg.Schedule, time.Now())
+	if err != nil {
+		return err
+	}
+	d, reason := sched.First(time.Now())
+	timer := time.NewTimer(s.scheduled(d, reason, false))
 
 	for {
 		select {
-		case <-ticker.C:
+		case d := <-s.interval:
+			sched.SetBase(d)
+			resetTimer(timer, s.schedule(sched))
+			log.Printf("Location update interval changed to %s\n", d)
+		case <-timer.C:
+			// The previous request was not answered in time
+			s.mu.RLock()
+			failed := !s.requested.IsZero()
+			s.mu.RUnlock()
+			if failed {
+				sched.Failed()
+			}
+			if s.m != nil {
+				n := s.m.Status().Network
+				sched.Cell(n.Plmn+" "+n.Cell.String(), time.Now())
+			}
 			// Instruct the locator to update the location
-			s.locch <- struct{}{}
+			s.trigger()
+			timer.Reset(s.schedule(sched))
 		case geo := <-s.locRecvch:
 			// New geolocation received, do something with it, store it in db and map
+			// The records stored before the timestamps were optional
+			// have a zero one
+			if geo.FixTime().IsZero() {
+				now := time.Now()
+				geo.Timestamp = &now
+			}
+			s.mu.Lock()
 			s.Location = geo
+			if !s.requested.IsZero() {
+				metrics.ObserveLocate(time.Since(s.requested))
+				s.requested = time.Time{}
+			}
+			s.mu.Unlock()
+			sched.Located(geo, time.Now())
+			resetTimer(timer, s.schedule(sched))
+			metrics.ObserveFix(*geo.Timestamp, geo.Accuracy, geo.Source)
+			s.history.add(geo)
+			s.publish(s.Current())
 			log.Printf("New geolocation received: \n%+v\n", geo)
 		case <-s.quitch:
-			ticker.Stop()
+			timer.Stop()
 			return nil
 		}
 	}
 }
 
+// Make Start return
+func (s *Server) Stop() {
+	close(s.quitch)
+}
+
+// Store of the known locations, posting through the outbox when there is one
+func (s *Server) store() (Store, error) {
+	c := store.NewClient(s.cfg.Store.Addr)
+	if s.box == nil {
+		return c, nil
+	}
+	return NewOutboxStore(c, s.box)
+}
+
+// Delay until the next request, multiplied while a provider is past the
+// slowdown share of its budget
+func (s *Server) schedule(sched *Scheduler) time.Duration {
+	slowdown := 1
+	if q := s.providers.Client().Quota(); q != nil && q.Near() {
+		s.mu.RLock()
+		slowdown = s.cfg.Quota.SlowdownFactor
+		s.mu.RUnlock()
+	}
+	d, reason := sched.Next(time.Now(), slowdown)
+	return s.scheduled(d, reason, slowdown > 1)
+}
+
+// Keep the time of the next request for the status
+func (s *Server) scheduled(d time.Duration, reason string, slowed bool) time.Duration {
+	s.mu.Lock()
+	changed := reason != s.reason || slowed != s.slowed
+	s.nextAt, s.reason, s.slowed = time.Now().Add(d), reason, slowed
+	s.mu.Unlock()
+	if changed {
+		log.Printf("Next location update in %s (%s, slowdown %v)\n", d.Round(time.Second), reason, slowed)
+	}
+	return d
+}
+
+// Reset a timer that may have fired without being read
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// Summary of the server and of the provider budgets
+type Status struct {
+	Device   string           `json:"device"`
+	Location Geolocation      `json:"location"`
+	Interval string           `json:"interval"` // between the locate requests, before the adaptive schedule
+	Next     string           `json:"next"`     // until the next scheduled locate request
+	Schedule string           `json:"schedule"` // why the request is then, see the SCHEDULE constants
+	Slowdown bool             `json:"slowdown"` // the intervals are raised to save the budgets
+	Quota    []provider.Usage `json:"quota"`
+}
+
+func (s *Server) Status() Status {
+	s.mu.RLock()
+	interval := s.cfg.Interval
+	if s.slowed {
+		interval *= time.Duration(s.cfg.Quota.SlowdownFactor)
+	}
+	st := Status{
+		Device:   s.cfg.DeviceID,
+		Interval: interval.String(),
+		Schedule: s.reason,
+		Slowdown: s.slowed,
+		Quota:    make([]provider.Usage, 0),
+	}
+	if !s.nextAt.IsZero() {
+		st.Next = max(time.Until(s.nextAt), 0).Round(time.Second).String()
+	}
+	s.mu.RUnlock()
+
+	st.Location = s.Current()
+	if q := s.providers.Client().Quota(); q != nil {
+		st.Quota = q.Usage()
+	}
+	return st
+}
+
+// Ask the locator for a new location. A request that is already waiting
+// covers this one, and the server never blocks on a busy locator
+func (s *Server) trigger() {
+	select {
+	case s.locch <- struct{}{}:
+		s.mu.Lock()
+		if s.requested.IsZero() {
+			s.requested = time.Now()
+		}
+		s.mu.Unlock()
+	default:
+	}
+}
+
+// Locate right away instead of waiting for the next tick
+func (s *Server) Relocate() {
+	s.trigger()
+}
+
 // Wrapper function to run the locator
 func (s *Server) handleLocating(loc Locator) {
 	// Run the locator
 	loc.Run()
 }
+
+// Location pinned by an operator, reported instead of the computed fixes
+// until it is cleared or it expires
+type Override struct {
+	Geolocation
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil when it stays until cleared
+}
+
+func (o *Override) expired() bool {
+	return o.ExpiresAt != nil && time.Now().After(*o.ExpiresAt)
+}
+
+// Current location of the device, the override takes precedence over
+// the computed fixes while it is active
+func (s *Server) Current() Geolocation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.override != nil && !s.override.expired() {
+		return s.override.Geolocation
+	}
+	return s.Location
+}
+
+// Pin the location of the device, a zero expiry keeps the override until
+// it is cleared. The address is looked up if none was given
+func (s *Server) SetOverride(loc Geolocation, expiresAt time.Time) Override {
+	if loc.Name == "" && loc.AddressLine1 == "" {
+		geo, err := reverseGeocode(s.ctx, s.providers, Coordinates{Lat: loc.Lat, Lon: loc.Lon})
+		if err != nil {
+			log.Println(err)
+		} else {
+			geo.Accuracy = loc.Accuracy
+			loc = geo
+		}
+	}
+	// The sinks read a fix without a time as no fix
+	now := time.Now()
+	loc.Source = SourceManual
+	loc.Timestamp = &now
+
+	o := &Override{Geolocation: loc}
+	if !expiresAt.IsZero() {
+		o.ExpiresAt = &expiresAt
+	}
+	s.mu.Lock()
+	s.override = o
+	s.mu.Unlock()
+	log.Printf("Location override set: \n%+v\n", *o)
+	s.publish(o.Geolocation)
+
+	return *o
+}
+
+// Get the active override, if any
+func (s *Server) GetOverride() (Override, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.override == nil || s.override.expired() {
+		return Override{}, false
+	}
+	return *s.override, true
+}
+
+// Remove the override, the computed fixes are reported again. The sinks
+// are given the computed location right away, if there is one
+func (s *Server) ClearOverride() {
+	s.mu.Lock()
+	cleared := s.override != nil
+	s.override = nil
+	loc := s.Location
+	s.mu.Unlock()
+	if cleared && loc.Timestamp != nil {
+		s.publish(loc)
+	}
+}
+
+// Settings changed by a configuration reload
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Applies a setting of a reloaded configuration live, on an error the
+// setting waits for the restart
+type ReloadFunc func(cfg *config.Config) error
+
+// Apply a setting reported by config.Diff on the reloads instead of
+// waiting for the restart, for the sinks built outside of the server
+func (s *Server) OnReload(setting string, apply ReloadFunc) {
+	s.mu.Lock()
+	s.reloaders[setting] = apply
+	s.mu.Unlock()
+}
+
+// Read the configuration again and apply the settings that can change
+// while running, the others are reported and need a restart
+func (s *Server) Reload() (ReloadResult, error) {
+	res := ReloadResult{
+		Applied:         make([]string, 0),
+		RestartRequired: make([]string, 0),
+	}
+
+	// The file is read and checked without holding the server
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.mu.RLock()
+	old := s.cfg
+	reloaders := make(map[string]ReloadFunc, len(s.reloaders))
+	for setting, apply := range s.reloaders {
+		reloaders[setting] = apply
+	}
+	s.mu.RUnlock()
+	cfg, err := old.Reload()
+	if err != nil {
+		return res, err
+	}
+
+	applied := make(map[string]bool)
+	for _, c := range config.Diff(old, cfg) {
+		apply, ok := reloaders[c.Setting]
+		switch {
+		case !c.Restart:
+		case !ok:
+			res.RestartRequired = append(res.RestartRequired, c.Setting)
+			continue
+		default:
+			if err := apply(cfg); err != nil {
+				log.Printf("Cannot apply %s, it needs a restart: %s\n", c.Setting, err)
+				res.RestartRequired = append(res.RestartRequired, c.Setting)
+				continue
+			}
+		}
+		applied[c.Setting] = true
+		res.Applied = append(res.Applied, c.Setting)
+	}
+
+	// Apply the live settings, keep the running values of the others so
+	// that they keep being reported until the restart
+	s.providers.Set(cfg.Providers)
+	if cfg.Interval != old.Interval {
+		// Drop a pending change that was not picked up yet
+		select {
+		case <-s.interval:
+		default:
+		}
+		s.interval <- cfg.Interval
+	}
+	next := *old
+	next.Interval = cfg.Interval
+	next.Providers = cfg.Providers
+	if applied["webhooks"] {
+		next.Webhooks = cfg.Webhooks
+	}
+	if applied["mqtt"] {
+		next.MQTT = cfg.MQTT
+	}
+	s.mu.Lock()
+	s.cfg = &next
+	s.mu.Unlock()
+
+	log.Printf("Configuration reloaded, applied: %v, restart required: %v\n", res.Applied, res.RestartRequired)
+	return res, nil
+}
+
+// Entries of the locator cache, empty if the locator does not cache
+func (s *Server) Cache() []CacheEntry {
+	s.mu.RLock()
+	c, ok := s.locator.(cache)
+	s.mu.RUnlock()
+	if !ok {
+		return make([]CacheEntry, 0)
+	}
+	return c.cacheEntries()
+}
+
+// Empty the locator cache, returns the number of entries removed
+func (s *Server) PurgeCache() int {
+	s.mu.RLock()
+	c, ok := s.locator.(cache)
+	s.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+	return c.purgeCache()
+}
+
+// Accepted fixes, oldest first
+func (s *Server) History() []Geolocation {
+	return s.history.List()
+}
+
+// Register a consumer of the reported locations, a consumer that falls
+// behind loses locations instead of blocking the server
+func (s *Server) Subscribe() <-chan Geolocation {
+	ch := make(chan Geolocation, 16)
+	s.mu.Lock()
+	s.subs = append(s.subs, ch)
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *Server) publish(geo Geolocation) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ch := range s.subs {
+		select {
+		case ch <- geo:
+		default:
+			log.Println("Location subscriber is full, dropping location")
+		}
+	}
+}
+
+// Modem used by the server, nil when there is none
+func (s *Server) Modem() *modem.Modem {
+	return s.m
+}
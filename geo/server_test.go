@@ -0,0 +1,108 @@
+package geo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+)
+
+func TestOverride(t *testing.T) {
+	now := time.Now()
+	s := &Server{Location: Geolocation{City: "Cluj-Napoca", Source: SourceIP, Timestamp: &now}}
+	ch := s.Subscribe()
+
+	o := s.SetOverride(Geolocation{Name: "Pump station 4", Lat: 46.77, Lon: 23.59}, time.Time{})
+	if o.Source != SourceManual || o.ExpiresAt != nil {
+		t.Fatalf("expected a manual override without expiry, got %+v", o)
+	}
+	if cur := s.Current(); cur.Name != "Pump station 4" {
+		t.Fatalf("expected the override to be reported, got %+v", cur)
+	}
+
+	if loc := <-ch; loc.Source != SourceManual {
+		t.Fatalf("expected the override to be published, got %+v", loc)
+	}
+
+	s.ClearOverride()
+	if cur := s.Current(); cur.City != "Cluj-Napoca" {
+		t.Fatalf("expected the computed location after clearing, got %+v", cur)
+	}
+	select {
+	case loc := <-ch:
+		if loc.City != "Cluj-Napoca" {
+			t.Fatalf("expected the computed location to be published, got %+v", loc)
+		}
+	default:
+		t.Fatal("expected the computed location to be published after clearing")
+	}
+
+	s.SetOverride(Geolocation{Name: "Pump station 4"}, time.Now().Add(-time.Second))
+	if _, ok := s.GetOverride(); ok {
+		t.Fatal("expected an expired override to be ignored")
+	}
+	if cur := s.Current(); cur.Source != SourceIP {
+		t.Fatalf("expected the computed location after expiry, got %+v", cur)
+	}
+}
+
+// The location reported before the first fix has no timestamp
+func TestNoFixTimestamp(t *testing.T) {
+	b, err := json.Marshal(Geolocation{City: "Cluj-Napoca"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "timestamp") {
+		t.Fatalf("location %s, want no timestamp without a fix", b)
+	}
+}
+
+// The settings with a reload function are applied, the others wait for
+// the restart with their running values
+func TestReloadHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locater.yaml")
+	write := func(yaml string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := "providers:\n  geoapify:\n    key: k\n  ip2loc:\n    key: k\n"
+	write(keys + "webhooks:\n  endpoints:\n    - url: http://hooks.local/a\n")
+	cfg, err := config.Load([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(context.Background(), cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hooked string
+	s.OnReload("webhooks", func(cfg *config.Config) error {
+		hooked = cfg.Webhooks.Endpoints[0].URL
+		return nil
+	})
+	s.OnReload("mqtt", func(cfg *config.Config) error { return errors.New("refused") })
+
+	write(keys + "webhooks:\n  endpoints:\n    - url: http://hooks.local/b\nmqtt:\n  broker: tcp://broker.local:1883\napi:\n  listen_addr: :4000\n")
+	res, err := s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hooked != "http://hooks.local/b" || !reflect.DeepEqual(res.Applied, []string{"webhooks"}) {
+		t.Errorf("applied %v, hook given %q", res.Applied, hooked)
+	}
+	if want := []string{"api.listen_addr", "mqtt"}; !reflect.DeepEqual(res.RestartRequired, want) {
+		t.Errorf("restart required for %v, want %v", res.RestartRequired, want)
+	}
+	if s.cfg.Webhooks.Endpoints[0].URL != "http://hooks.local/b" || s.cfg.MQTT.Broker != "" || s.cfg.API.ListenAddr == ":4000" {
+		t.Errorf("running configuration not as applied: %+v", s.cfg)
+	}
+}
@@ -0,0 +1,305 @@
+package geo
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/modem"
+	"github.com/sirupsen/logrus"
+)
+
+// Point of a simulated track, at an offset from the start of the track
+type TrackPoint struct {
+	Offset   time.Duration
+	Lat      float64
+	Lon      float64
+	Accuracy float64
+}
+
+// Read a GPX or CSV track. The points without a time are step after the
+// previous one
+func LoadTrack(path string, step time.Duration) ([]TrackPoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the track: %s", err)
+	}
+	defer f.Close()
+
+	var points []TrackPoint
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpx":
+		points, err = readGPX(f, step)
+	case ".csv":
+		points, err = readCSV(f, step)
+	default:
+		return nil, fmt.Errorf("track %s: not a .gpx or .csv file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the track %s: %s", path, err)
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("track %s has no points", path)
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i].Offset < points[i-1].Offset {
+			return nil, fmt.Errorf("track %s: point %d is older than the previous one", path, i+1)
+		}
+	}
+	// The seconds of a csv may not start at 0
+	first := points[0].Offset
+	for i := range points {
+		points[i].Offset -= first
+	}
+	return points, nil
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+}
+
+type gpxFile struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+	Routes []struct {
+		Points []gpxPoint `xml:"rtept"`
+	} `xml:"rte"`
+}
+
+// The track points, or the route points of a file without tracks
+func readGPX(r io.Reader, step time.Duration) ([]TrackPoint, error) {
+	var gpx gpxFile
+	if err := xml.NewDecoder(r).Decode(&gpx); err != nil {
+		return nil, err
+	}
+	var pts []gpxPoint
+	for _, t := range gpx.Tracks {
+		for _, s := range t.Segments {
+			pts = append(pts, s.Points...)
+		}
+	}
+	if len(pts) == 0 {
+		for _, rte := range gpx.Routes {
+			pts = append(pts, rte.Points...)
+		}
+	}
+
+	points := make([]TrackPoint, 0, len(pts))
+	var start time.Time
+	for i, p := range pts {
+		tp := TrackPoint{Lat: p.Lat, Lon: p.Lon}
+		if p.Time != "" {
+			ts, err := time.Parse(time.RFC3339, p.Time)
+			if err != nil {
+				return nil, fmt.Errorf("point %d: %s", i+1, err)
+			}
+			if start.IsZero() {
+				start = ts
+			}
+			tp.Offset = ts.Sub(start)
+		} else if i > 0 {
+			tp.Offset = points[i-1].Offset + step
+		}
+		points = append(points, tp)
+	}
+	return points, nil
+}
+
+// Columns lat and lon, optionally time (RFC3339 or seconds from the
+// start) and accuracy in meters, named on the first line
+func readCSV(r io.Reader, step time.Duration) ([]TrackPoint, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	cols := make(map[string]int)
+	for i, name := range records[0] {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	latCol, okLat := cols["lat"]
+	lonCol, okLon := cols["lon"]
+	if !okLat || !okLon {
+		return nil, errors.New("the first line must name the lat and lon columns")
+	}
+	timeCol, hasTime := cols["time"]
+	accCol, hasAcc := cols["accuracy"]
+
+	points := make([]TrackPoint, 0, len(records)-1)
+	var start time.Time
+	for i, rec := range records[1:] {
+		line := i + 2
+		var tp TrackPoint
+		if tp.Lat, err = strconv.ParseFloat(rec[latCol], 64); err != nil {
+			return nil, fmt.Errorf("line %d: lat %q is not a number", line, rec[latCol])
+		}
+		if tp.Lon, err = strconv.ParseFloat(rec[lonCol], 64); err != nil {
+			return nil, fmt.Errorf("line %d: lon %q is not a number", line, rec[lonCol])
+		}
+		if hasAcc && rec[accCol] != "" {
+			if tp.Accuracy, err = strconv.ParseFloat(rec[accCol], 64); err != nil {
+				return nil, fmt.Errorf("line %d: accuracy %q is not a number", line, rec[accCol])
+			}
+		}
+
+		if hasTime && rec[timeCol] != "" {
+			if tp.Offset, err = csvOffset(rec[timeCol], &start); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+		} else if len(points) > 0 {
+			tp.Offset = points[len(points)-1].Offset + step
+		}
+		points = append(points, tp)
+	}
+	return points, nil
+}
+
+// Offset of a time in seconds from the start, or of an RFC3339 time from
+// the first one of the track
+func csvOffset(v string, start *time.Time) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	ts, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, fmt.Errorf("time %q is not RFC3339 or seconds", v)
+	}
+	if start.IsZero() {
+		*start = ts
+	}
+	return ts.Sub(*start), nil
+}
+
+// Position on the track at an offset from its first point, interpolated
+// between the points. Past the end the track starts over at the first
+// point when looping, otherwise the device stays at the last point
+func trackPosition(track []TrackPoint, offset time.Duration, loop bool) TrackPoint {
+	first, last := track[0], track[len(track)-1]
+	if span := last.Offset - first.Offset; loop && span > 0 {
+		offset %= span
+	}
+	offset += first.Offset
+	if offset <= first.Offset {
+		return TrackPoint{Offset: offset, Lat: first.Lat, Lon: first.Lon, Accuracy: first.Accuracy}
+	}
+	if offset >= last.Offset {
+		return TrackPoint{Offset: offset, Lat: last.Lat, Lon: last.Lon, Accuracy: last.Accuracy}
+	}
+	for i := 1; i < len(track); i++ {
+		a, b := track[i-1], track[i]
+		if offset >= b.Offset {
+			continue
+		}
+		f := 0.0
+		if b.Offset > a.Offset {
+			f = float64(offset-a.Offset) / float64(b.Offset-a.Offset)
+		}
+		return TrackPoint{
+			Offset:   offset,
+			Lat:      a.Lat + (b.Lat-a.Lat)*f,
+			Lon:      a.Lon + (b.Lon-a.Lon)*f,
+			Accuracy: a.Accuracy + (b.Accuracy-a.Accuracy)*f,
+		}
+	}
+	return track[0]
+}
+
+// Locator replaying a recorded track as the location of the device, for
+// demos and tests without a modem or network. The positions are looked
+// up only when a geocoding key is configured
+type SimulatedLocator struct {
+	Locch  chan struct{}    // channel that signals that it is time to check for a location change
+	Sendch chan Geolocation // channel used to update the location on the server
+	track  []TrackPoint
+	speed  float64
+	loop   bool
+	p      *Providers
+	start  time.Time // of the replay, set on the first request
+	now    func() time.Time
+}
+
+func NewSimulatedLocator(cfg config.Simulation, step time.Duration, p *Providers, locch chan struct{}, sendch chan Geolocation) (*SimulatedLocator, error) {
+	track, err := LoadTrack(cfg.Track, step)
+	if err != nil {
+		return nil, err
+	}
+	return &SimulatedLocator{
+		Locch:  locch,
+		Sendch: sendch,
+		track:  track,
+		speed:  cfg.Speed,
+		loop:   cfg.Loop,
+		p:      p,
+		now:    time.Now,
+	}, nil
+}
+
+func (l *SimulatedLocator) Run() {
+	for {
+		<-l.Locch
+		ctx := startLocate(SourceSimulated)
+		geo := l.locate(ctx)
+		l.Sendch <- traced(ctx, geo)
+		endLocate(ctx, nil)
+	}
+}
+
+// Position at the time elapsed since the first request, scaled by the
+// speed
+func (l *SimulatedLocator) locate(ctx context.Context) Geolocation {
+	now := l.now()
+	if l.start.IsZero() {
+		l.start = now
+	}
+	offset := time.Duration(float64(now.Sub(l.start)) * l.speed)
+	pos := trackPosition(l.track, offset, l.loop)
+
+	geo := Geolocation{Lat: pos.Lat, Lon: pos.Lon}
+	if l.p.Get().Geoapify.Key != "" {
+		loc, err := reverseGeocode(ctx, l.p, Coordinates{Lat: pos.Lat, Lon: pos.Lon})
+		if err != nil {
+			// Still report the coordinates
+			logrus.Println(err)
+		} else {
+			geo = loc
+		}
+	}
+	geo.Accuracy = pos.Accuracy
+	geo.Source = SourceSimulated
+	geo.Timestamp = &now
+	return geo
+}
+
+// Modem of the device, the simulated one when it is configured
+func OpenModem(ctx context.Context, cfg *config.Config) (*modem.Modem, error) {
+	var m *modem.Modem
+	var err error
+	if cfg.Simulation.Modem != "" {
+		m, err = modem.NewSimulatedModem(ctx, cfg.Simulation.Modem, cfg.Simulation.ModemInterval)
+	} else {
+		m, err = modem.NewModem(ctx, cfg.Modem.Command)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := m.SetHomeNetwork(cfg.Modem.HomeNetwork); err != nil {
+		return nil, fmt.Errorf("modem.home_network: %s", err)
+	}
+	return m, nil
+}
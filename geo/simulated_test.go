@@ -0,0 +1,106 @@
+package geo
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/provider"
+)
+
+func TestSimulatedTrack(t *testing.T) {
+	gpx, err := LoadTrack("../simulation/track.gpx", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv, err := LoadTrack("../simulation/track.csv", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gpx) != len(csv) {
+		t.Fatalf("%d gpx and %d csv points, want the same track", len(gpx), len(csv))
+	}
+	for i := range gpx {
+		if gpx[i].Offset != csv[i].Offset || gpx[i].Lat != csv[i].Lat || gpx[i].Lon != csv[i].Lon {
+			t.Errorf("point %d: gpx %+v, csv %+v", i, gpx[i], csv[i])
+		}
+	}
+
+	// Half way between the first two points
+	pos := trackPosition(gpx, 30*time.Second, false)
+	if math.Abs(pos.Lat-(gpx[0].Lat+gpx[1].Lat)/2) > 1e-9 {
+		t.Errorf("lat %f after 30s, want the middle of the first segment", pos.Lat)
+	}
+	// Past the end the device stays there, or starts over
+	end := gpx[len(gpx)-1]
+	if pos := trackPosition(gpx, end.Offset+time.Hour, false); pos.Lat != end.Lat {
+		t.Errorf("lat %f past the end, want the last point", pos.Lat)
+	}
+	if pos := trackPosition(gpx, end.Offset+time.Minute, true); pos.Lat != gpx[1].Lat {
+		t.Errorf("lat %f one minute into the second loop, want the second point", pos.Lat)
+	}
+
+	// The seconds of a csv are from the first point
+	path := filepath.Join(t.TempDir(), "track.csv")
+	if err := os.WriteFile(path, []byte("time,lat,lon\n100,46.0,23.0\n110,46.1,23.0\n120,46.2,23.0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	late, err := LoadTrack(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if late[0].Offset != 0 || late[2].Offset != 20*time.Second {
+		t.Errorf("offsets %s and %s, want 0s and 20s", late[0].Offset, late[2].Offset)
+	}
+	for _, d := range []time.Duration{0, 20 * time.Second, 40 * time.Second} {
+		if pos := trackPosition(late, d, true); pos.Lat != 46.0 {
+			t.Errorf("lat %f after %s, want each loop to start at the first point", pos.Lat, d)
+		}
+	}
+	if pos := trackPosition(late, 25*time.Second, true); math.Abs(pos.Lat-46.05) > 1e-9 {
+		t.Errorf("lat %f 5s into the second loop", pos.Lat)
+	}
+	// Not rebased, still from the first point
+	raw := []TrackPoint{{Offset: 100 * time.Second, Lat: 46.0}, {Offset: 110 * time.Second, Lat: 46.1}}
+	if pos := trackPosition(raw, 5*time.Second, false); math.Abs(pos.Lat-46.05) > 1e-9 {
+		t.Errorf("lat %f 5s into a track starting at 100s", pos.Lat)
+	}
+
+	// The replay is scaled by the speed, no address without a key
+	client, err := provider.NewClient(config.Default().HTTP, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l, err := NewSimulatedLocator(config.Simulation{Track: "../simulation/track.csv", Speed: 2}, time.Minute,
+		NewProviders(config.Providers{}, client), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return now }
+	l.locate(context.Background())
+	now = now.Add(30 * time.Second)
+	if geo := l.locate(context.Background()); geo.Lat != csv[1].Lat || geo.Source != SourceSimulated {
+		t.Errorf("%+v after 30s at twice the speed, want the second point", geo)
+	}
+}
+
+func TestSimulatedModem(t *testing.T) {
+	cfg := config.Default()
+	cfg.Simulation.Modem = "../simulation/modem"
+	m, err := OpenModem(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	st := m.Status()
+	if st.Info.Model != "EG25" || st.Network.Mcc != 226 || st.Network.Mnc != 1 || st.Network.Cid != 1 {
+		t.Errorf("status %+v, want the first recording", st)
+	}
+}
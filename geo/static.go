@@ -0,0 +1,52 @@
+package geo
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Locator for devices that are permanently installed at a known address,
+// it reports the configured location on every tick
+type StaticLocator struct {
+	Locch  chan struct{}    // channel that signals that it is time to check for a location change
+	Sendch chan Geolocation // channel used to update the location on the server
+	loc    Geolocation
+	p      *Providers
+	// the address is looked up once if it was not configured
+	resolved bool
+}
+
+func NewStaticLocator(c Coordinates, address string, p *Providers, locch chan struct{}, sendch chan Geolocation) *StaticLocator {
+	return &StaticLocator{
+		p:      p,
+		Locch:  locch,
+		Sendch: sendch,
+		loc: Geolocation{
+			Name:         address,
+			AddressLine1: address,
+			Lat:          c.Lat,
+			Lon:          c.Lon,
+			Source:       SourceStatic,
+		},
+		resolved: address != "",
+	}
+}
+
+func (l *StaticLocator) Run() {
+	for {
+		<-l.Locch
+		ctx := startLocate(SourceStatic)
+		if !l.resolved {
+			geo, err := reverseGeocode(ctx, l.p, Coordinates{Lat: l.loc.Lat, Lon: l.loc.Lon})
+			if err != nil {
+				// Still report the coordinates, retry the address on the next tick
+				logrus.Println(err)
+			} else {
+				geo.Source = SourceStatic
+				l.loc = geo
+				l.resolved = true
+			}
+		}
+		l.Sendch <- traced(ctx, l.loc)
+		endLocate(ctx, nil)
+	}
+}
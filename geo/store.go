@@ -0,0 +1,64 @@
+package geo
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/mircearem/locater/outbox"
+	"github.com/mircearem/storer/store"
+)
+
+// Store of the known locations, shared by the locators
+type Store interface {
+	Get(collection string, key string) (string, error)
+	Post(collection string, data []byte) error
+}
+
+// Entry of the outbox, a post to a collection
+type storePost struct {
+	Collection string          `json:"collection"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Store whose posts go through the outbox, so that the ones made while
+// the store is unreachable are not lost
+type outboxStore struct {
+	*store.Client
+	sink *outbox.Sink
+}
+
+func NewOutboxStore(c *store.Client, box *outbox.Outbox) (Store, error) {
+	s := &outboxStore{Client: c}
+	sink, err := box.Sink("store", outbox.Options{}, s.deliver)
+	if err != nil {
+		return nil, err
+	}
+	s.sink = sink
+	return s, nil
+}
+
+// Write the post to the outbox, data that the store would refuse is
+// reported right away
+func (s *outboxStore) Post(collection string, data []byte) error {
+	return s.post(context.Background(), collection, data)
+}
+
+func (s *outboxStore) post(ctx context.Context, collection string, data []byte) error {
+	kv := make(map[string]string)
+	if err := json.Unmarshal(data, &kv); err != nil {
+		return err
+	}
+	b, err := json.Marshal(storePost{Collection: collection, Data: data})
+	if err != nil {
+		return err
+	}
+	return s.sink.Put(ctx, b)
+}
+
+func (s *outboxStore) deliver(b []byte, attempt int) error {
+	var p storePost
+	if err := json.Unmarshal(b, &p); err != nil {
+		return outbox.Permanent(err)
+	}
+	return s.Client.Post(p.Collection, p.Data)
+}
@@ -0,0 +1,74 @@
+package geo
+
+import (
+	"context"
+	"time"
+
+	"github.com/mircearem/locater/metrics"
+	"github.com/mircearem/locater/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Start the trace of a locate cycle, the steps of the cycle are its
+// children and it ends with endLocate
+func startLocate(source string) context.Context {
+	ctx, _ := tracing.Start(context.Background(), "locate", tracing.ATTR_SOURCE.String(source))
+	return ctx
+}
+
+// End the trace of a locate cycle, err is the step that failed if any
+func endLocate(ctx context.Context, err error) {
+	tracing.End(trace.SpanFromContext(ctx), err)
+}
+
+// Trace and count a call to a provider, the returned function ends it
+// with the result of the call
+func providerCall(ctx context.Context, step, provider string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, step, tracing.ATTR_PROVIDER.String(provider))
+	return ctx, func(err error) {
+		metrics.ObserveCall(provider, start, err)
+		tracing.End(span, err)
+	}
+}
+
+// Record a lookup in a cache on the current span
+func cacheLookup(ctx context.Context, cache string, hit bool) {
+	metrics.ObserveCache(cache, hit)
+	trace.SpanFromContext(ctx).AddEvent("cache lookup", trace.WithAttributes(
+		tracing.ATTR_CACHE.String(cache),
+		tracing.ATTR_CACHE_HIT.Bool(hit),
+	))
+}
+
+// Post to the store, traced as a step of the cycle. The outbox store
+// keeps the trace for the delivery of the post
+func storeWrite(ctx context.Context, db Store, collection string, data []byte) error {
+	ctx, span := tracing.Start(ctx, "store post", tracing.ATTR_STORE.String(collection))
+	var err error
+	if s, ok := db.(*outboxStore); ok {
+		err = s.post(ctx, collection, data)
+	} else {
+		err = db.Post(collection, data)
+	}
+	tracing.End(span, err)
+	return err
+}
+
+// Location tagged with the trace of the cycle that produced it, the
+// sinks queuing it continue the trace
+func traced(ctx context.Context, geo Geolocation) Geolocation {
+	geo.traceparent = tracing.Traceparent(ctx)
+	return geo
+}
+
+// Look up a key in the store, traced as a step of the cycle
+func storeLookup(ctx context.Context, db Store, collection, key string) (string, error) {
+	_, span := tracing.Start(ctx, "store lookup", tracing.ATTR_STORE.String(collection))
+	v, err := db.Get(collection, key)
+	hit := err == nil && v != ""
+	metrics.ObserveCache("store", hit)
+	span.SetAttributes(tracing.ATTR_CACHE.String("store"), tracing.ATTR_CACHE_HIT.Bool(hit))
+	tracing.End(span, err)
+	return v, err
+}
@@ -0,0 +1,246 @@
+package geo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// Access point seen during a scan, in the geolocate request format
+type AccessPoint struct {
+	MacAddress     string `json:"macAddress"`
+	SignalStrength int    `json:"signalStrength,omitempty"`
+	Channel        int    `json:"channel,omitempty"`
+	Ssid           string `json:"-"`
+}
+
+// Cell tower in the geolocate request format
+type CellTower struct {
+	RadioType         string `json:"radioType,omitempty"`
+	MobileCountryCode int    `json:"mobileCountryCode"`
+	MobileNetworkCode int    `json:"mobileNetworkCode"`
+	LocationAreaCode  int    `json:"locationAreaCode"`
+	CellId            int64  `json:"cellId,omitempty"`
+	NewRadioCellId    int64  `json:"newRadioCellId,omitempty"` // 36 bit nr cell identity
+	SignalStrength    int    `json:"signalStrength,omitempty"`
+}
+
+// Request body of the Google/Mozilla geolocate api
+type geolocateRequest struct {
+	ConsiderIp       bool          `json:"considerIp"`
+	CellTowers       []CellTower   `json:"cellTowers,omitempty"`
+	WifiAccessPoints []AccessPoint `json:"wifiAccessPoints,omitempty"`
+}
+
+// Response of the Google/Mozilla geolocate api
+type geolocateResponse struct {
+	Location struct {
+		Lat float64 `json:"lat"`
+		Lng float64 `json:"lng"`
+	} `json:"location"`
+	Accuracy float64 `json:"accuracy"`
+	Error    *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Locator using the access points visible on a wireless interface, and
+// the serving cell if a modem is present
+type WiFiLocator struct {
+	Iface  string
+	cmd    string           // scan command, {iface} is replaced with the interface name
+	Locch  chan struct{}    // channel that signals that it is time to check for a location change
+	Sendch chan Geolocation // channel used to update the location on the server
+	m      *modem.Modem     // optional, adds the serving cell to the request
+	p      *Providers
+}
+
+func NewWiFiLocator(w config.WiFi, p *Providers, m *modem.Modem, locch chan struct{}, sendch chan Geolocation) *WiFiLocator {
+	return &WiFiLocator{
+		Iface:  w.Interface,
+		cmd:    w.ScanCommand,
+		p:      p,
+		Locch:  locch,
+		Sendch: sendch,
+		m:      m,
+	}
+}
+
+func (l *WiFiLocator) Run() {
+	for {
+		<-l.Locch
+		ctx := startLocate(SourceWiFi)
+		aps, err := l.scan(ctx)
+		if err != nil {
+			logrus.Println(err)
+		}
+		towers := l.cellTowers()
+		// The providers need at least two access points to locate
+		if len(aps) < 2 && len(towers) == 0 {
+			endLocate(ctx, errors.New("not enough access points to locate"))
+			continue
+		}
+		c, accuracy, err := l.getLatLon(ctx, aps, towers)
+		if err != nil {
+			logrus.Println(err)
+			endLocate(ctx, err)
+			continue
+		}
+		geo, err := reverseGeocode(ctx, l.p, c)
+		if err != nil && !errors.Is(err, ErrNoAddress) {
+			logrus.Println(err)
+			endLocate(ctx, err)
+			continue
+		}
+		geo.Accuracy = accuracy
+		geo.Source = SourceWiFi
+		l.Sendch <- traced(ctx, geo)
+		endLocate(ctx, nil)
+	}
+}
+
+// Scan the access points visible on the interface
+func (l *WiFiLocator) scan(ctx context.Context) (aps []AccessPoint, err error) {
+	_, span := tracing.Start(ctx, "wifi scan")
+	defer func() {
+		span.SetAttributes(tracing.ATTR_ACCESS_POINTS.Int(len(aps)))
+		tracing.End(span, err)
+	}()
+
+	args := strings.Fields(strings.ReplaceAll(l.cmd, "{iface}", l.Iface))
+	if len(args) == 0 {
+		return nil, errors.New("wifi scan command not configured")
+	}
+
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("wifi scan fail: %s", err.Error())
+	}
+	return parseIwScan(bytes.NewReader(out)), nil
+}
+
+// Serving cell of the modem, if there is one
+func (l *WiFiLocator) cellTowers() []CellTower {
+	if l.m == nil {
+		return nil
+	}
+	n := l.m.Status().Network
+	if n.Cell.ID == 0 {
+		return nil
+	}
+	tower := CellTower{
+		RadioType:         radioType(n.Cell.Radio),
+		MobileCountryCode: n.Mcc,
+		MobileNetworkCode: n.Mnc,
+		LocationAreaCode:  n.Cell.Area(),
+		SignalStrength:    n.SignalRssi,
+	}
+	if n.Cell.Radio == modem.RADIO_NR {
+		tower.NewRadioCellId = n.Cell.ID
+	} else {
+		tower.CellId = n.Cell.ID
+	}
+	return []CellTower{tower}
+}
+
+// Get the coordinates and accuracy from the wifi geolocation provider
+func (l *WiFiLocator) getLatLon(ctx context.Context, aps []AccessPoint, towers []CellTower) (_ Coordinates, _ float64, err error) {
+	ctx, done := providerCall(ctx, "geolocation", "geolocate")
+	defer func() { done(err) }()
+	p := l.p.Get().Geolocate
+	url := fmt.Sprintf("%s?key=%s", p.URI, p.Key)
+
+	req := geolocateRequest{
+		ConsiderIp:       false,
+		CellTowers:       towers,
+		WifiAccessPoints: aps,
+	}
+	// Errors are reported in the body, with the status or without
+	var loc geolocateResponse
+	if err := l.p.Client().Post(ctx, "geolocate", url, req, &loc); err != nil {
+		return Coordinates{}, 0, err
+	}
+	if loc.Error != nil {
+		return Coordinates{}, 0, fmt.Errorf("geolocate error %d: %s", loc.Error.Code, loc.Error.Message)
+	}
+	return Coordinates{
+		Lat: loc.Location.Lat,
+		Lon: loc.Location.Lng,
+	}, loc.Accuracy, nil
+}
+
+// Parse the output of `iw dev <iface> scan`. Access points that opted out
+// of location services with an "_nomap" ssid are skipped
+func parseIwScan(r io.Reader) []AccessPoint {
+	aps := make([]AccessPoint, 0)
+	var ap *AccessPoint
+
+	flush := func() {
+		if ap != nil && !strings.HasSuffix(ap.Ssid, "_nomap") {
+			aps = append(aps, *ap)
+		}
+		ap = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "BSS "):
+			// BSS aa:bb:cc:dd:ee:ff(on wlan0) -- associated
+			flush()
+			mac := strings.TrimPrefix(line, "BSS ")
+			if i := strings.IndexAny(mac, "( "); i > 0 {
+				mac = mac[:i]
+			}
+			ap = &AccessPoint{MacAddress: mac}
+		case ap == nil:
+			continue
+		case strings.HasPrefix(line, "signal:"):
+			// signal: -52.00 dBm
+			fields := strings.Fields(strings.TrimPrefix(line, "signal:"))
+			if len(fields) > 0 {
+				dbm, _ := strconv.ParseFloat(fields[0], 64)
+				ap.SignalStrength = int(dbm)
+			}
+		case strings.HasPrefix(line, "SSID:"):
+			ap.Ssid = strings.TrimSpace(strings.TrimPrefix(line, "SSID:"))
+		case strings.HasPrefix(line, "DS Parameter set: channel"):
+			ch := strings.TrimSpace(strings.TrimPrefix(line, "DS Parameter set: channel"))
+			ap.Channel, _ = strconv.Atoi(ch)
+		case strings.HasPrefix(line, "* primary channel:"):
+			ch := strings.TrimSpace(strings.TrimPrefix(line, "* primary channel:"))
+			ap.Channel, _ = strconv.Atoi(ch)
+		}
+	}
+	flush()
+
+	return aps
+}
+
+// Map the radio of the serving cell to the geolocate radio type
+func radioType(radio string) string {
+	switch radio {
+	case modem.RADIO_GSM:
+		return "gsm"
+	case modem.RADIO_UMTS:
+		return "wcdma"
+	case modem.RADIO_LTE:
+		return "lte"
+	case modem.RADIO_NR:
+		return "nr"
+	}
+	return ""
+}
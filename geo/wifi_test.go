@@ -0,0 +1,47 @@
+package geo
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mircearem/locater/config"
+)
+
+const iwScanOutput = `BSS 00:11:22:33:44:55(on wlan0) -- associated
+	TSF: 1234 usec (0d, 00:00:00)
+	freq: 2437
+	signal: -48.00 dBm
+	SSID: plant-floor
+	DS Parameter set: channel 6
+BSS 66:77:88:99:aa:bb(on wlan0)
+	freq: 5180
+	signal: -71.00 dBm
+	SSID: office
+	HT operation:
+		 * primary channel: 36
+BSS cc:dd:ee:ff:00:11(on wlan0)
+	signal: -80.00 dBm
+	SSID: guest_nomap
+`
+
+func TestParseIwScan(t *testing.T) {
+	aps := parseIwScan(strings.NewReader(iwScanOutput))
+	if len(aps) != 2 {
+		t.Fatalf("expected 2 access points, got %d", len(aps))
+	}
+	if aps[0].MacAddress != "00:11:22:33:44:55" || aps[0].SignalStrength != -48 || aps[0].Channel != 6 {
+		t.Fatalf("unexpected first access point: %+v", aps[0])
+	}
+	if aps[1].MacAddress != "66:77:88:99:aa:bb" || aps[1].SignalStrength != -71 || aps[1].Channel != 36 {
+		t.Fatalf("unexpected second access point: %+v", aps[1])
+	}
+}
+
+// A blank scan command is an error, not a panic
+func TestScanCommandBlank(t *testing.T) {
+	l := NewWiFiLocator(config.WiFi{Interface: "wlan0", ScanCommand: " \t"}, nil, nil, nil, nil)
+	if _, err := l.scan(context.Background()); err == nil {
+		t.Fatal("expected an error without a scan command")
+	}
+}
@@ -0,0 +1,111 @@
+package gpsd
+
+import (
+	"time"
+
+	"github.com/mircearem/locater/geo"
+)
+
+// Version of the gpsd JSON protocol spoken by the server
+const (
+	PROTO_MAJOR = 3
+	PROTO_MINOR = 14
+)
+
+// Fix modes of the TPV report, locater has no altitude so a fix is at
+// most 2D
+const (
+	MODE_UNKNOWN = 0
+	MODE_NO_FIX  = 1
+	MODE_2D      = 2
+)
+
+// Path and driver of the only device, a fix from any locater source
+const DEVICE_PATH = "locater"
+
+// Timestamps are UTC with millisecond precision, like gpsd
+const TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+
+// Device has seen GPS data
+const SEEN_GPS = 1
+
+type version struct {
+	Class      string `json:"class"`
+	Release    string `json:"release"`
+	Rev        string `json:"rev"`
+	ProtoMajor int    `json:"proto_major"`
+	ProtoMinor int    `json:"proto_minor"`
+}
+
+type device struct {
+	Class     string `json:"class"`
+	Path      string `json:"path"`
+	Driver    string `json:"driver"`
+	Activated string `json:"activated,omitempty"`
+	Flags     int    `json:"flags"`
+}
+
+type devices struct {
+	Class   string   `json:"class"`
+	Devices []device `json:"devices"`
+}
+
+type watch struct {
+	Class  string `json:"class"`
+	Enable bool   `json:"enable"`
+	JSON   bool   `json:"json"`
+	NMEA   bool   `json:"nmea"`
+	Raw    int    `json:"raw"`
+	Scaled bool   `json:"scaled"`
+	Timing bool   `json:"timing"`
+	Split  bool   `json:"split24"`
+	PPS    bool   `json:"pps"`
+}
+
+// Time-position-velocity report. The error estimates are 95% confidence
+// radii in meters, the accuracy of the fix is reported as is
+type tpv struct {
+	Class  string   `json:"class"`
+	Device string   `json:"device"`
+	Mode   int      `json:"mode"`
+	Time   string   `json:"time,omitempty"`
+	Lat    *float64 `json:"lat,omitempty"`
+	Lon    *float64 `json:"lon,omitempty"`
+	Eph    *float64 `json:"eph,omitempty"`
+	Epx    *float64 `json:"epx,omitempty"`
+	Epy    *float64 `json:"epy,omitempty"`
+}
+
+type poll struct {
+	Class  string `json:"class"`
+	Time   string `json:"time"`
+	Active int    `json:"active"`
+	TPV    []tpv  `json:"tpv"`
+	Sky    []any  `json:"sky"`
+}
+
+type errorReport struct {
+	Class   string `json:"class"`
+	Message string `json:"message"`
+}
+
+// TPV report of a location, without a fix when there is no location yet
+// or when it is older than the maximum age
+func newTPV(loc geo.Geolocation, maxAge time.Duration, now time.Time) tpv {
+	r := tpv{Class: "TPV", Device: DEVICE_PATH, Mode: MODE_NO_FIX}
+	if loc.Timestamp == nil {
+		return r
+	}
+	r.Time = loc.Timestamp.UTC().Format(TIME_FORMAT)
+	if maxAge != 0 && now.Sub(*loc.Timestamp) > maxAge {
+		return r
+	}
+
+	r.Mode = MODE_2D
+	r.Lat, r.Lon = &loc.Lat, &loc.Lon
+	// Unknown accuracy is left out rather than reported as exact
+	if loc.Accuracy > 0 {
+		r.Eph, r.Epx, r.Epy = &loc.Accuracy, &loc.Accuracy, &loc.Accuracy
+	}
+	return r
+}
@@ -0,0 +1,266 @@
+package gpsd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/sirupsen/logrus"
+)
+
+// Time to wait for a client to accept a report
+const WRITE_TIMEOUT = 10 * time.Second
+
+// Longest request line accepted from a client
+const MAX_REQUEST_SIZE = 4096
+
+// Source of the location reported on request
+type Location interface {
+	Current() geo.Geolocation
+}
+
+// Server speaking the gpsd JSON protocol, the fixes of every locater
+// source are reported as TPV to the watching clients
+type Server struct {
+	cfg       config.Gpsd
+	loc       Location
+	activated time.Time
+
+	mu      sync.Mutex
+	ln      net.Listener
+	clients map[*client]struct{}
+}
+
+type client struct {
+	conn net.Conn
+	// Writes come from the connection and from the location stream
+	mu    sync.Mutex
+	watch watch
+}
+
+func NewServer(cfg config.Gpsd, loc Location) *Server {
+	return &Server{
+		cfg:       cfg,
+		loc:       loc,
+		activated: time.Now(),
+		clients:   make(map[*client]struct{}),
+	}
+}
+
+// Accept connections and report the locations received on the channel
+// to the watching clients, until the server is closed
+func (s *Server) Run(locch <-chan geo.Geolocation) error {
+	ln, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	logrus.Printf("gpsd server listening on %s", ln.Addr())
+
+	go func() {
+		for loc := range locch {
+			s.broadcast(loc)
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Address the server is listening on, nil before Run
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+// Stop listening and disconnect the clients
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	c := &client{conn: conn, watch: watch{Class: "WATCH"}}
+	s.mu.Lock()
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	// Like gpsd, greet with the version banner
+	if err := c.send(s.version()); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, MAX_REQUEST_SIZE), MAX_REQUEST_SIZE)
+	for scanner.Scan() {
+		// A line may hold several requests, each ending with a semicolon
+		for _, req := range strings.Split(scanner.Text(), ";") {
+			req = strings.TrimSpace(req)
+			if req == "" {
+				continue
+			}
+			if err := s.handle(c, req); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Answer a request like ?WATCH={"enable":true,"json":true}
+func (s *Server) handle(c *client, req string) error {
+	if !strings.HasPrefix(req, "?") {
+		return c.send(errorReport{Class: "ERROR", Message: fmt.Sprintf("Unrecognized request '%s'", req)})
+	}
+	name, args, _ := strings.Cut(req[1:], "=")
+
+	switch name {
+	case "VERSION":
+		return c.send(s.version())
+	case "DEVICES":
+		return c.send(s.devices())
+	case "DEVICE":
+		return c.send(s.device())
+	case "POLL":
+		r := newTPV(s.loc.Current(), s.cfg.MaxFixAge, time.Now())
+		active := 0
+		if r.Mode >= MODE_2D {
+			active = 1
+		}
+		return c.send(poll{
+			Class:  "POLL",
+			Time:   time.Now().UTC().Format(TIME_FORMAT),
+			Active: active,
+			TPV:    []tpv{r},
+			Sky:    make([]any, 0),
+		})
+	case "WATCH":
+		c.mu.Lock()
+		if args != "" {
+			// Enable defaults to true when arguments are given
+			w := c.watch
+			w.Enable = true
+			if err := json.Unmarshal([]byte(args), &w); err != nil {
+				c.mu.Unlock()
+				return c.send(errorReport{Class: "ERROR", Message: fmt.Sprintf("Invalid WATCH: %s", err)})
+			}
+			// Only the JSON reports are supported, a watcher gets them
+			// even without asking, like gpsd does without nmea or raw
+			w.Class, w.NMEA, w.Raw = "WATCH", false, 0
+			w.JSON = w.JSON || w.Enable
+			c.watch = w
+		}
+		w := c.watch
+		c.mu.Unlock()
+
+		if err := c.send(s.devices()); err != nil {
+			return err
+		}
+		if err := c.send(w); err != nil {
+			return err
+		}
+		// Report the current fix right away rather than at the next locate
+		if w.Enable && w.JSON {
+			return c.send(newTPV(s.loc.Current(), s.cfg.MaxFixAge, time.Now()))
+		}
+		return nil
+	}
+	return c.send(errorReport{Class: "ERROR", Message: fmt.Sprintf("Unrecognized request '%s'", name)})
+}
+
+// Send the report of a new location to the watching clients
+func (s *Server) broadcast(loc geo.Geolocation) {
+	r := newTPV(loc, s.cfg.MaxFixAge, time.Now())
+
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		c.mu.Lock()
+		watching := c.watch.Enable && c.watch.JSON
+		c.mu.Unlock()
+		if !watching {
+			continue
+		}
+		if err := c.send(r); err != nil {
+			// The connection handler sees the error on its next read
+			c.conn.Close()
+		}
+	}
+}
+
+func (s *Server) version() version {
+	return version{
+		Class:      "VERSION",
+		Release:    "locater",
+		Rev:        "locater",
+		ProtoMajor: PROTO_MAJOR,
+		ProtoMinor: PROTO_MINOR,
+	}
+}
+
+func (s *Server) device() device {
+	return device{
+		Class:     "DEVICE",
+		Path:      DEVICE_PATH,
+		Driver:    "locater",
+		Activated: s.activated.UTC().Format(TIME_FORMAT),
+		Flags:     SEEN_GPS,
+	}
+}
+
+func (s *Server) devices() devices {
+	return devices{Class: "DEVICES", Devices: []device{s.device()}}
+}
+
+// Write a report as a line of JSON
+func (c *client) send(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\r', '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	_, err = c.conn.Write(b)
+	return err
+}
@@ -0,0 +1,120 @@
+package gpsd
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+)
+
+type fakeLocation struct {
+	mu  sync.Mutex
+	loc geo.Geolocation
+}
+
+func (f *fakeLocation) Current() geo.Geolocation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.loc
+}
+
+type conn struct {
+	t *testing.T
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, loc Location, locch chan geo.Geolocation) *conn {
+	s := NewServer(config.Gpsd{ListenAddr: "127.0.0.1:0", MaxFixAge: time.Hour}, loc)
+	go s.Run(locch)
+	t.Cleanup(func() { s.Close() })
+
+	for i := 0; s.Addr() == nil; i++ {
+		if i == 100 {
+			t.Fatal("gpsd server not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &conn{t: t, Conn: c, r: bufio.NewReader(c)}
+}
+
+// Read the next report, checking its class
+func (c *conn) expect(class string) map[string]any {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var r map[string]any
+	if err := json.Unmarshal(line, &r); err != nil {
+		c.t.Fatalf("invalid report %q: %s", line, err)
+	}
+	if r["class"] != class {
+		c.t.Fatalf("expected a %s report, got %s", class, line)
+	}
+	return r
+}
+
+func TestWatch(t *testing.T) {
+	locch := make(chan geo.Geolocation)
+	c := dial(t, &fakeLocation{}, locch)
+
+	if v := c.expect("VERSION"); v["proto_major"] != float64(PROTO_MAJOR) {
+		t.Fatalf("unexpected version %v", v)
+	}
+	c.Write([]byte(`?WATCH={"enable":true,"json":true};` + "\n"))
+	if d := c.expect("DEVICES"); len(d["devices"].([]any)) != 1 {
+		t.Fatalf("unexpected devices %v", d)
+	}
+	if w := c.expect("WATCH"); w["enable"] != true || w["json"] != true {
+		t.Fatalf("unexpected watch %v", w)
+	}
+	// No location yet
+	if r := c.expect("TPV"); r["mode"] != float64(MODE_NO_FIX) || r["lat"] != nil {
+		t.Fatalf("expected no fix, got %v", r)
+	}
+
+	now := time.Now()
+	locch <- geo.Geolocation{Lat: 46.7712, Lon: 23.6236, Accuracy: 1200, Source: geo.SourceCell, Timestamp: &now}
+	r := c.expect("TPV")
+	if r["mode"] != float64(MODE_2D) || r["lat"] != 46.7712 || r["lon"] != 23.6236 || r["eph"] != float64(1200) {
+		t.Fatalf("unexpected fix %v", r)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	stale := time.Now().Add(-2 * time.Hour)
+	loc := &fakeLocation{loc: geo.Geolocation{Lat: 46.7712, Lon: 23.6236, Source: geo.SourceIP, Timestamp: &stale}}
+	c := dial(t, loc, make(chan geo.Geolocation))
+	c.expect("VERSION")
+
+	// Older than the maximum age
+	c.Write([]byte("?POLL;\n"))
+	p := c.expect("POLL")
+	if p["active"] != float64(0) || p["tpv"].([]any)[0].(map[string]any)["mode"] != float64(MODE_NO_FIX) {
+		t.Fatalf("expected a stale fix, got %v", p)
+	}
+
+	now := time.Now()
+	loc.mu.Lock()
+	loc.loc.Timestamp = &now
+	loc.mu.Unlock()
+	c.Write([]byte("?POLL;?FOO;\n"))
+	p = c.expect("POLL")
+	r := p["tpv"].([]any)[0].(map[string]any)
+	// Unknown accuracy is not reported
+	if p["active"] != float64(1) || r["mode"] != float64(MODE_2D) || r["eph"] != nil {
+		t.Fatalf("unexpected poll %v", p)
+	}
+	c.expect("ERROR")
+}
@@ -1,28 +1,63 @@
 package main
 
 import (
-	"context"
+	"fmt"
+	"os"
+	"strings"
 
-	"github.com/joho/godotenv"
-	"github.com/mircearem/locater/geo"
 	"github.com/sirupsen/logrus"
 )
 
-// Load the information from the .env file
-func init() {
-	// Setup logrus
+const usage = `Usage: locater <command> [flags]
 
-	// Load environment variables
-	err := godotenv.Load(".env")
-	// Stop the app if the .env file is not found
-	if err != nil {
-		logrus.Fatalln("Unable to load .env file")
-	}
-}
+Commands:
+  serve                        run the daemon (default)
+  locate [--once] [--source cell|ip|wifi|static|simulated] [--json]
+                               locate the device without the daemon
+  modem status [--json]        read the modem information
+  cache list|purge             show or empty the daemon caches
+  history export [--format json|csv] [--output file]
+                               export the fixes accepted by the daemon
+  providers test [--json]      call every provider and report latency and errors
+  fakeapi [--listen addr] [--scenario file]
+                               serve fakes of the provider apis for tests
+
+Every command but fakeapi accepts -config <file>, serve also accepts the flags that
+override the configuration (-interval, -listen, -store, -modem-command,
+-wifi-interface).
+`
 
-// The GPRS conncection information read from the mdmd configurator
 func main() {
-	ctx := context.Background()
-	s := geo.NewServer(ctx)
-	logrus.Fatalln(s.Start())
+	args := os.Args[1:]
+	// Without a command, or with flags only, run the daemon
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = serve(args)
+	case "locate":
+		err = locate(args)
+	case "modem":
+		err = modemCommand(args)
+	case "cache":
+		err = cacheCommand(args)
+	case "history":
+		err = historyCommand(args)
+	case "providers":
+		err = providersCommand(args)
+	case "fakeapi":
+		err = fakeapiCommand(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		logrus.Fatalln(err)
+	}
 }
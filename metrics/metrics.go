@@ -0,0 +1,258 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/outbox"
+	"github.com/mircearem/locater/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Prefix of every metric
+const NAMESPACE = "locater"
+
+// Outcomes of a provider call
+const (
+	OUTCOME_OK    = "ok"
+	OUTCOME_ERROR = "error"
+)
+
+// Results of a cache lookup
+const (
+	CACHE_HIT  = "hit"
+	CACHE_MISS = "miss"
+)
+
+// Registry of the metrics served on /metrics, with the go runtime and
+// process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	providerCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "provider_calls_total",
+		Help:      "Calls to the location providers, by provider and outcome.",
+	}, []string{"provider", "outcome"})
+
+	providerLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "provider_call_duration_seconds",
+		Help:      "Duration of the calls to the location providers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"provider"})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "cache_lookups_total",
+		Help:      "Lookups in the location caches and the store, by cache and result.",
+	}, []string{"cache", "result"})
+
+	locateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "locate_duration_seconds",
+		Help:      "Time from a locate request to the new fix.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	accuracy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "fix_accuracy_meters",
+		Help:      "Accuracy of the current fix, 0 when the source does not report it.",
+	}, []string{"source"})
+)
+
+// Time of the last fix, for the fix age gauge
+var (
+	mu      sync.Mutex
+	lastFix time.Time
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		providerCalls,
+		providerLatency,
+		cacheLookups,
+		locateDuration,
+		accuracy,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: NAMESPACE,
+			Name:      "fix_age_seconds",
+			Help:      "Time since the current fix, 0 before the first one.",
+		}, fixAge),
+	)
+}
+
+// Count a provider call that started at start, err is the result of the call
+func ObserveCall(provider string, start time.Time, err error) {
+	outcome := OUTCOME_OK
+	if err != nil {
+		outcome = OUTCOME_ERROR
+	}
+	providerCalls.WithLabelValues(provider, outcome).Inc()
+	providerLatency.WithLabelValues(provider).Observe(time.Since(start).Seconds())
+}
+
+// Count a lookup in a cache
+func ObserveCache(cache string, hit bool) {
+	result := CACHE_MISS
+	if hit {
+		result = CACHE_HIT
+	}
+	cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+// Time taken by a locate cycle
+func ObserveLocate(d time.Duration) {
+	locateDuration.Observe(d.Seconds())
+}
+
+// Record a new fix, only the source of the last fix keeps an accuracy
+func ObserveFix(ts time.Time, acc float64, source string) {
+	mu.Lock()
+	lastFix = ts
+	mu.Unlock()
+	accuracy.Reset()
+	accuracy.WithLabelValues(source).Set(acc)
+}
+
+func fixAge() float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	if lastFix.IsZero() {
+		return 0
+	}
+	return time.Since(lastFix).Seconds()
+}
+
+// Export the signal and registration of the modem
+func RegisterModem(m *modem.Modem) error {
+	return Registry.Register(&modemCollector{m: m})
+}
+
+// Export the calls and the budgets of the providers
+func RegisterQuota(q *provider.Quota) error {
+	return Registry.Register(&quotaCollector{q: q})
+}
+
+// Export the backlog of the outbox sinks
+func RegisterOutbox(box *outbox.Outbox) error {
+	return Registry.Register(&outboxCollector{box: box})
+}
+
+var (
+	rssiDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "modem", "rssi_dbm"),
+		"Received signal strength of the serving cell.", nil, nil)
+	signalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "modem", "signal_strength"),
+		"Signal strength reported by the modem.", nil, nil)
+	registrationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "modem", "registration_state"),
+		"Registration of the modem, 1 for the current state.",
+		[]string{"state", "technology", "operator"}, nil)
+)
+
+// Reads the modem status on every scrape
+type modemCollector struct {
+	m *modem.Modem
+}
+
+func (c *modemCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rssiDesc
+	ch <- signalDesc
+	ch <- registrationDesc
+}
+
+func (c *modemCollector) Collect(ch chan<- prometheus.Metric) {
+	n := c.m.Status().Network
+	ch <- prometheus.MustNewConstMetric(rssiDesc, prometheus.GaugeValue, float64(n.SignalRssi))
+	ch <- prometheus.MustNewConstMetric(signalDesc, prometheus.GaugeValue, float64(n.SignalStrength))
+	ch <- prometheus.MustNewConstMetric(registrationDesc, prometheus.GaugeValue, 1, n.State, n.Technology, n.Operator)
+}
+
+var (
+	pendingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "outbox", "pending"),
+		"Entries of the sink waiting for delivery.", []string{"sink"}, nil)
+	oldestDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "outbox", "oldest_age_seconds"),
+		"Age of the oldest entry waiting for delivery.", []string{"sink"}, nil)
+	deliveredDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "outbox", "delivered_total"),
+		"Entries delivered by the sink.", []string{"sink"}, nil)
+	failedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "outbox", "failed_total"),
+		"Delivery attempts of the sink that will be retried.", []string{"sink"}, nil)
+	droppedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "outbox", "dropped_total"),
+		"Entries of the sink over the limits or refused for good.", []string{"sink"}, nil)
+)
+
+// Reads the outbox statistics on every scrape
+type outboxCollector struct {
+	box *outbox.Outbox
+}
+
+func (c *outboxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingDesc
+	ch <- oldestDesc
+	ch <- deliveredDesc
+	ch <- failedDesc
+	ch <- droppedDesc
+}
+
+func (c *outboxCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, st := range c.box.Stats() {
+		ch <- prometheus.MustNewConstMetric(pendingDesc, prometheus.GaugeValue, float64(st.Pending), st.Name)
+		ch <- prometheus.MustNewConstMetric(oldestDesc, prometheus.GaugeValue, st.OldestAge, st.Name)
+		ch <- prometheus.MustNewConstMetric(deliveredDesc, prometheus.CounterValue, float64(st.Delivered), st.Name)
+		ch <- prometheus.MustNewConstMetric(failedDesc, prometheus.CounterValue, float64(st.Failed), st.Name)
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(st.Dropped), st.Name)
+	}
+}
+
+var (
+	quotaUsedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "provider", "quota_used"),
+		"Calls to the provider in the current period.", []string{"provider", "period"}, nil)
+	quotaBudgetDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "provider", "quota_budget"),
+		"Calls allowed to the provider in a period, absent without a limit.", []string{"provider", "period"}, nil)
+	quotaExhaustedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(NAMESPACE, "provider", "quota_exhausted"),
+		"1 when the provider spent one of its budgets.", []string{"provider"}, nil)
+)
+
+// Reads the provider counters on every scrape
+type quotaCollector struct {
+	q *provider.Quota
+}
+
+func (c *quotaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- quotaUsedDesc
+	ch <- quotaBudgetDesc
+	ch <- quotaExhaustedDesc
+}
+
+func (c *quotaCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, u := range c.q.Usage() {
+		ch <- prometheus.MustNewConstMetric(quotaUsedDesc, prometheus.GaugeValue, float64(u.Daily), u.Provider, "day")
+		ch <- prometheus.MustNewConstMetric(quotaUsedDesc, prometheus.GaugeValue, float64(u.Monthly), u.Provider, "month")
+		if u.DailyBudget > 0 {
+			ch <- prometheus.MustNewConstMetric(quotaBudgetDesc, prometheus.GaugeValue, float64(u.DailyBudget), u.Provider, "day")
+		}
+		if u.MonthlyBudget > 0 {
+			ch <- prometheus.MustNewConstMetric(quotaBudgetDesc, prometheus.GaugeValue, float64(u.MonthlyBudget), u.Provider, "month")
+		}
+		exhausted := 0.0
+		if u.Exhausted {
+			exhausted = 1
+		}
+		ch <- prometheus.MustNewConstMetric(quotaExhaustedDesc, prometheus.GaugeValue, exhausted, u.Provider)
+	}
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/outbox"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveCall(t *testing.T) {
+	ObserveCall("ipify", time.Now(), nil)
+	ObserveCall("ipify", time.Now(), errors.New("timeout"))
+	ObserveCall("ipify", time.Now(), nil)
+
+	if n := testutil.ToFloat64(providerCalls.WithLabelValues("ipify", OUTCOME_OK)); n != 2 {
+		t.Errorf("ok calls = %v, want 2", n)
+	}
+	if n := testutil.ToFloat64(providerCalls.WithLabelValues("ipify", OUTCOME_ERROR)); n != 1 {
+		t.Errorf("failed calls = %v, want 1", n)
+	}
+}
+
+func TestObserveFix(t *testing.T) {
+	ObserveFix(time.Now().Add(-time.Minute), 1200, "cell")
+	ObserveFix(time.Now().Add(-30*time.Second), 25, "wifi")
+
+	if n := testutil.CollectAndCount(accuracy); n != 1 {
+		t.Fatalf("accuracy series = %d, want only the last source", n)
+	}
+	if a := testutil.ToFloat64(accuracy.WithLabelValues("wifi")); a != 25 {
+		t.Errorf("accuracy = %v, want 25", a)
+	}
+	if age := fixAge(); age < 30 || age > 60 {
+		t.Errorf("fix age = %v, want about 30s", age)
+	}
+}
+
+func TestRegisterOutbox(t *testing.T) {
+	box, err := outbox.Open(config.Outbox{
+		Path:       filepath.Join(t.TempDir(), "outbox.db"),
+		MaxEntries: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.Close()
+	sink, err := box.Sink("test", outbox.Options{Backoff: time.Hour}, func([]byte, int) error {
+		return errors.New("unreachable")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Put(context.Background(), []byte("a"))
+	sink.Put(context.Background(), []byte("b"))
+
+	if err := RegisterOutbox(box); err != nil {
+		t.Fatal(err)
+	}
+	want := `
+# HELP locater_outbox_pending Entries of the sink waiting for delivery.
+# TYPE locater_outbox_pending gauge
+locater_outbox_pending{sink="test"} 2
+`
+	if err := testutil.GatherAndCompare(Registry, strings.NewReader(want), "locater_outbox_pending"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,144 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/modem"
+)
+
+// Register map, the same values are served as input registers (function
+// 04) and as read-only holding registers (function 03). 32 bit values take
+// two registers, high word first.
+//
+//	Address  Size  Type     Value
+//	0        2     float32  latitude, degrees
+//	2        2     float32  longitude, degrees
+//	4        2     float32  accuracy radius, meters, 0 if unknown
+//	6        2     uint32   fix age, seconds
+//	8        1     uint16   source, see the SOURCE_ values
+//	9        1     uint16   signal strength, percent
+//	10       1     int16    signal rssi, dBm
+//	11       1     uint16   registration state, see the REGSTATE_ values
+//	12       1     uint16   fix valid, 1 if there is a fix younger than the maximum age
+//
+// Discrete input 0 (function 02) mirrors the fix valid flag. Writing 1 to
+// coil 0 (functions 05 and 15) triggers an immediate relocate, the coil
+// always reads back 0 (function 01).
+const (
+	REG_LATITUDE       = 0
+	REG_LONGITUDE      = 2
+	REG_ACCURACY       = 4
+	REG_FIX_AGE        = 6
+	REG_SOURCE         = 8
+	REG_SIGNAL         = 9
+	REG_RSSI           = 10
+	REG_REGISTRATION   = 11
+	REG_FIX_VALID      = 12
+	REGISTER_COUNT     = 13
+	COIL_RELOCATE      = 0
+	COIL_COUNT         = 1
+	DISCRETE_FIX_VALID = 0
+	DISCRETE_COUNT     = 1
+)
+
+// Values of the source register
+const (
+	SOURCE_NONE = iota
+	SOURCE_IP
+	SOURCE_CELL
+	SOURCE_WIFI
+	SOURCE_STATIC
+	SOURCE_MANUAL
+	SOURCE_SIMULATED
+)
+
+// Values of the registration state register
+const (
+	REGSTATE_UNKNOWN = iota
+	REGSTATE_HOME
+	REGSTATE_ROAMING
+	REGSTATE_SEARCHING
+	REGSTATE_DENIED
+	REGSTATE_NOT_REGISTERED
+)
+
+var sources = map[string]uint16{
+	geo.SourceIP:        SOURCE_IP,
+	geo.SourceCell:      SOURCE_CELL,
+	geo.SourceWiFi:      SOURCE_WIFI,
+	geo.SourceStatic:    SOURCE_STATIC,
+	geo.SourceManual:    SOURCE_MANUAL,
+	geo.SourceSimulated: SOURCE_SIMULATED,
+}
+
+// Encode the current values in the register map
+func registers(loc geo.Geolocation, st *modem.Status, maxAge time.Duration, now time.Time) []uint16 {
+	regs := make([]uint16, REGISTER_COUNT)
+	putFloat := func(addr int, f float64) {
+		bits := math.Float32bits(float32(f))
+		regs[addr] = uint16(bits >> 16)
+		regs[addr+1] = uint16(bits)
+	}
+
+	if loc.Timestamp != nil {
+		age := now.Sub(*loc.Timestamp)
+		if age < 0 {
+			age = 0
+		}
+		secs := uint32(math.Min(age.Seconds(), math.MaxUint32))
+
+		putFloat(REG_LATITUDE, loc.Lat)
+		putFloat(REG_LONGITUDE, loc.Lon)
+		putFloat(REG_ACCURACY, loc.Accuracy)
+		regs[REG_FIX_AGE] = uint16(secs >> 16)
+		regs[REG_FIX_AGE+1] = uint16(secs)
+		regs[REG_SOURCE] = sources[loc.Source]
+		if maxAge == 0 || age <= maxAge {
+			regs[REG_FIX_VALID] = 1
+		}
+	}
+
+	if st != nil {
+		regs[REG_SIGNAL] = uint16(st.Network.SignalStrength)
+		regs[REG_RSSI] = uint16(int16(st.Network.SignalRssi))
+		regs[REG_REGISTRATION] = registration(st.Network.State)
+		// Registered away from the home network of the sim
+		if regs[REG_REGISTRATION] == REGSTATE_HOME && st.Network.Roaming {
+			regs[REG_REGISTRATION] = REGSTATE_ROAMING
+		}
+	}
+	return regs
+}
+
+// Map the modem registration state to the register value
+func registration(state string) uint16 {
+	s := strings.ToUpper(state)
+	switch {
+	case s == "":
+		return REGSTATE_UNKNOWN
+	case strings.Contains(s, "ROAM"):
+		return REGSTATE_ROAMING
+	case strings.Contains(s, "DENIED"):
+		return REGSTATE_DENIED
+	case strings.Contains(s, "SEARCH"):
+		return REGSTATE_SEARCHING
+	case strings.Contains(s, "NOT"), strings.Contains(s, "UNREG"):
+		return REGSTATE_NOT_REGISTERED
+	case strings.Contains(s, "REGISTERED"), strings.Contains(s, "HOME"):
+		return REGSTATE_HOME
+	}
+	return REGSTATE_UNKNOWN
+}
+
+// Big endian bytes of a register range
+func encodeRegisters(regs []uint16) []byte {
+	b := make([]byte, 2*len(regs))
+	for i, r := range regs {
+		binary.BigEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
@@ -0,0 +1,235 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/modem"
+	"github.com/sirupsen/logrus"
+)
+
+// Function codes
+const (
+	READ_COILS               = 0x01
+	READ_DISCRETE_INPUTS     = 0x02
+	READ_HOLDING_REGISTERS   = 0x03
+	READ_INPUT_REGISTERS     = 0x04
+	WRITE_SINGLE_COIL        = 0x05
+	WRITE_MULTIPLE_COILS     = 0x0F
+	WRITE_MULTIPLE_REGISTERS = 0x10
+)
+
+// Exception codes
+const (
+	ILLEGAL_FUNCTION     = 0x01
+	ILLEGAL_DATA_ADDRESS = 0x02
+	ILLEGAL_DATA_VALUE   = 0x03
+)
+
+// Length of the MBAP header, and the largest frame allowed by the protocol
+const (
+	HEADER_SIZE    = 7
+	MAX_FRAME_SIZE = 260
+)
+
+// Connections idle for longer are closed
+const IDLE_TIMEOUT = 5 * time.Minute
+
+// Source of the values served in the registers
+type Location interface {
+	Current() geo.Geolocation
+	Relocate()
+}
+
+// Modbus TCP server exposing the location and the modem status to the PLC
+type Server struct {
+	cfg config.Modbus
+	loc Location
+	m   *modem.Modem // optional, the modem registers are 0 without it
+
+	mu sync.Mutex
+	ln net.Listener
+}
+
+func NewServer(cfg config.Modbus, loc Location, m *modem.Modem) *Server {
+	return &Server{
+		cfg: cfg,
+		loc: loc,
+		m:   m,
+	}
+}
+
+// Accept connections until the server is closed
+func (s *Server) Run() error {
+	ln, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	logrus.Printf("Modbus server listening on %s", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Address the server is listening on, nil before Run
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, HEADER_SIZE)
+	for {
+		conn.SetDeadline(time.Now().Add(IDLE_TIMEOUT))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		// Transaction id, protocol id (0 for modbus), length, unit id
+		protocol := binary.BigEndian.Uint16(header[2:4])
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		if protocol != 0 || length < 2 || length > MAX_FRAME_SIZE-6 {
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		res := s.handle(pdu)
+		frame := make([]byte, HEADER_SIZE+len(res))
+		copy(frame, header[:4])
+		binary.BigEndian.PutUint16(frame[4:6], uint16(len(res)+1))
+		frame[6] = header[6]
+		copy(frame[HEADER_SIZE:], res)
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// Handle a request pdu and return the response pdu
+func (s *Server) handle(pdu []byte) []byte {
+	fc := pdu[0]
+	data := pdu[1:]
+
+	switch fc {
+	case READ_HOLDING_REGISTERS, READ_INPUT_REGISTERS:
+		addr, count, ok := readRange(data)
+		if !ok || count < 1 || count > 125 {
+			return exception(fc, ILLEGAL_DATA_VALUE)
+		}
+		if addr+count > REGISTER_COUNT {
+			return exception(fc, ILLEGAL_DATA_ADDRESS)
+		}
+		regs := s.registers()[addr : addr+count]
+		return append([]byte{fc, byte(2 * count)}, encodeRegisters(regs)...)
+	case READ_COILS, READ_DISCRETE_INPUTS:
+		addr, count, ok := readRange(data)
+		if !ok || count < 1 || count > 2000 {
+			return exception(fc, ILLEGAL_DATA_VALUE)
+		}
+		size := COIL_COUNT
+		if fc == READ_DISCRETE_INPUTS {
+			size = DISCRETE_COUNT
+		}
+		if addr+count > size {
+			return exception(fc, ILLEGAL_DATA_ADDRESS)
+		}
+		bits := make([]byte, (count+7)/8)
+		// The relocate coil always reads 0
+		if fc == READ_DISCRETE_INPUTS && s.registers()[REG_FIX_VALID] == 1 {
+			bits[0] = 1
+		}
+		return append([]byte{fc, byte(len(bits))}, bits...)
+	case WRITE_SINGLE_COIL:
+		addr, value, ok := readRange(data)
+		if !ok {
+			return exception(fc, ILLEGAL_DATA_VALUE)
+		}
+		if value != 0xFF00 && value != 0x0000 {
+			return exception(fc, ILLEGAL_DATA_VALUE)
+		}
+		if addr >= COIL_COUNT {
+			return exception(fc, ILLEGAL_DATA_ADDRESS)
+		}
+		if value == 0xFF00 {
+			s.relocate()
+		}
+		// The response echoes the request
+		return append([]byte{fc}, data[:4]...)
+	case WRITE_MULTIPLE_COILS:
+		addr, count, ok := readRange(data)
+		if !ok || len(data) < 5 || count < 1 || int(data[4]) != (count+7)/8 || len(data) < 5+int(data[4]) {
+			return exception(fc, ILLEGAL_DATA_VALUE)
+		}
+		if addr+count > COIL_COUNT {
+			return exception(fc, ILLEGAL_DATA_ADDRESS)
+		}
+		if data[5]&1 == 1 {
+			s.relocate()
+		}
+		return append([]byte{fc}, data[:4]...)
+	case WRITE_MULTIPLE_REGISTERS:
+		// The registers are read only
+		return exception(fc, ILLEGAL_DATA_ADDRESS)
+	}
+	return exception(fc, ILLEGAL_FUNCTION)
+}
+
+func (s *Server) registers() []uint16 {
+	var st *modem.Status
+	if s.m != nil {
+		status := s.m.Status()
+		st = &status
+	}
+	return registers(s.loc.Current(), st, s.cfg.MaxFixAge, time.Now())
+}
+
+func (s *Server) relocate() {
+	logrus.Println("Relocate requested over modbus")
+	s.loc.Relocate()
+}
+
+// Starting address and quantity (or value) of a request
+func readRange(data []byte) (int, int, bool) {
+	if len(data) < 4 {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint16(data[0:2])), int(binary.BigEndian.Uint16(data[2:4])), true
+}
+
+func exception(fc byte, code byte) []byte {
+	return []byte{fc | 0x80, code}
+}
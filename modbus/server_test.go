@@ -0,0 +1,143 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+)
+
+type fakeLocation struct {
+	loc         geo.Geolocation
+	relocations atomic.Int32
+}
+
+func (f *fakeLocation) Current() geo.Geolocation { return f.loc }
+func (f *fakeLocation) Relocate()                { f.relocations.Add(1) }
+
+func startServer(t *testing.T, loc Location) net.Conn {
+	s := NewServer(config.Modbus{ListenAddr: "127.0.0.1:0", MaxFixAge: time.Hour}, loc, nil)
+	go s.Run()
+	t.Cleanup(func() { s.Close() })
+
+	for i := 0; s.Addr() == nil; i++ {
+		if i == 100 {
+			t.Fatal("modbus server not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Send a request pdu and return the response pdu
+func request(t *testing.T, conn net.Conn, pdu ...byte) []byte {
+	frame := make([]byte, HEADER_SIZE+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:2], 0x1234)
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(pdu)+1))
+	frame[6] = 1
+	copy(frame[HEADER_SIZE:], pdu)
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	header := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(header[0:2]) != 0x1234 || header[6] != 1 {
+		t.Fatalf("unexpected response header % x", header)
+	}
+	res := make([]byte, binary.BigEndian.Uint16(header[4:6])-1)
+	if _, err := io.ReadFull(conn, res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestReadRegisters(t *testing.T) {
+	fix := time.Now().Add(-90 * time.Second)
+	loc := &fakeLocation{loc: geo.Geolocation{
+		Lat:       46.7712,
+		Lon:       23.6236,
+		Accuracy:  1200,
+		Source:    geo.SourceCell,
+		Timestamp: &fix,
+	}}
+	conn := startServer(t, loc)
+
+	res := request(t, conn, READ_INPUT_REGISTERS, 0, 0, 0, REGISTER_COUNT)
+	if res[0] != READ_INPUT_REGISTERS || int(res[1]) != 2*REGISTER_COUNT {
+		t.Fatalf("unexpected response % x", res)
+	}
+	reg := func(addr int) []byte { return res[2+2*addr:] }
+	if lat := math.Float32frombits(binary.BigEndian.Uint32(reg(REG_LATITUDE))); lat != float32(46.7712) {
+		t.Fatalf("unexpected latitude %f", lat)
+	}
+	if age := binary.BigEndian.Uint32(reg(REG_FIX_AGE)); age < 90 || age > 92 {
+		t.Fatalf("unexpected fix age %d", age)
+	}
+	if src := binary.BigEndian.Uint16(reg(REG_SOURCE)); src != SOURCE_CELL {
+		t.Fatalf("unexpected source %d", src)
+	}
+	if valid := binary.BigEndian.Uint16(reg(REG_FIX_VALID)); valid != 1 {
+		t.Fatal("expected a valid fix")
+	}
+
+	// Out of the map
+	res = request(t, conn, READ_HOLDING_REGISTERS, 0, 10, 0, 10)
+	if res[0] != READ_HOLDING_REGISTERS|0x80 || res[1] != ILLEGAL_DATA_ADDRESS {
+		t.Fatalf("expected an illegal address exception, got % x", res)
+	}
+}
+
+func TestRelocateCoil(t *testing.T) {
+	loc := &fakeLocation{}
+	conn := startServer(t, loc)
+
+	res := request(t, conn, WRITE_SINGLE_COIL, 0, COIL_RELOCATE, 0xFF, 0x00)
+	if res[0] != WRITE_SINGLE_COIL {
+		t.Fatalf("unexpected response % x", res)
+	}
+	if n := loc.relocations.Load(); n != 1 {
+		t.Fatalf("expected 1 relocation, got %d", n)
+	}
+
+	// No fix yet
+	res = request(t, conn, READ_DISCRETE_INPUTS, 0, DISCRETE_FIX_VALID, 0, 1)
+	if res[2] != 0 {
+		t.Fatal("expected the fix to be invalid")
+	}
+}
+
+func TestOverrideRegisters(t *testing.T) {
+	s, err := geo.NewServer(context.Background(), config.Default(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetOverride(geo.Geolocation{Name: "Pump station 4", Lat: 46.7712, Lon: 23.6236}, time.Time{})
+	conn := startServer(t, s)
+
+	res := request(t, conn, READ_INPUT_REGISTERS, 0, 0, 0, REGISTER_COUNT)
+	reg := func(addr int) []byte { return res[2+2*addr:] }
+	if lat := math.Float32frombits(binary.BigEndian.Uint32(reg(REG_LATITUDE))); lat != float32(46.7712) {
+		t.Fatalf("unexpected latitude %f", lat)
+	}
+	if src := binary.BigEndian.Uint16(reg(REG_SOURCE)); src != SOURCE_MANUAL {
+		t.Fatalf("unexpected source %d", src)
+	}
+	if valid := binary.BigEndian.Uint16(reg(REG_FIX_VALID)); valid != 1 {
+		t.Fatal("expected the override to be a valid fix")
+	}
+}
@@ -0,0 +1,94 @@
+package modem
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Radio technologies, named as OpenCellID names them
+const (
+	RADIO_GSM  = "GSM"
+	RADIO_UMTS = "UMTS"
+	RADIO_LTE  = "LTE"
+	RADIO_NR   = "NR"
+)
+
+// Radio technology of the technology reported by the modem, empty when
+// unknown. A 5G non standalone connection is anchored on an LTE cell
+func Radio(technology string) string {
+	t := strings.ToUpper(strings.TrimSpace(technology))
+	switch {
+	case t == "":
+		return ""
+	case strings.Contains(t, "NSA"):
+		return RADIO_LTE
+	case strings.HasPrefix(t, "NR"), strings.HasPrefix(t, "5G"):
+		return RADIO_NR
+	case strings.HasPrefix(t, "LTE"), t == "4G", strings.HasPrefix(t, "CAT-M"), strings.HasPrefix(t, "EMTC"):
+		return RADIO_LTE
+	case t == "UMTS", t == "WCDMA", t == "3G", strings.HasPrefix(t, "HSPA"), strings.HasPrefix(t, "HSDPA"), strings.HasPrefix(t, "HSUPA"):
+		return RADIO_UMTS
+	case t == "GSM", t == "GPRS", t == "EDGE", t == "2G":
+		return RADIO_GSM
+	}
+	return ""
+}
+
+// Identity of the serving cell, decoded according to its radio. The area
+// is a location area for GSM and UMTS and a tracking area for LTE and NR.
+// The cell id is 16 bits for GSM, 28 bits for UMTS (RNC and cell) and LTE
+// (eNodeB and sector) and 36 bits for NR, where the split between the gNB
+// and the cell is chosen by the operator and is not decoded
+type Cell struct {
+	Radio  string `json:"radio"`
+	LAC    int    `json:"lac,omitempty"`
+	TAC    int    `json:"tac,omitempty"`
+	ID     int64  `json:"id"`
+	RNC    int    `json:"rnc,omitempty"`
+	CID    int    `json:"cid,omitempty"` // cell of the RNC
+	ENB    int    `json:"enb,omitempty"`
+	Sector int    `json:"sector,omitempty"`
+}
+
+func NewCell(technology string, area int, id int64) Cell {
+	c := Cell{Radio: Radio(technology), ID: id}
+	switch c.Radio {
+	case RADIO_LTE, RADIO_NR:
+		c.TAC = area
+	default:
+		c.LAC = area
+	}
+	switch c.Radio {
+	case RADIO_UMTS:
+		c.RNC = int(id >> 16)
+		c.CID = int(id & 0xffff)
+	case RADIO_LTE:
+		c.ENB = int(id >> 8)
+		c.Sector = int(id & 0xff)
+	}
+	return c
+}
+
+// Location or tracking area code
+func (c Cell) Area() int {
+	if c.Radio == RADIO_LTE || c.Radio == RADIO_NR {
+		return c.TAC
+	}
+	return c.LAC
+}
+
+func (c Cell) String() string {
+	radio := c.Radio
+	if radio == "" {
+		radio = "unknown radio"
+	}
+	switch c.Radio {
+	case RADIO_UMTS:
+		return fmt.Sprintf("%s lac %d cell %d (rnc %d cid %d)", radio, c.LAC, c.ID, c.RNC, c.CID)
+	case RADIO_LTE:
+		return fmt.Sprintf("%s tac %d eci %d (enb %d sector %d)", radio, c.TAC, c.ID, c.ENB, c.Sector)
+	case RADIO_NR:
+		return fmt.Sprintf("%s tac %d nci %d", radio, c.TAC, c.ID)
+	}
+	return fmt.Sprintf("%s lac %d cid %d", radio, c.LAC, c.ID)
+}
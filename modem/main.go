@@ -4,15 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/mircearem/locater/plmn"
 )
 
+// Interval between the updates of the network and data service information
+const MODEM_INTERVAL = 5 * time.Minute
+
 var (
-	COMMAND   = "/etc/config-tools/config_mdmd-ng"
 	MDMD_ARGS = []string{"-m", "get", "json"}
 	CONN_ARGS = []string{"-n", "get", "json"}
 	WDS_ARGS  = []string{"-w", "get", "json"}
@@ -54,7 +60,7 @@ type info struct {
 }
 
 type network struct {
-	Cid                 int    `json:"cid"`
+	Cid                 int64  `json:"cid"`
 	FallbackToAuto      string `json:"fallback_to_auto"`
 	Lac                 int    `json:"lac"`
 	Mcc                 int    `json:"mcc"`
@@ -68,6 +74,12 @@ type network struct {
 	State               string `json:"state"`
 	Technology          string `json:"technology"`
 	TechnologySelection string `json:"technology_selection"`
+	Plmn                string `json:"plmn"`    // mcc and mnc, with the leading zeros of the mnc
+	Country             string `json:"country"` // iso code of the serving network, empty if unknown
+	Brand               string `json:"brand"`
+	HomeNetwork         string `json:"home_network,omitempty"` // plmn of the sim, empty if unknown
+	Roaming             bool   `json:"roaming"`
+	Cell                Cell   `json:"cell"` // the cid and lac decoded according to the technology
 }
 
 // Wireless data service
@@ -79,25 +91,63 @@ type wds struct {
 }
 
 type Modem struct {
-	Info     info    `json:"info"`
-	Wireless wds     `json:"wds"`
-	Network  network `json:"network"`
+	Info     info         `json:"info"`
+	Wireless wds          `json:"wds"`
+	Network  network      `json:"network"`
+	Sim      sim          `json:"sim"`
+	mu       sync.RWMutex // guards the information above while it is updated
 	ctx      context.Context
+	command  string // path of the config_mdmd-ng tool
+	home     string // plmn of the home network, from the configuration
+	interval time.Duration
+	iccid    string // of the last sim seen
+	simFile  string // where the last iccid is kept, empty to keep it in memory
+	swapSubs []chan SimSwap
+	// output of config_mdmd-ng for the arguments, the tool is run unless
+	// the outputs are replayed
+	output func(args []string) ([]byte, error)
 }
 
-func NewModem(ctx context.Context) (*Modem, error) {
+func NewModem(ctx context.Context, command string) (*Modem, error) {
 	// Check if a modem is installed on the system
-	if _, err := os.Stat(COMMAND); errors.Is(err, os.ErrNotExist) {
+	if _, err := os.Stat(command); errors.Is(err, os.ErrNotExist) {
 		return nil, err
 	}
 
-	return &Modem{
-		ctx: ctx,
-	}, nil
+	m := &Modem{
+		ctx:      ctx,
+		command:  command,
+		interval: MODEM_INTERVAL,
+	}
+	m.output = m.execute
+	return m, nil
+}
+
+// Set the home network of the sim, roaming is then detected by comparing
+// it with the serving network instead of trusting the registration state
+func (m *Modem) SetHomeNetwork(mccmnc string) error {
+	if mccmnc != "" {
+		if _, err := plmn.Parse(mccmnc); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.home = mccmnc
+	m.mu.Unlock()
+	return nil
+}
+
+// Run config_mdmd-ng
+func (m *Modem) execute(args []string) ([]byte, error) {
+	return exec.CommandContext(m.ctx, m.command, args...).Output()
 }
 
 // Function to initialize the and get all the information
 func (m *Modem) Init() error {
+	// The sim first, its home network decides the roaming. Older firmware
+	// does not report the sim, the modem works without it
+	_ = m.simInfo()
+
 	errch := make(chan error, 3)
 
 	var wg sync.WaitGroup
@@ -131,15 +181,22 @@ func (m *Modem) Init() error {
 	return nil
 }
 
-// Run the modem update
+// Run the modem update, until the context of the modem is done
 func (m *Modem) Run() {
 	// Move the stuff below in a netork update function
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
 
 	var wg sync.WaitGroup
 
 	for {
-		<-ticker.C
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// The sim can be replaced or unlocked while running
+		_ = m.simInfo()
 		for i := 0; i < 2; i += 1 {
 			wg.Add(1)
 			go func(x int) {
@@ -159,26 +216,33 @@ func (m *Modem) Run() {
 // Read modem information -> stays the same, except for the state
 func (m *Modem) mdmdInfo() error {
 	// Execute the command
-	bytes, err := exec.CommandContext(m.ctx, COMMAND, MDMD_ARGS...).Output()
+	bytes, err := m.output(MDMD_ARGS)
 	// Modem not present, set error state
 	if err != nil {
 		err := errors.New("NOT PRESENT")
 		return err
 	}
 
-	err = json.Unmarshal(bytes, &m)
+	var res struct {
+		Info info `json:"info"`
+	}
+	err = json.Unmarshal(bytes, &res)
 	if err != nil {
 		err := errors.New("INFO DECODE ERR")
 		return err
 	}
 
+	m.mu.Lock()
+	m.Info = res.Info
+	m.mu.Unlock()
+
 	return nil
 }
 
 // Read information about the wireless data service -> can change
 func (m *Modem) wdsInfo() error {
 	// Execute the command
-	bytes, err := exec.CommandContext(m.ctx, COMMAND, WDS_ARGS...).Output()
+	bytes, err := m.output(WDS_ARGS)
 	// Modem not present, set error state
 	if err != nil {
 		err := errors.New("NOT PRESENT")
@@ -192,14 +256,16 @@ func (m *Modem) wdsInfo() error {
 		return err
 	}
 
+	m.mu.Lock()
 	m.Wireless = wds
+	m.mu.Unlock()
 
 	return nil
 }
 
 // Update information regarding the connection -> can change
 func (m *Modem) networkInfo() error {
-	bytes, err := exec.CommandContext(m.ctx, COMMAND, CONN_ARGS...).Output()
+	bytes, err := m.output(CONN_ARGS)
 	if err != nil {
 		err := errors.New("CONN READ ERR")
 		return err
@@ -211,6 +277,19 @@ func (m *Modem) networkInfo() error {
 		err := errors.New("CONN DECODE ERR")
 		return err
 	}
+	// The mcc has 3 digits, the mnc 2 or 3 depending on the country
+	p, err := plmn.Parse(conn.Mccmnc)
+	if err != nil {
+		return fmt.Errorf("CONN DECODE ERR: %s", err)
+	}
+	cid, err := strconv.ParseInt(conn.Cid, 10, 64)
+	if err != nil {
+		return fmt.Errorf("CONN DECODE ERR: cid %q", conn.Cid)
+	}
+	lac, err := strconv.Atoi(conn.Lac)
+	if err != nil {
+		return fmt.Errorf("CONN DECODE ERR: lac %q", conn.Lac)
+	}
 
 	var net net
 	err = json.Unmarshal(bytes, &net)
@@ -219,15 +298,28 @@ func (m *Modem) networkInfo() error {
 		return err
 	}
 
-	// Reformat the cid, lac, mcc and mnc to int
-	cid, _ := strconv.Atoi(conn.Cid)
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Network.Cid = cid
-	lac, _ := strconv.Atoi(conn.Lac)
 	m.Network.Lac = lac
-	mcc, _ := strconv.Atoi(conn.Mccmnc[:3])
-	m.Network.Mcc = mcc
-	mnc, _ := strconv.Atoi(conn.Mccmnc[3:])
-	m.Network.Mnc = mnc
+	m.Network.Mcc, m.Network.Mnc = p.Codes()
+	m.Network.Plmn = p.String()
+	op, _ := plmn.Lookup(p)
+	m.Network.Country = op.Country.ISO
+	m.Network.Brand = op.Brand
+	// The configured home network wins over the one of the imsi
+	home := m.home
+	if home == "" {
+		home = m.Sim.HomeNetwork
+	}
+	m.Network.HomeNetwork = home
+	// Roaming when the serving network is not the one of the sim, the
+	// registration state is the only hint without a home network
+	if home != "" {
+		m.Network.Roaming = home != m.Network.Plmn
+	} else {
+		m.Network.Roaming = strings.Contains(strings.ToUpper(net.State), "ROAM")
+	}
 	// Format network information
 	m.Network.FallbackToAuto = net.FallbackToAuto
 	m.Network.Operator = net.Operator
@@ -239,6 +331,26 @@ func (m *Modem) networkInfo() error {
 	m.Network.State = net.State
 	m.Network.Technology = net.Technology
 	m.Network.TechnologySelection = net.TechnologySelection
+	m.Network.Cell = NewCell(net.Technology, lac, cid)
 
 	return nil
 }
+
+// Copy of the modem information, safe to read while the modem is updated
+type Status struct {
+	Info     info    `json:"info"`
+	Wireless wds     `json:"wds"`
+	Network  network `json:"network"`
+	Sim      sim     `json:"sim"`
+}
+
+func (m *Modem) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return Status{
+		Info:     m.Info,
+		Wireless: m.Wireless,
+		Network:  m.Network,
+		Sim:      m.Sim,
+	}
+}
@@ -0,0 +1,336 @@
+package modem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The test binary is also the fake config_mdmd-ng: run with FAKE_MDMD_SCRIPT
+// set it answers the options from the script instead of running the tests
+func TestMain(m *testing.M) {
+	if path := os.Getenv("FAKE_MDMD_SCRIPT"); path != "" {
+		os.Exit(fakeMdmd(path, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// Answer of the fake tool to one call
+type step struct {
+	Output string `json:"output"`
+	Exit   int    `json:"exit"`
+}
+
+// Answers to the successive calls with an option (-m, -n or -w), the last
+// one is repeated
+type script map[string][]step
+
+// Print the next answer for the option, the calls are counted in a file
+// next to the script as every call is a new process
+func fakeMdmd(path string, args []string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var s script
+	if err := json.Unmarshal(b, &s); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(args) != 3 || args[1] != "get" || args[2] != "json" {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %v\n", args)
+		return 2
+	}
+	steps := s[args[0]]
+	if len(steps) == 0 {
+		fmt.Fprintf(os.Stderr, "unknown option %s\n", args[0])
+		return 1
+	}
+
+	counter := path + args[0]
+	n := 0
+	if b, err := os.ReadFile(counter); err == nil {
+		n, _ = strconv.Atoi(string(b))
+	}
+	os.WriteFile(counter, []byte(strconv.Itoa(n+1)), 0600)
+
+	st := steps[min(n, len(steps)-1)]
+	fmt.Print(st.Output)
+	return st.Exit
+}
+
+// Modem running the test binary as config_mdmd-ng with the script
+func newFakeModem(t *testing.T, s script) *Modem {
+	path := filepath.Join(t.TempDir(), "script.json")
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_MDMD_SCRIPT", path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m, err := NewModem(ctx, os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+const (
+	infoOutput = `{"info":{"imei":"356938035643809","manufacturer":"Quectel","model":"EG25","state":"ready","version":"EG25GGBR07A08M2G"}}`
+	wdsOutput  = `{"apn":"internet","ip":"10.64.12.7","state":"connected","status":"ok"}`
+)
+
+func simOutput(iccid, imsi string) string {
+	return fmt.Sprintf(`{"sim":{"iccid":"%s","imsi":"%s","state":"ready","pin_state":"disabled","pin_retries":3}}`, iccid, imsi)
+}
+
+func networkOutput(mccmnc string, lac, cid int) string {
+	return fmt.Sprintf(`{"cid":"%d","lac":"%d","mccmnc":"%s","operator":"Test","operator_identifier":"%s","signal_rssi":-71,"signal_strength":3,"state":"registered home","technology":"LTE"}`,
+		cid, lac, mccmnc, mccmnc)
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		mccmnc   string
+		mcc, mnc int
+	}{
+		{"22610", 226, 10},   // 2 digit mnc
+		{"310410", 310, 410}, // 3 digit mnc
+		{"22601", 226, 1},
+	}
+	for _, tt := range tests {
+		m := newFakeModem(t, script{
+			"-m": {{Output: infoOutput}},
+			"-n": {{Output: networkOutput(tt.mccmnc, 2010, 42051)}},
+			"-w": {{Output: wdsOutput}},
+		})
+		if err := m.Init(); err != nil {
+			t.Fatalf("%s: %s", tt.mccmnc, err)
+		}
+		st := m.Status()
+		if st.Network.Mcc != tt.mcc || st.Network.Mnc != tt.mnc || st.Network.Lac != 2010 || st.Network.Cid != 42051 {
+			t.Errorf("%s: network %+v, want mcc %d mnc %d", tt.mccmnc, st.Network, tt.mcc, tt.mnc)
+		}
+		if st.Info.Model != "EG25" || st.Wireless.IP != "10.64.12.7" {
+			t.Errorf("%s: info %+v, wds %+v", tt.mccmnc, st.Info, st.Wireless)
+		}
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		s    script
+		want string
+	}{
+		{"tool fails", script{
+			"-m": {{Output: "modem not found", Exit: 1}},
+			"-n": {{Output: networkOutput("22610", 1, 1)}},
+			"-w": {{Output: wdsOutput}},
+		}, "NOT PRESENT"},
+		{"malformed info", script{
+			"-m": {{Output: `{"info":`}},
+			"-n": {{Output: networkOutput("22610", 1, 1)}},
+			"-w": {{Output: wdsOutput}},
+		}, "INFO DECODE ERR"},
+		{"malformed network", script{
+			"-m": {{Output: infoOutput}},
+			"-n": {{Output: `not json`}},
+			"-w": {{Output: wdsOutput}},
+		}, "CONN DECODE ERR"},
+		{"no operator", script{
+			"-m": {{Output: infoOutput}},
+			"-n": {{Output: networkOutput("", 0, 0)}},
+			"-w": {{Output: wdsOutput}},
+		}, "CONN DECODE ERR"},
+	}
+	for _, tt := range tests {
+		err := newFakeModem(t, tt.s).Init()
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRunHandover(t *testing.T) {
+	m := newFakeModem(t, script{
+		"-m": {{Output: infoOutput}},
+		// A failed reading keeps the previous cell, then the modem moves
+		// to a cell of another operator
+		"-n": {
+			{Output: networkOutput("22601", 1, 1)},
+			{Output: "busy", Exit: 1},
+			{Output: networkOutput("22610", 2010, 42051)},
+		},
+		"-w": {{Output: wdsOutput}},
+	})
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	m.interval = 10 * time.Millisecond
+	go m.Run()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := m.Status().Network
+		if n.Cid == 42051 {
+			if n.Mnc != 10 || n.Lac != 2010 {
+				t.Errorf("network %+v after the handover", n)
+			}
+			return
+		}
+		if n.Cid != 1 {
+			t.Fatalf("network %+v before the handover, want the first cell", n)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no handover")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRoaming(t *testing.T) {
+	s := script{
+		"-m": {{Output: infoOutput}},
+		"-n": {{Output: networkOutput("22610", 2010, 42051)}},
+		"-w": {{Output: wdsOutput}},
+	}
+	// The home network of the sim decides, whatever the registration state
+	for home, want := range map[string]bool{"22601": true, "22610": false} {
+		m := newFakeModem(t, s)
+		if err := m.SetHomeNetwork(home); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Init(); err != nil {
+			t.Fatal(err)
+		}
+		n := m.Status().Network
+		if n.Roaming != want || n.Plmn != "22610" || n.Country != "ro" || n.Brand != "Orange" {
+			t.Errorf("home %s: network %+v, want roaming %v", home, n, want)
+		}
+	}
+
+	// Without a home network, only the registration state
+	s["-n"] = []step{{Output: strings.Replace(networkOutput("22610", 1, 1), "registered home", "registered roaming", 1)}}
+	m := newFakeModem(t, s)
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Status().Network.Roaming {
+		t.Error("roaming state not flagged")
+	}
+	if err := m.SetHomeNetwork("31041"); err == nil {
+		t.Error("invalid home network accepted")
+	}
+}
+
+func TestCell(t *testing.T) {
+	tests := []struct {
+		technology string
+		area       int
+		id         int64
+		want       Cell
+	}{
+		{"GSM", 2010, 42051, Cell{Radio: RADIO_GSM, LAC: 2010, ID: 42051}},
+		{"WCDMA", 2010, 0x0a1b2c3, Cell{Radio: RADIO_UMTS, LAC: 2010, ID: 0x0a1b2c3, RNC: 0xa1, CID: 0xb2c3}},
+		{"LTE", 10301, 0x1a2b3c4, Cell{Radio: RADIO_LTE, TAC: 10301, ID: 0x1a2b3c4, ENB: 0x1a2b3, Sector: 0xc4}},
+		{"NR5G-NSA", 10301, 0x1a2b3c4, Cell{Radio: RADIO_LTE, TAC: 10301, ID: 0x1a2b3c4, ENB: 0x1a2b3, Sector: 0xc4}},
+		{"NR5G-SA", 10301, 0x8c4a1b2c3, Cell{Radio: RADIO_NR, TAC: 10301, ID: 0x8c4a1b2c3}}, // 36 bits
+		{"", 2010, 42051, Cell{LAC: 2010, ID: 42051}},
+	}
+	for _, tt := range tests {
+		c := NewCell(tt.technology, tt.area, tt.id)
+		if c != tt.want {
+			t.Errorf("%s: cell %+v, want %+v", tt.technology, c, tt.want)
+		}
+		if c.Area() != tt.area {
+			t.Errorf("%s: area %d, want %d", tt.technology, c.Area(), tt.area)
+		}
+	}
+}
+
+func TestSim(t *testing.T) {
+	s := script{
+		"-m": {{Output: infoOutput}},
+		"-n": {{Output: networkOutput("22610", 2010, 42051)}},
+		"-w": {{Output: wdsOutput}},
+		"-s": {
+			{Output: simOutput("8940010000123456789", "226010123456789")},
+			{Output: simOutput("8940010000123456789", "226010123456789")},
+			{Output: `{"sim":{"state":"absent"}}`},
+			{Output: simOutput("8940100000987654321", "226100987654321")},
+		},
+	}
+	m := newFakeModem(t, s)
+	file := filepath.Join(t.TempDir(), "sim")
+	if err := m.SetSimFile(file); err != nil {
+		t.Fatal(err)
+	}
+	swapch := m.SubscribeSimSwaps()
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// The home network of the imsi decides the roaming
+	st := m.Status()
+	if st.Sim.HomeNetwork != "22601" || st.Sim.HomeOperator != "Vodafone" || st.Sim.HomeCountry != "ro" {
+		t.Errorf("sim %+v, want the vodafone home network", st.Sim)
+	}
+	if !st.Network.Roaming || st.Network.HomeNetwork != "22601" {
+		t.Errorf("network %+v, want roaming from the home network of the sim", st.Network)
+	}
+
+	// Removing the sim is not a swap, another one is
+	for i := 0; i < 3; i++ {
+		if err := m.simInfo(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case swap := <-swapch:
+		if swap.Previous != "8940010000123456789" || swap.Iccid != "8940100000987654321" || swap.Imsi != "226100987654321" {
+			t.Errorf("swap %+v", swap)
+		}
+	default:
+		t.Fatal("no swap")
+	}
+	select {
+	case swap := <-swapch:
+		t.Errorf("unexpected swap %+v", swap)
+	default:
+	}
+
+	// The last sim is remembered across restarts
+	b, err := os.ReadFile(file)
+	if err != nil || strings.TrimSpace(string(b)) != "8940100000987654321" {
+		t.Errorf("sim file %q, %v", b, err)
+	}
+	s["-s"] = []step{{Output: simOutput("8940010000123456789", "226010123456789")}}
+	m = newFakeModem(t, s)
+	if err := m.SetSimFile(file); err != nil {
+		t.Fatal(err)
+	}
+	swapch = m.SubscribeSimSwaps()
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case swap := <-swapch:
+		if swap.Previous != "8940100000987654321" {
+			t.Errorf("swap %+v after the restart", swap)
+		}
+	default:
+		t.Error("no swap after the restart")
+	}
+}
@@ -0,0 +1,120 @@
+package modem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mircearem/locater/atomicfile"
+	"github.com/mircearem/locater/plmn"
+)
+
+var SIM_ARGS = []string{"-s", "get", "json"}
+
+// Sim card and subscriber, the home network is decoded from the imsi
+type sim struct {
+	Iccid        string `json:"iccid"`
+	Imsi         string `json:"imsi"`
+	State        string `json:"state"`       // ready, absent, locked...
+	PinState     string `json:"pin_state"`   // disabled, enabled, puk required...
+	PinRetries   int    `json:"pin_retries"` // before the puk is required
+	HomeNetwork  string `json:"home_network,omitempty"`
+	HomeOperator string `json:"home_operator,omitempty"`
+	HomeCountry  string `json:"home_country,omitempty"` // iso code
+}
+
+// Another sim card than the last one seen in the modem
+type SimSwap struct {
+	Previous  string    `json:"previous"` // iccid
+	Iccid     string    `json:"iccid"`
+	Imsi      string    `json:"imsi"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Remember the iccid of the sim in a file, so that a sim replaced while
+// the controller was off is reported as a swap on the next start
+func (m *Modem) SetSimFile(path string) error {
+	var iccid string
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot read the sim file: %s", err)
+		}
+		iccid = strings.TrimSpace(string(b))
+	}
+	m.mu.Lock()
+	m.simFile = path
+	m.iccid = iccid
+	m.mu.Unlock()
+	return nil
+}
+
+// Channel of the sim swaps, a slow subscriber misses the swaps it is not
+// ready for
+func (m *Modem) SubscribeSimSwaps() <-chan SimSwap {
+	ch := make(chan SimSwap, 4)
+	m.mu.Lock()
+	m.swapSubs = append(m.swapSubs, ch)
+	m.mu.Unlock()
+	return ch
+}
+
+// Read the sim and subscriber information -> changes when the sim is
+// replaced or unlocked
+func (m *Modem) simInfo() error {
+	bytes, err := m.output(SIM_ARGS)
+	if err != nil {
+		err := errors.New("SIM READ ERR")
+		return err
+	}
+
+	var res struct {
+		Sim sim `json:"sim"`
+	}
+	err = json.Unmarshal(bytes, &res)
+	if err != nil {
+		err := errors.New("SIM DECODE ERR")
+		return err
+	}
+	s := res.Sim
+	// No imsi while the sim is absent or locked
+	if s.Imsi != "" {
+		p, err := plmn.FromIMSI(s.Imsi)
+		if err != nil {
+			return fmt.Errorf("SIM DECODE ERR: %s", err)
+		}
+		op, _ := plmn.Lookup(p)
+		s.HomeNetwork = p.String()
+		s.HomeOperator = op.Brand
+		s.HomeCountry = op.Country.ISO
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Sim = s
+	if s.Iccid == "" || s.Iccid == m.iccid {
+		return nil
+	}
+	previous := m.iccid
+	m.iccid = s.Iccid
+	if m.simFile != "" {
+		if err := atomicfile.WriteFile(m.simFile, []byte(s.Iccid+"\n")); err != nil {
+			return fmt.Errorf("cannot write the sim file: %s", err)
+		}
+	}
+	// The first sim seen is not a swap
+	if previous == "" {
+		return nil
+	}
+	swap := SimSwap{Previous: previous, Iccid: s.Iccid, Imsi: s.Imsi, Timestamp: time.Now().UTC()}
+	for _, ch := range m.swapSubs {
+		select {
+		case ch <- swap:
+		default:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package modem
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Files of the recorded outputs, by config_mdmd-ng option. The outputs
+// of an option are replayed in the order of the file names, like
+// network-01.json, network-02.json, starting over after the last one.
+// The sim is optional like on the older firmware
+var recordings = map[string]string{
+	MDMD_ARGS[0]: "info*.json",
+	CONN_ARGS[0]: "network*.json",
+	WDS_ARGS[0]:  "wds*.json",
+	SIM_ARGS[0]:  "sim*.json",
+}
+
+// Outputs of config_mdmd-ng recorded in a directory
+type replay struct {
+	mu      sync.Mutex
+	outputs map[string][][]byte // by option
+	next    map[string]int
+}
+
+// Modem replaying the config_mdmd-ng outputs recorded in dir instead of
+// running the tool, read every interval
+func NewSimulatedModem(ctx context.Context, dir string, interval time.Duration) (*Modem, error) {
+	r := &replay{
+		outputs: make(map[string][][]byte),
+		next:    make(map[string]int),
+	}
+	for option, pattern := range recordings {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 && option != SIM_ARGS[0] {
+			return nil, fmt.Errorf("simulated modem: no %s in %s", pattern, dir)
+		}
+		sort.Strings(files)
+		for _, f := range files {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("simulated modem: %s", err)
+			}
+			r.outputs[option] = append(r.outputs[option], b)
+		}
+	}
+
+	return &Modem{
+		ctx:      ctx,
+		command:  dir,
+		interval: interval,
+		output:   r.output,
+	}, nil
+}
+
+func (r *replay) output(args []string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	outputs := r.outputs[args[0]]
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("simulated modem: no output for %v", args)
+	}
+	i := r.next[args[0]]
+	r.next[args[0]] = (i + 1) % len(outputs)
+	return outputs[i], nil
+}
@@ -0,0 +1,265 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/outbox"
+	"github.com/sirupsen/logrus"
+)
+
+// Payloads of the status topic, the offline one is sent by the broker as
+// the last will when the connection is lost
+const (
+	STATUS_ONLINE  = "online"
+	STATUS_OFFLINE = "offline"
+)
+
+// Time to wait for the broker to acknowledge a message
+const PUBLISH_TIMEOUT = 10 * time.Second
+
+// Delay between the attempts of the first connection
+var connectRetryInterval = 5 * time.Second
+
+// Entry of the outbox
+type message struct {
+	Topic    string `json:"topic"`
+	Payload  []byte `json:"payload"`
+	Retained bool   `json:"retained"`
+}
+
+// Publishes the reported locations and the modem snapshots to a broker.
+// The messages go through the outbox, the ones produced while the broker
+// is unreachable are published in order once it is back
+type Publisher struct {
+	device   string
+	m        *modem.Modem // optional, no modem snapshots without it
+	sink     *outbox.Sink
+	reloadch chan struct{} // the modem interval may have changed
+	quitch   chan struct{}
+
+	mu     sync.RWMutex
+	cfg    config.MQTT
+	client paho.Client
+}
+
+func NewPublisher(cfg config.MQTT, device string, m *modem.Modem, box *outbox.Outbox) (*Publisher, error) {
+	p := &Publisher{
+		cfg:      cfg,
+		device:   device,
+		m:        m,
+		reloadch: make(chan struct{}, 1),
+		quitch:   make(chan struct{}),
+	}
+
+	var err error
+	p.client, err = p.newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.sink, err = box.Sink("mqtt", outbox.Options{MaxEntries: cfg.BufferSize}, p.deliver)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Publisher) newClient(cfg config.MQTT) (paho.Client, error) {
+	opts, err := ClientOptions(cfg, p.expand(cfg.ClientID))
+	if err != nil {
+		return nil, err
+	}
+	opts.SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(connectRetryInterval).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(p.expand(cfg.StatusTopic), STATUS_OFFLINE, cfg.QoS, true).
+		SetOnConnectHandler(func(c paho.Client) { p.onConnect(c, cfg) }).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logrus.Printf("MQTT connection lost: %s", err)
+		})
+	return paho.NewClient(opts), nil
+}
+
+// Connect to the broker of a reloaded configuration, the previous client
+// is reported offline. The messages not published yet stay in the outbox
+// for the new client, its size is the one of the start
+func (p *Publisher) Set(cfg config.MQTT) error {
+	if cfg.Broker == "" {
+		return errors.New("mqtt cannot be disabled while running")
+	}
+	client, err := p.newClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	prev, prevCfg := p.client, p.cfg
+	p.client, p.cfg = client, cfg
+	p.mu.Unlock()
+	disconnect(prev, p.expand(prevCfg.StatusTopic), prevCfg.QoS)
+	client.Connect()
+
+	select {
+	case p.reloadch <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Publish the locations received on the channel and the modem snapshots
+// until the publisher is closed
+func (p *Publisher) Run(locch <-chan geo.Geolocation) {
+	// With connect retry the token only completes once connected
+	p.mu.RLock()
+	p.client.Connect()
+	ticker := time.NewTicker(p.cfg.ModemInterval)
+	p.mu.RUnlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case loc := <-locch:
+			b, err := json.Marshal(loc)
+			if err != nil {
+				logrus.Println(err)
+				continue
+			}
+			cfg := p.config()
+			p.send(loc.TraceContext(), message{
+				Topic:    p.expand(cfg.LocationTopic),
+				Payload:  b,
+				Retained: cfg.Retain,
+			})
+		case <-ticker.C:
+			if p.m == nil {
+				continue
+			}
+			b, err := json.Marshal(p.m.Status())
+			if err != nil {
+				logrus.Println(err)
+				continue
+			}
+			cfg := p.config()
+			p.send(context.Background(), message{
+				Topic:    p.expand(cfg.ModemTopic),
+				Payload:  b,
+				Retained: cfg.Retain,
+			})
+		case <-p.reloadch:
+			ticker.Reset(p.config().ModemInterval)
+		case <-p.quitch:
+			return
+		}
+	}
+}
+
+// Report the publisher offline and disconnect from the broker
+func (p *Publisher) Close() {
+	close(p.quitch)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	disconnect(p.client, p.expand(p.cfg.StatusTopic), p.cfg.QoS)
+}
+
+func disconnect(c paho.Client, statusTopic string, qos byte) {
+	if c.IsConnectionOpen() {
+		c.Publish(statusTopic, qos, true, STATUS_OFFLINE).WaitTimeout(PUBLISH_TIMEOUT)
+	}
+	c.Disconnect(250)
+}
+
+func (p *Publisher) config() config.MQTT {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cfg
+}
+
+// Number of messages waiting for the broker
+func (p *Publisher) Buffered() int {
+	return p.sink.Pending()
+}
+
+func (p *Publisher) onConnect(c paho.Client, cfg config.MQTT) {
+	logrus.Printf("MQTT connected to %s", cfg.Broker)
+	// The handler must not block the client
+	go func() {
+		c.Publish(p.expand(cfg.StatusTopic), cfg.QoS, true, STATUS_ONLINE).WaitTimeout(PUBLISH_TIMEOUT)
+		p.sink.Wake()
+	}()
+}
+
+// Write a message to the outbox, its delivery continues the trace of the
+// context
+func (p *Publisher) send(ctx context.Context, msg message) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		logrus.Println(err)
+		return
+	}
+	if err := p.sink.Put(ctx, b); err != nil {
+		logrus.Println(err)
+	}
+}
+
+// Publish a message of the outbox, it stays there until the broker
+// acknowledges it
+func (p *Publisher) deliver(b []byte, attempt int) error {
+	var msg message
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return outbox.Permanent(err)
+	}
+	p.mu.RLock()
+	client, qos := p.client, p.cfg.QoS
+	p.mu.RUnlock()
+	if !client.IsConnectionOpen() {
+		return errors.New("not connected")
+	}
+	t := client.Publish(msg.Topic, qos, msg.Retained, msg.Payload)
+	if !t.WaitTimeout(PUBLISH_TIMEOUT) {
+		return errors.New("publish timeout")
+	}
+	if err := t.Error(); err != nil {
+		if attempt == 1 {
+			logrus.Printf("MQTT publish to %s failed, keeping it in the outbox: %s", msg.Topic, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Replace the {device} and {imei} placeholders
+func (p *Publisher) expand(s string) string {
+	imei := ""
+	if p.m != nil {
+		imei = p.m.Status().Info.Imei
+	}
+	return strings.NewReplacer("{device}", p.device, "{imei}", imei).Replace(s)
+}
+
+// Connection options shared by the clients of the broker
+func ClientOptions(cfg config.MQTT, clientID string) (*paho.ClientOptions, error) {
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(clientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password)
+
+	if cfg.TLS != (config.TLS{}) {
+		tlsCfg, err := cfg.TLS.ClientConfig("mqtt", false)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsCfg)
+	}
+	return opts, nil
+}
@@ -0,0 +1,200 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/outbox"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func startBroker(t *testing.T, addr string) *mochi.Server {
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func openOutbox(t *testing.T) *outbox.Outbox {
+	cfg := config.Default().Outbox
+	cfg.Path = filepath.Join(t.TempDir(), "outbox.db")
+	box, err := outbox.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { box.Close() })
+	return box
+}
+
+// Locations produced before the broker is reachable are delivered once
+// the publisher connects
+func TestPublisherBuffersOffline(t *testing.T) {
+	connectRetryInterval = 100 * time.Millisecond
+	addr := freeAddr(t)
+
+	cfg := config.Default().MQTT
+	cfg.Broker = "tcp://" + addr
+	p, err := NewPublisher(cfg, "pump-4", nil, openOutbox(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locch := make(chan geo.Geolocation)
+	go p.Run(locch)
+	defer p.Close()
+
+	locch <- geo.Geolocation{City: "Cluj-Napoca", Source: geo.SourceCell}
+	for i := 0; p.Buffered() != 1; i++ {
+		if i == 50 {
+			t.Fatalf("expected 1 buffered message, got %d", p.Buffered())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server := startBroker(t, addr)
+	received := make(chan packets.Packet, 4)
+	err = server.Subscribe("locater/pump-4/#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		received <- pk
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case pk := <-received:
+			if pk.TopicName != "locater/pump-4/location" {
+				continue
+			}
+			var loc geo.Geolocation
+			if err := json.Unmarshal(pk.Payload, &loc); err != nil {
+				t.Fatal(err)
+			}
+			if loc.City != "Cluj-Napoca" {
+				t.Fatalf("unexpected location: %+v", loc)
+			}
+			return
+		case <-deadline:
+			t.Fatal("location not delivered after the broker came up")
+		}
+	}
+}
+
+// The client id, the last will and the status use the imei of the modem
+func TestImeiTopics(t *testing.T) {
+	connectRetryInterval = 100 * time.Millisecond
+	addr := freeAddr(t)
+	server := startBroker(t, addr)
+	received := make(chan packets.Packet, 4)
+	err := server.Subscribe("locater/#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		received <- pk
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := modem.NewSimulatedModem(context.Background(), "../simulation/modem", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default().MQTT
+	cfg.Broker = "tcp://" + addr
+	cfg.ClientID = "locater-{imei}"
+	cfg.StatusTopic = "locater/{imei}/status"
+	p, err := NewPublisher(cfg, "pump-4", m, openOutbox(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Run(make(chan geo.Geolocation))
+	defer p.Close()
+
+	opts := p.client.OptionsReader()
+	if id := opts.ClientID(); id != "locater-356938035643809" {
+		t.Errorf("client id %q", id)
+	}
+	if will := opts.WillTopic(); will != "locater/356938035643809/status" {
+		t.Errorf("will topic %q", will)
+	}
+	select {
+	case pk := <-received:
+		if pk.TopicName != "locater/356938035643809/status" || string(pk.Payload) != STATUS_ONLINE {
+			t.Errorf("%s on %s, want online on the imei status topic", pk.Payload, pk.TopicName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("status not published")
+	}
+}
+
+// After a reload the locations go to the new broker
+func TestSetBroker(t *testing.T) {
+	connectRetryInterval = 100 * time.Millisecond
+	first := freeAddr(t)
+	startBroker(t, first)
+	second := freeAddr(t)
+	server := startBroker(t, second)
+	received := make(chan packets.Packet, 4)
+	err := server.Subscribe("locater/pump-4/location", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		received <- pk
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default().MQTT
+	cfg.Broker = "tcp://" + first
+	p, err := NewPublisher(cfg, "pump-4", nil, openOutbox(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locch := make(chan geo.Geolocation)
+	go p.Run(locch)
+	defer p.Close()
+
+	cfg.Broker = "tcp://" + second
+	if err := p.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	locch <- geo.Geolocation{City: "Turda", Source: geo.SourceCell}
+	select {
+	case pk := <-received:
+		var loc geo.Geolocation
+		if err := json.Unmarshal(pk.Payload, &loc); err != nil || loc.City != "Turda" {
+			t.Fatalf("unexpected location %s", pk.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("location not published to the new broker")
+	}
+
+	cfg.Broker = ""
+	if err := p.Set(cfg); err == nil {
+		t.Fatal("mqtt disabled while running")
+	}
+}
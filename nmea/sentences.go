@@ -0,0 +1,91 @@
+package nmea
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/mircearem/locater/geo"
+)
+
+// GGA fix quality, none of the locater sources is a satellite fix so the
+// computed ones are reported as estimated, the configured ones as manual
+// input and the replayed tracks as simulated
+const (
+	QUALITY_INVALID   = 0
+	QUALITY_ESTIMATED = 6
+	QUALITY_MANUAL    = 7
+	QUALITY_SIMULATED = 8
+)
+
+// Horizontal error of a fix with a dilution of 1, used to turn the
+// accuracy radius into the GGA hdop
+const UERE = 5.0
+
+// Largest hdop the GGA field can hold
+const MAX_HDOP = 99.9
+
+// Sentences reporting a location, GGA then RMC, terminated by CRLF. The
+// position is left empty when there is no location yet or when it is
+// older than the maximum age
+func sentences(talker string, loc geo.Geolocation, maxAge time.Duration, now time.Time) []string {
+	now = now.UTC()
+	hms := now.Format("150405.00")
+	valid := loc.Timestamp != nil && (maxAge == 0 || now.Sub(*loc.Timestamp) <= maxAge)
+
+	if !valid {
+		return []string{
+			sentence(talker+"GGA", hms, "", "", "", "", "0", "00", "", "", "", "", "", "", ""),
+			sentence(talker+"RMC", hms, "V", "", "", "", "", "", "", now.Format("020106"), "", "", "N"),
+		}
+	}
+
+	lat, ns := coordinate(loc.Lat, 2, "N", "S")
+	lon, ew := coordinate(loc.Lon, 3, "E", "W")
+	quality, mode := QUALITY_ESTIMATED, "E"
+	if loc.Source == geo.SourceStatic || loc.Source == geo.SourceManual {
+		quality, mode = QUALITY_MANUAL, "M"
+	} else if loc.Source == geo.SourceSimulated {
+		quality, mode = QUALITY_SIMULATED, "S"
+	}
+	hdop := ""
+	if loc.Accuracy > 0 {
+		hdop = fmt.Sprintf("%.1f", math.Min(loc.Accuracy/UERE, MAX_HDOP))
+	}
+
+	return []string{
+		sentence(talker+"GGA", hms, lat, ns, lon, ew, fmt.Sprint(quality), "00", hdop, "", "M", "", "M", "", ""),
+		sentence(talker+"RMC", hms, "A", lat, ns, lon, ew, "", "", now.Format("020106"), "", "", mode),
+	}
+}
+
+// $<fields separated by commas>*<checksum>
+func sentence(fields ...string) string {
+	body := strings.Join(fields, ",")
+	return fmt.Sprintf("$%s*%02X\r\n", body, checksum(body))
+}
+
+// Xor of the characters between $ and *
+func checksum(body string) byte {
+	var cs byte
+	for i := 0; i < len(body); i++ {
+		cs ^= body[i]
+	}
+	return cs
+}
+
+// Degrees and decimal minutes, ddmm.mmmm for the latitude and dddmm.mmmm
+// for the longitude, with the hemisphere
+func coordinate(v float64, digits int, pos, neg string) (string, string) {
+	hemisphere := pos
+	if v < 0 {
+		hemisphere = neg
+		v = -v
+	}
+	// Round the minutes first, 59.99999 must carry into the degrees
+	minutes := math.Round(v*60*10000) / 10000
+	degrees := math.Floor(minutes / 60)
+	minutes -= degrees * 60
+	return fmt.Sprintf("%0*d%07.4f", digits, int(degrees), minutes), hemisphere
+}
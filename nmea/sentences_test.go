@@ -0,0 +1,105 @@
+package nmea
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+)
+
+type fakeLocation geo.Geolocation
+
+func (f fakeLocation) Current() geo.Geolocation { return geo.Geolocation(f) }
+
+func TestSentences(t *testing.T) {
+	now := time.Date(2024, 3, 9, 12, 35, 19, 0, time.UTC)
+	fix := now.Add(-time.Minute)
+	loc := geo.Geolocation{
+		Lat:       48.1173,
+		Lon:       -11.5166667,
+		Accuracy:  25,
+		Source:    geo.SourceWiFi,
+		Timestamp: &fix,
+	}
+
+	s := sentences("GP", loc, time.Hour, now)
+	expected := []string{
+		"$GPGGA,123519.00,4807.0380,N,01131.0000,W,6,00,5.0,,M,,M,,*43\r\n",
+		"$GPRMC,123519.00,A,4807.0380,N,01131.0000,W,,,090324,,,E*4B\r\n",
+	}
+	for i := range expected {
+		if s[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected[i], s[i])
+		}
+	}
+
+	// Stale fix
+	s = sentences("GN", loc, 30*time.Second, now)
+	if !strings.HasPrefix(s[0], "$GNGGA,123519.00,,,,,0,") || !strings.HasPrefix(s[1], "$GNRMC,123519.00,V,") {
+		t.Fatalf("expected no fix, got %q", s)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// Reference sentence of the NMEA 0183 documentation
+	body := "GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,"
+	if cs := checksum(body); cs != 0x47 {
+		t.Fatalf("expected checksum 47, got %02X", cs)
+	}
+}
+
+func TestCoordinateCarry(t *testing.T) {
+	if c, h := coordinate(-9.9999999, 3, "E", "W"); c != "01000.0000" || h != "W" {
+		t.Fatalf("expected 01000.0000 W, got %s %s", c, h)
+	}
+}
+
+func TestTCPOutput(t *testing.T) {
+	cfg := config.NMEA{Output: OUTPUT_TCP, Addr: "127.0.0.1:0", Rate: 50 * time.Millisecond, Talker: "GP"}
+	now := time.Now()
+	s := NewSink(cfg, fakeLocation{Lat: 46.7712, Lon: 23.6236, Source: geo.SourceStatic, Timestamp: &now})
+	go s.Run()
+	t.Cleanup(func() { s.Close() })
+
+	for i := 0; s.Addr() == nil; i++ {
+		if i == 100 {
+			t.Fatal("nmea server not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "$GPGGA,") || !strings.Contains(line, ",4646.2720,N,02337.4160,E,7,") {
+		t.Fatalf("unexpected sentence %q", line)
+	}
+}
+
+func TestPtyClose(t *testing.T) {
+	cfg := config.NMEA{Output: OUTPUT_PTY, Rate: time.Millisecond, Talker: "GP"}
+	now := time.Now()
+	s := NewSink(cfg, fakeLocation{Lat: 46.7712, Lon: 23.6236, Source: geo.SourceStatic, Timestamp: &now})
+	errch := make(chan error, 1)
+	go func() { errch <- s.Run() }()
+
+	time.Sleep(20 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errch; err != nil {
+		t.Skipf("pty not available: %s", err)
+	}
+}
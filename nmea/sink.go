@@ -0,0 +1,277 @@
+package nmea
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// Outputs of the sink
+const (
+	OUTPUT_TCP = "tcp"
+	OUTPUT_UDP = "udp"
+	OUTPUT_PTY = "pty"
+)
+
+// Time to wait for a tcp client to accept the sentences
+const WRITE_TIMEOUT = 5 * time.Second
+
+// Source of the reported location
+type Location interface {
+	Current() geo.Geolocation
+}
+
+// Destination of the sentences
+type output interface {
+	write(b []byte) error
+	close() error
+}
+
+// Writes GGA and RMC sentences of the current location at a fixed rate,
+// for the consumers that only speak NMEA 0183
+type Sink struct {
+	cfg config.NMEA
+	loc Location
+
+	mu      sync.Mutex
+	out     output
+	running bool
+	quitch  chan struct{}
+	donech  chan struct{}
+}
+
+func NewSink(cfg config.NMEA, loc Location) *Sink {
+	return &Sink{
+		cfg:    cfg,
+		loc:    loc,
+		quitch: make(chan struct{}),
+		donech: make(chan struct{}),
+	}
+}
+
+// Open the output and write the sentences until the sink is closed
+func (s *Sink) Run() error {
+	s.mu.Lock()
+	select {
+	case <-s.quitch:
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer close(s.donech)
+
+	out, err := s.open()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.out = out
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(s.cfg.Rate)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			b := strings.Join(sentences(s.cfg.Talker, s.loc.Current(), s.cfg.MaxFixAge, now), "")
+			if err := out.write([]byte(b)); err != nil {
+				logrus.Printf("NMEA write failed: %s", err)
+			}
+		case <-s.quitch:
+			return nil
+		}
+	}
+}
+
+// Address of the tcp listener, nil for the other outputs or before Run
+func (s *Sink) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if out, ok := s.out.(*tcpOutput); ok {
+		return out.ln.Addr()
+	}
+	return nil
+}
+
+// The output is closed once Run stopped writing to it
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	close(s.quitch)
+	running := s.running
+	s.mu.Unlock()
+	if running {
+		<-s.donech
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.out == nil {
+		return nil
+	}
+	return s.out.close()
+}
+
+func (s *Sink) open() (output, error) {
+	switch s.cfg.Output {
+	case OUTPUT_TCP:
+		return listenTCP(s.cfg.Addr)
+	case OUTPUT_UDP:
+		conn, err := net.Dial("udp", s.cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Printf("NMEA sentences sent to udp %s", s.cfg.Addr)
+		return &udpOutput{conn: conn}, nil
+	case OUTPUT_PTY:
+		return openPty(s.cfg.Link)
+	}
+	return nil, fmt.Errorf("unknown nmea output %q", s.cfg.Output)
+}
+
+// Every connected client gets the sentences
+type tcpOutput struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	clients map[net.Conn]struct{}
+}
+
+func listenTCP(addr string) (*tcpOutput, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Printf("NMEA server listening on %s", ln.Addr())
+
+	o := &tcpOutput{ln: ln, clients: make(map[net.Conn]struct{})}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logrus.Printf("NMEA server stopped: %s", err)
+				}
+				return
+			}
+			o.mu.Lock()
+			o.clients[conn] = struct{}{}
+			o.mu.Unlock()
+		}
+	}()
+	return o, nil
+}
+
+// A client that does not keep up is disconnected
+func (o *tcpOutput) write(b []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for conn := range o.clients {
+		conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+		if _, err := conn.Write(b); err != nil {
+			conn.Close()
+			delete(o.clients, conn)
+		}
+	}
+	return nil
+}
+
+func (o *tcpOutput) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for conn := range o.clients {
+		conn.Close()
+	}
+	return o.ln.Close()
+}
+
+// Datagrams to a single or a broadcast address
+type udpOutput struct {
+	conn net.Conn
+}
+
+func (o *udpOutput) write(b []byte) error {
+	_, err := o.conn.Write(b)
+	return err
+}
+
+func (o *udpOutput) close() error {
+	return o.conn.Close()
+}
+
+// Pseudo-terminal standing in for a serial port. The sentences are
+// dropped while the previous ones are still waiting for a reader, so
+// that the sink never blocks on a closed port
+type ptyOutput struct {
+	master *os.File
+	slave  *os.File
+	link   string
+	linech chan []byte
+}
+
+func openPty(link string) (*ptyOutput, error) {
+	master, slave, err := pty.Open()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open pty: %s", err)
+	}
+	// The consumer must read the sentences as they are written
+	if _, err := term.MakeRaw(int(slave.Fd())); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, fmt.Errorf("cannot set the pty in raw mode: %s", err)
+	}
+
+	o := &ptyOutput{
+		master: master,
+		slave:  slave,
+		link:   link,
+		linech: make(chan []byte, 1),
+	}
+	if link != "" {
+		os.Remove(link)
+		if err := os.Symlink(slave.Name(), link); err != nil {
+			o.close()
+			return nil, fmt.Errorf("cannot link the pty: %s", err)
+		}
+		logrus.Printf("NMEA sentences written to %s, linked from %s", slave.Name(), link)
+	} else {
+		logrus.Printf("NMEA sentences written to %s", slave.Name())
+	}
+
+	go func() {
+		for b := range o.linech {
+			if _, err := master.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	return o, nil
+}
+
+func (o *ptyOutput) write(b []byte) error {
+	select {
+	case o.linech <- b:
+	default:
+	}
+	return nil
+}
+
+func (o *ptyOutput) close() error {
+	close(o.linech)
+	if o.link != "" {
+		os.Remove(o.link)
+	}
+	o.slave.Close()
+	return o.master.Close()
+}
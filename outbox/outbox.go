@@ -0,0 +1,452 @@
+package outbox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/tracing"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Delays between the attempts of a failing delivery, doubled after every
+// failure
+const (
+	DEFAULT_BACKOFF     = time.Second
+	DEFAULT_MAX_BACKOFF = time.Minute
+)
+
+// Bucket holding the cursor of every sink, the entries of a sink are in
+// a bucket named after it
+var cursorsBucket = []byte("cursors")
+
+// An entry is the time it was written in unix nanoseconds then the
+// payload. With this bit of the time set, a length byte and the
+// traceparent of the producer come before the payload
+const TRACE_FLAG = uint64(1) << 63
+
+// A truncated entry or one with a bad traceparent length, it cannot be
+// delivered and is dropped
+var errMalformed = errors.New("malformed entry")
+
+// Deliver an entry, attempt is 1 for the first try of the entry
+type DeliverFunc func(payload []byte, attempt int) error
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Mark a delivery error as final, the entry is dropped instead of retried
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Limits and retry delays of a sink, the zero values use the defaults.
+// Expired is given the entries dropped for their age, they are otherwise
+// lost
+type Options struct {
+	MaxEntries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Expired    func(payload []byte)
+}
+
+// Persistent queue of the outbound messages. Every sink has its own
+// entries and cursor, and a worker delivering them one at a time in the
+// order they were written, so nothing produced while offline is lost
+type Outbox struct {
+	cfg config.Outbox
+	db  *bolt.DB
+
+	mu     sync.Mutex
+	sinks  map[string]*Sink
+	wg     sync.WaitGroup
+	quitch chan struct{}
+}
+
+func Open(cfg config.Outbox) (*Outbox, error) {
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the outbox %s: %s", cfg.Path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(cursorsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Outbox{
+		cfg:    cfg,
+		db:     db,
+		sinks:  make(map[string]*Sink),
+		quitch: make(chan struct{}),
+	}, nil
+}
+
+// Stop the workers, the entries not delivered yet are kept for the next run
+func (o *Outbox) Close() error {
+	close(o.quitch)
+	o.wg.Wait()
+	return o.db.Close()
+}
+
+// Register a sink and start delivering its entries, the ones left by the
+// previous run first
+func (o *Outbox) Sink(name string, opts Options, deliver DeliverFunc) (*Sink, error) {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = o.cfg.MaxEntries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DEFAULT_BACKOFF
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.sinks[name]; ok {
+		return nil, fmt.Errorf("outbox sink %q is already registered", name)
+	}
+
+	s := &Sink{
+		name:    name,
+		bucket:  []byte("sink:" + name),
+		opts:    opts,
+		maxAge:  o.cfg.MaxAge,
+		deliver: deliver,
+		o:       o,
+		wakech:  make(chan struct{}, 1),
+	}
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return err
+		}
+		s.pending = b.Stats().KeyN
+		s.cursor = decodeSeq(tx.Bucket(cursorsBucket).Get([]byte(name)))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the outbox sink %q: %s", name, err)
+	}
+	if s.pending > 0 {
+		logrus.Printf("Outbox sink %s has %d entries from the previous run", name, s.pending)
+	}
+
+	o.sinks[name] = s
+	o.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// Statistics of every sink, by name
+func (o *Outbox) Stats() []Stats {
+	o.mu.Lock()
+	sinks := make([]*Sink, 0, len(o.sinks))
+	for _, s := range o.sinks {
+		sinks = append(sinks, s)
+	}
+	o.mu.Unlock()
+
+	stats := make([]Stats, 0, len(sinks))
+	for _, s := range sinks {
+		stats = append(stats, s.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// Counters of a sink since the daemon started
+type Stats struct {
+	Name      string  `json:"name"`
+	Pending   int     `json:"pending"`
+	Cursor    uint64  `json:"cursor"` // sequence of the last delivered entry
+	Delivered uint64  `json:"delivered"`
+	Failed    uint64  `json:"failed"`  // attempts that will be retried
+	Dropped   uint64  `json:"dropped"` // entries over the limits or refused for good
+	OldestAge float64 `json:"oldest_age_seconds"`
+}
+
+type Sink struct {
+	name    string
+	bucket  []byte
+	opts    Options
+	maxAge  time.Duration
+	deliver DeliverFunc
+	o       *Outbox
+	wakech  chan struct{}
+
+	mu        sync.Mutex
+	pending   int
+	cursor    uint64
+	oldest    time.Time // written time of the next entry, zero when empty
+	delivered uint64
+	failed    uint64
+	dropped   uint64
+}
+
+// Write an entry, the oldest one is dropped when the sink is full. The
+// delivery continues the trace of the context
+func (s *Sink) Put(ctx context.Context, payload []byte) error {
+	now := time.Now()
+	value := encodeEntry(now, tracing.Traceparent(ctx), payload)
+	dropped := 0
+	err := s.o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(encodeSeq(seq), value); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		over := s.pending + 1 - s.opts.MaxEntries
+		s.mu.Unlock()
+		c := b.Cursor()
+		for ; dropped < over; dropped++ {
+			if k, _ := c.First(); k == nil {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot write to the outbox sink %s: %s", s.name, err)
+	}
+
+	s.mu.Lock()
+	s.pending += 1 - dropped
+	s.dropped += uint64(dropped)
+	if s.oldest.IsZero() {
+		s.oldest = now
+	}
+	s.mu.Unlock()
+	if dropped > 0 {
+		logrus.Printf("Outbox sink %s is full, dropped %d entries", s.name, dropped)
+	}
+	s.Wake()
+	return nil
+}
+
+// Retry the next entry right away, for example after a reconnection
+func (s *Sink) Wake() {
+	select {
+	case s.wakech <- struct{}{}:
+	default:
+	}
+}
+
+// Number of entries not delivered yet
+func (s *Sink) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+func (s *Sink) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Stats{
+		Name:      s.name,
+		Pending:   s.pending,
+		Cursor:    s.cursor,
+		Delivered: s.delivered,
+		Failed:    s.failed,
+		Dropped:   s.dropped,
+	}
+	if !s.oldest.IsZero() {
+		st.OldestAge = time.Since(s.oldest).Seconds()
+	}
+	return st
+}
+
+// Deliver the entries in order, the next one waits until the current one
+// is delivered, dropped, or expired
+func (s *Sink) run() {
+	defer s.o.wg.Done()
+	var last uint64
+	attempt := 0
+	backoff := s.opts.Backoff
+	for {
+		seq, written, traceparent, payload, ok, err := s.next()
+		if errors.Is(err, errMalformed) {
+			logrus.Printf("Outbox sink %s dropped entry %d: %s", s.name, seq, err)
+			s.ack(seq, false)
+			continue
+		}
+		if err != nil {
+			logrus.Printf("Outbox sink %s read failed: %s", s.name, err)
+		}
+		if !ok {
+			select {
+			case <-s.wakech:
+				continue
+			case <-s.o.quitch:
+				return
+			}
+		}
+		// The entry that was retried may have been dropped by a full sink
+		if seq != last {
+			last, attempt, backoff = seq, 0, s.opts.Backoff
+		}
+
+		if s.maxAge > 0 && time.Since(written) > s.maxAge {
+			if s.opts.Expired != nil {
+				s.opts.Expired(payload)
+			}
+			s.ack(seq, false)
+			continue
+		}
+
+		attempt++
+		_, span := tracing.Start(tracing.WithTraceparent(context.Background(), traceparent), "outbox delivery",
+			tracing.ATTR_SINK.String(s.name),
+			tracing.ATTR_ATTEMPT.Int(attempt),
+		)
+		err = s.deliver(payload, attempt)
+		tracing.End(span, err)
+		var perr *permanentError
+		if err == nil || errors.As(err, &perr) {
+			if err != nil {
+				logrus.Printf("Outbox sink %s dropped entry %d: %s", s.name, seq, err)
+			}
+			s.ack(seq, err == nil)
+			continue
+		}
+
+		s.mu.Lock()
+		s.failed++
+		s.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-s.wakech:
+		case <-s.o.quitch:
+			return
+		}
+		backoff = min(2*backoff, s.opts.MaxBackoff)
+	}
+}
+
+// First entry after the cursor, a malformed one is returned with its seq
+// and errMalformed so that it can be skipped
+func (s *Sink) next() (seq uint64, written time.Time, traceparent string, payload []byte, ok bool, err error) {
+	err = s.o.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+		k, v := c.Seek(encodeSeq(s.cursor + 1))
+		if k == nil {
+			return nil
+		}
+		seq = decodeSeq(k)
+		// The value is only valid during the transaction
+		written, traceparent, payload, ok = decodeEntry(v)
+		if !ok {
+			return errMalformed
+		}
+		payload = append([]byte(nil), payload...)
+		return nil
+	})
+
+	s.mu.Lock()
+	if ok {
+		s.oldest = written
+	} else {
+		s.oldest = time.Time{}
+	}
+	s.mu.Unlock()
+	return
+}
+
+// Move the cursor past an entry and remove it
+func (s *Sink) ack(seq uint64, delivered bool) {
+	// The entry may have been dropped by a full sink while it was delivered
+	existed := false
+	err := s.o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if b.Get(encodeSeq(seq)) != nil {
+			existed = true
+			if err := b.Delete(encodeSeq(seq)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(cursorsBucket).Put([]byte(s.name), encodeSeq(seq))
+	})
+	if err != nil {
+		logrus.Printf("Outbox sink %s cursor update failed: %s", s.name, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursor = seq
+	if existed {
+		s.pending--
+	}
+	if delivered {
+		s.delivered++
+	} else if existed {
+		s.dropped++
+	}
+}
+
+func encodeEntry(written time.Time, traceparent string, payload []byte) []byte {
+	ts := uint64(written.UnixNano())
+	if traceparent == "" || len(traceparent) > 255 {
+		b := make([]byte, 8+len(payload))
+		binary.BigEndian.PutUint64(b, ts)
+		copy(b[8:], payload)
+		return b
+	}
+	b := make([]byte, 0, 9+len(traceparent)+len(payload))
+	b = binary.BigEndian.AppendUint64(b, ts|TRACE_FLAG)
+	b = append(b, byte(len(traceparent)))
+	b = append(b, traceparent...)
+	return append(b, payload...)
+}
+
+// Entry of a value, the entries written before the traces are read too
+func decodeEntry(v []byte) (written time.Time, traceparent string, payload []byte, ok bool) {
+	if len(v) < 8 {
+		return
+	}
+	ts := binary.BigEndian.Uint64(v)
+	payload = v[8:]
+	if ts&TRACE_FLAG != 0 {
+		if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+			return
+		}
+		n := int(payload[0])
+		traceparent, payload = string(payload[1:1+n]), payload[1+n:]
+	}
+	return time.Unix(0, int64(ts&^TRACE_FLAG)), traceparent, payload, true
+}
+
+// Big endian keys keep the entries sorted by sequence
+func encodeSeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+func decodeSeq(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,240 @@
+package outbox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/tracing"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Delivery function recording the payloads, failing while down is set
+type recorder struct {
+	mu       sync.Mutex
+	down     bool
+	received []string
+}
+
+func (r *recorder) deliver(b []byte, attempt int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.down {
+		return errors.New("unreachable")
+	}
+	if string(b) == "refused" {
+		return Permanent(errors.New("refused"))
+	}
+	r.received = append(r.received, string(b))
+	return nil
+}
+
+func (r *recorder) setDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	r.mu.Unlock()
+}
+
+func (r *recorder) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.received...)
+}
+
+func open(t *testing.T, path string, maxEntries int) *Outbox {
+	o, err := Open(config.Outbox{Path: path, MaxEntries: maxEntries, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; !cond(); i++ {
+		if i == 500 {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Entries written while the sink is down survive a restart and are
+// delivered in order once it is back
+func TestStoreAndForward(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	r := &recorder{down: true}
+
+	o := open(t, path, 100)
+	s, err := o.Sink("test", Options{Backoff: 10 * time.Millisecond}, r.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"1", "2", "refused", "3"} {
+		if err := s.Put(context.Background(), []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "a failed attempt", func() bool { return s.Stats().Failed > 0 })
+	o.Close()
+
+	r.setDown(false)
+	o = open(t, path, 100)
+	defer o.Close()
+	s, err = o.Sink("test", Options{Backoff: 10 * time.Millisecond}, r.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return s.Pending() == 0 })
+
+	got := r.list()
+	if len(got) != 3 || got[0] != "1" || got[1] != "2" || got[2] != "3" {
+		t.Fatalf("expected 1, 2, 3 in order, got %v", got)
+	}
+	st := s.Stats()
+	if st.Delivered != 3 || st.Dropped != 1 || st.Cursor != 4 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	r := &recorder{down: true}
+	o := open(t, filepath.Join(t.TempDir(), "outbox.db"), 2)
+	defer o.Close()
+	s, err := o.Sink("test", Options{Backoff: time.Hour}, r.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"1", "2", "3"} {
+		if err := s.Put(context.Background(), []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := s.Stats(); st.Pending != 2 || st.Dropped != 1 {
+		t.Fatalf("expected the oldest entry to be dropped, got %+v", st)
+	}
+
+	r.setDown(false)
+	s.Wake()
+	waitFor(t, "the delivery", func() bool { return s.Pending() == 0 })
+	if got := r.list(); len(got) != 2 || got[0] != "2" || got[1] != "3" {
+		t.Fatalf("expected 2, 3, got %v", got)
+	}
+}
+
+// The entries past the max age are handed to Expired instead of delivered
+func TestExpired(t *testing.T) {
+	r := &recorder{down: true}
+	o, err := Open(config.Outbox{Path: filepath.Join(t.TempDir(), "outbox.db"), MaxEntries: 10, MaxAge: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	expiredch := make(chan string, 2)
+	s, err := o.Sink("test", Options{
+		Backoff: 100 * time.Millisecond,
+		Expired: func(b []byte) { expiredch <- string(b) },
+	}, r.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"1", "2"} {
+		if err := s.Put(context.Background(), []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"1", "2"} {
+		select {
+		case got := <-expiredch:
+			if got != want {
+				t.Fatalf("expired %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("entry %s not expired", want)
+		}
+	}
+	// Handed over before they are dropped
+	waitFor(t, "the expired entries to be dropped", func() bool { return s.Pending() == 0 })
+	if st := s.Stats(); st.Pending != 0 || st.Dropped != 2 || st.Delivered != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+// The delivery continues the trace of the producer, the entries written
+// before the traces are still read
+func TestTraceparent(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer otel.SetTracerProvider(prev)
+
+	r := &recorder{}
+	o := open(t, filepath.Join(t.TempDir(), "outbox.db"), 10)
+	defer o.Close()
+	s, err := o.Sink("test", Options{}, r.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, span := tracing.Start(context.Background(), "locate")
+	if err := s.Put(ctx, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+	waitFor(t, "the delivery", func() bool { return s.Pending() == 0 })
+
+	var delivery sdktrace.ReadOnlySpan
+	for _, sp := range rec.Ended() {
+		if sp.Name() == "outbox delivery" {
+			delivery = sp
+		}
+	}
+	if delivery == nil || delivery.Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Fatalf("delivery span %v, want a child of the producer", delivery)
+	}
+
+	now := time.Now()
+	old := make([]byte, 8)
+	binary.BigEndian.PutUint64(old, uint64(now.UnixNano()))
+	written, traceparent, payload, ok := decodeEntry(append(old, "2"...))
+	if !ok || !written.Equal(now) || traceparent != "" || string(payload) != "2" {
+		t.Fatalf("entry %s %q %q %v, want the old format read", written, traceparent, payload, ok)
+	}
+}
+
+// A malformed entry is dropped, the ones after it are still delivered
+func TestMalformed(t *testing.T) {
+	r := &recorder{down: true}
+	o := open(t, filepath.Join(t.TempDir(), "outbox.db"), 10)
+	defer o.Close()
+	s, err := o.Sink("test", Options{Backoff: 10 * time.Millisecond}, r.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"1", "2"} {
+		if err := s.Put(context.Background(), []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("sink:test")).Put(encodeSeq(1), []byte{1, 2, 3})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.setDown(false)
+	waitFor(t, "the delivery", func() bool { return s.Pending() == 0 })
+	if got := r.list(); len(got) != 1 || got[0] != "2" {
+		t.Fatalf("delivered %v, want [2]", got)
+	}
+	if st := s.Stats(); st.Dropped != 1 || st.Delivered != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
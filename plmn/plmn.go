@@ -0,0 +1,147 @@
+package plmn
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Registry of the mobile country codes, with the length of their network
+// codes, and of the main operators. A network missing from the registry
+// is still decoded, without a country or a brand
+var (
+	//go:embed countries.csv
+	countriesCSV []byte
+	//go:embed networks.csv
+	networksCSV []byte
+
+	countries = make(map[string]Country)
+	operators = make(map[PLMN]Operator)
+)
+
+// Public land mobile network, the network codes keep their leading zeros
+// as 01 and 001 are different networks
+type PLMN struct {
+	MCC string `json:"mcc"`
+	MNC string `json:"mnc"`
+}
+
+func (p PLMN) String() string {
+	return p.MCC + p.MNC
+}
+
+// Numeric codes, as expected by the cell databases
+func (p PLMN) Codes() (mcc, mnc int) {
+	mcc, _ = strconv.Atoi(p.MCC)
+	mnc, _ = strconv.Atoi(p.MNC)
+	return mcc, mnc
+}
+
+// Country of a mobile country code
+type Country struct {
+	MCC       string `json:"mcc"`
+	ISO       string `json:"iso"` // ISO 3166 alpha-2 code, lower case
+	Name      string `json:"name"`
+	MNCDigits int    `json:"mnc_digits"` // 0 when the country uses both lengths
+}
+
+// Operator of a network
+type Operator struct {
+	PLMN
+	Country Country `json:"country"`
+	Brand   string  `json:"brand"`
+	Name    string  `json:"name"`
+}
+
+func init() {
+	rows, err := readCSV(countriesCSV, 4)
+	if err != nil {
+		panic(fmt.Sprintf("plmn: countries.csv: %s", err))
+	}
+	for _, r := range rows {
+		digits, _ := strconv.Atoi(r[3])
+		countries[r[0]] = Country{MCC: r[0], ISO: r[1], Name: r[2], MNCDigits: digits}
+	}
+
+	rows, err = readCSV(networksCSV, 4)
+	if err != nil {
+		panic(fmt.Sprintf("plmn: networks.csv: %s", err))
+	}
+	for _, r := range rows {
+		p := PLMN{MCC: r[0], MNC: r[1]}
+		operators[p] = Operator{PLMN: p, Country: countries[r[0]], Brand: r[2], Name: r[3]}
+	}
+}
+
+// Rows of an embedded table, without the header
+func readCSV(b []byte, fields int) ([][]string, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = fields
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("empty table")
+	}
+	return rows[1:], nil
+}
+
+// Decode an mccmnc string like 22610 or 310410. The length of the network
+// code must be the one of the country when the registry knows it
+func Parse(s string) (PLMN, error) {
+	if len(s) < 5 || len(s) > 6 {
+		return PLMN{}, fmt.Errorf("mccmnc %q: want 5 or 6 digits", s)
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return PLMN{}, fmt.Errorf("mccmnc %q: want only digits", s)
+		}
+	}
+	p := PLMN{MCC: s[:3], MNC: s[3:]}
+	if c, ok := countries[p.MCC]; ok && c.MNCDigits != 0 && c.MNCDigits != len(p.MNC) {
+		return PLMN{}, fmt.Errorf("mccmnc %q: the network codes of %s have %d digits", s, c.Name, c.MNCDigits)
+	}
+	return p, nil
+}
+
+// Home network of a subscriber identity. The country gives the length of
+// the network code, the registry decides for the countries using both
+// lengths and 2 digits are assumed for the networks it does not know
+func FromIMSI(imsi string) (PLMN, error) {
+	if len(imsi) < 6 || len(imsi) > 15 {
+		return PLMN{}, fmt.Errorf("imsi %q: want 6 to 15 digits", imsi)
+	}
+	for _, c := range imsi {
+		if c < '0' || c > '9' {
+			return PLMN{}, fmt.Errorf("imsi %q: want only digits", imsi)
+		}
+	}
+	mcc := imsi[:3]
+	digits := countries[mcc].MNCDigits
+	if digits == 0 {
+		digits = 2
+		if _, ok := operators[PLMN{MCC: mcc, MNC: imsi[3:6]}]; ok {
+			digits = 3
+		}
+	}
+	return PLMN{MCC: mcc, MNC: imsi[3 : 3+digits]}, nil
+}
+
+// Country of a mobile country code
+func LookupCountry(mcc string) (Country, bool) {
+	c, ok := countries[mcc]
+	return c, ok
+}
+
+// Operator of a network, with the country alone when the network is not
+// in the registry
+func Lookup(p PLMN) (Operator, bool) {
+	if op, ok := operators[p]; ok {
+		return op, true
+	}
+	return Operator{PLMN: p, Country: countries[p.MCC]}, false
+}
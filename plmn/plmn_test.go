@@ -0,0 +1,80 @@
+package plmn
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PLMN
+		wantErr bool
+	}{
+		{"22610", PLMN{"226", "10"}, false},
+		{"22601", PLMN{"226", "01"}, false},
+		{"310410", PLMN{"310", "410"}, false},
+		{"310010", PLMN{"310", "010"}, false},
+		{"90170", PLMN{"901", "70"}, false},
+		{"99901", PLMN{"999", "01"}, false}, // not in the registry
+		{"31041", PLMN{}, true},             // us networks have 3 digits
+		{"226010", PLMN{}, true},
+		{"2261", PLMN{}, true},
+		{"", PLMN{}, true},
+		{"22a10", PLMN{}, true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Parse(%q) = %+v, %v", tt.in, got, err)
+		}
+	}
+
+	// Leading zeros are kept, the codes are numbers for the cell databases
+	p, _ := Parse("310010")
+	if mcc, mnc := p.Codes(); mcc != 310 || mnc != 10 || p.String() != "310010" {
+		t.Errorf("codes %d %d of %s", mcc, mnc, p)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	op, ok := Lookup(PLMN{"226", "10"})
+	if !ok || op.Brand != "Orange" || op.Country.ISO != "ro" {
+		t.Errorf("226 10: %+v", op)
+	}
+	op, ok = Lookup(PLMN{"226", "99"})
+	if ok || op.Country.ISO != "ro" || op.Brand != "" {
+		t.Errorf("226 99: %+v, want the country only", op)
+	}
+
+	// Every operator matches the length of the network codes of its country
+	for p := range operators {
+		c, ok := countries[p.MCC]
+		if !ok {
+			t.Errorf("%s: mcc not in the countries", p)
+			continue
+		}
+		if c.MNCDigits != 0 && c.MNCDigits != len(p.MNC) {
+			t.Errorf("%s: %s uses %d digit network codes", p, c.Name, c.MNCDigits)
+		}
+	}
+}
+
+func TestFromIMSI(t *testing.T) {
+	tests := []struct {
+		imsi    string
+		want    PLMN
+		wantErr bool
+	}{
+		{"226100123456789", PLMN{"226", "10"}, false},
+		{"310410123456789", PLMN{"310", "410"}, false},
+		{"405854123456789", PLMN{"405", "854"}, false}, // 3 digits in the registry
+		{"405990123456789", PLMN{"405", "99"}, false},  // mixed country, unknown network
+		{"999010123456789", PLMN{"999", "01"}, false},
+		{"22610", PLMN{}, true},
+		{"2261012345678x", PLMN{}, true},
+	}
+	for _, tt := range tests {
+		got, err := FromIMSI(tt.imsi)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("FromIMSI(%q) = %+v, %v", tt.imsi, got, err)
+		}
+	}
+}
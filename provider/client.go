@@ -0,0 +1,293 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mircearem/locater/config"
+)
+
+// Bytes of an error body kept in the error
+const MAX_ERROR_BODY = 512
+
+// Errors of the provider responses, matched with errors.Is
+var (
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrNotFound      = errors.New("not found")
+)
+
+// Response of a provider other than 2xx
+type StatusError struct {
+	Provider   string
+	Code       int
+	Message    string        // taken from the error body, if any
+	RetryAfter time.Duration // asked by the provider, 0 if not
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: unexpected status %d", e.Provider, e.Code)
+	}
+	return fmt.Sprintf("%s: unexpected status %d: %s", e.Provider, e.Code, e.Message)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden
+	case ErrQuotaExceeded:
+		return e.Code == http.StatusTooManyRequests || e.Code == http.StatusPaymentRequired
+	case ErrNotFound:
+		return e.Code == http.StatusNotFound
+	}
+	return false
+}
+
+// Client of the provider apis, shared by every locator. Every attempt has
+// a timeout, and the transient failures are retried with a jittered delay.
+// Every attempt is counted against the budget of the provider
+type Client struct {
+	cfg     config.HTTP
+	client  *http.Client
+	quota   *Quota // optional, no accounting without it
+	secrets *secrets
+}
+
+func NewClient(cfg config.HTTP, quota *Quota) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http proxy %q: %s", cfg.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if cfg.TLS != (config.TLS{}) {
+		tlsCfg, err := cfg.TLS.ClientConfig("http", true)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsCfg
+	}
+
+	// The calls can be recorded, or answered from a recording without
+	// network to reproduce an issue
+	s := &secrets{}
+	var rt http.RoundTripper = transport
+	switch {
+	case cfg.Record != "":
+		r, err := newRecorder(cfg.Record, transport, s)
+		if err != nil {
+			return nil, err
+		}
+		rt = r
+	case cfg.Replay != "":
+		r, err := newReplayer(cfg.Replay, s)
+		if err != nil {
+			return nil, err
+		}
+		rt = r
+	}
+	return &Client{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: rt,
+		},
+		quota:   quota,
+		secrets: s,
+	}, nil
+}
+
+// Api keys left out of the recordings, and of the requests matched
+// against a recording
+func (c *Client) SetSecrets(values []string) {
+	c.secrets.set(values)
+}
+
+// Budgets and counters of the calls, nil without accounting
+func (c *Client) Quota() *Quota {
+	return c.quota
+}
+
+// Get an url and decode the JSON response into out
+func (c *Client) Get(ctx context.Context, name, uri string, out any) error {
+	return c.do(ctx, name, http.MethodGet, uri, nil, out)
+}
+
+// Post a JSON body to an url and decode the JSON response into out
+func (c *Client) Post(ctx context.Context, name, uri string, body, out any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, name, http.MethodPost, uri, b, out)
+}
+
+func (c *Client) do(ctx context.Context, name, method, uri string, body []byte, out any) error {
+	backoff := c.cfg.Backoff
+	for attempt := 1; ; attempt++ {
+		if c.quota != nil {
+			if err := c.quota.Take(name); err != nil {
+				return err
+			}
+		}
+		err := c.attempt(ctx, name, method, uri, body, out)
+		if err == nil || attempt >= c.cfg.MaxAttempts || !c.retryable(ctx, err) {
+			return err
+		}
+
+		// A delay asked by the provider replaces the backoff
+		delay := jitter(backoff)
+		var se *StatusError
+		if errors.As(err, &se) && se.RetryAfter > 0 {
+			delay = se.RetryAfter
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		backoff = min(2*backoff, c.cfg.MaxBackoff)
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, name, method, uri string, body []byte, out any) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(withProvider(ctx, name), method, uri, r)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s response fail: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, MAX_ERROR_BODY))
+		return &StatusError{
+			Provider:   name,
+			Code:       res.StatusCode,
+			Message:    errorMessage(b),
+			RetryAfter: retryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("cannot parse %s response: %s", name, err)
+	}
+	return nil
+}
+
+// Transient network failures and server errors are worth another attempt,
+// a response that can not be parsed is not. Rate limiting is retried only
+// when the provider asks for a delay within the backoff limit
+func (c *Client) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return transient(err)
+	}
+	switch {
+	case se.Code >= 500, se.Code == http.StatusRequestTimeout:
+		return true
+	case se.Code == http.StatusTooManyRequests:
+		return se.RetryAfter > 0 && se.RetryAfter <= c.cfg.MaxBackoff
+	}
+	return false
+}
+
+// Delivery errors of the sinks worth another attempt: network errors,
+// timeouts, rate limiting and server errors. The other client errors are
+// final
+func Retryable(err error) bool {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.Code >= 500 || se.Code == http.StatusRequestTimeout || se.Code == http.StatusTooManyRequests
+}
+
+// Network failures that may not last: timeouts, connections reset or
+// refused, and temporary dns failures. A certificate that does not verify
+// or an unknown host will fail the same way again
+func transient(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Random delay between half and all of the backoff, so that the devices
+// failing together do not retry together
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Retry-After in seconds, the http date form is not used by the providers
+func retryAfter(v string) time.Duration {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// Message of an error body, in the shapes used by the providers
+func errorMessage(b []byte) string {
+	var body struct {
+		Message string          `json:"message"`
+		Error   json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return strings.TrimSpace(string(b))
+	}
+	if body.Message != "" {
+		return body.Message
+	}
+	// The error is either a string or an object with a message
+	var s string
+	if err := json.Unmarshal(body.Error, &s); err == nil {
+		return s
+	}
+	var obj struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body.Error, &obj); err == nil && obj.Message != "" {
+		return obj.Message
+	}
+	return strings.TrimSpace(string(b))
+}
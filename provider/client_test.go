@@ -0,0 +1,202 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+)
+
+func newTestClient(t *testing.T) *Client {
+	c, err := NewClient(config.HTTP{
+		Timeout:     time.Second,
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"ip":"1.2.3.4"}`))
+	}))
+	defer srv.Close()
+
+	var res struct {
+		IP string `json:"ip"`
+	}
+	if err := newTestClient(t).Get(context.Background(), "ipify", srv.URL, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.IP != "1.2.3.4" || calls.Load() != 3 {
+		t.Errorf("ip %q after %d calls, want 1.2.3.4 after 3", res.IP, calls.Load())
+	}
+}
+
+// A certificate that does not verify is not retried, a refused
+// connection is
+func TestNetworkErrors(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	c := newTestClient(t)
+	err := c.Get(context.Background(), "test", srv.URL, nil)
+	if err == nil || conns.Load() != 1 {
+		t.Errorf("error %v after %d connections, want the unknown authority once", err, conns.Load())
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	err = c.attempt(context.Background(), "test", http.MethodGet, "http://"+ln.Addr().String(), nil, nil)
+	if !c.retryable(context.Background(), err) {
+		t.Errorf("error %v not retried", err)
+	}
+	if c.retryable(context.Background(), &net.DNSError{Err: "no such host", Name: "nowhere.invalid", IsNotFound: true}) {
+		t.Error("unknown host retried")
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	tests := []struct {
+		code    int
+		body    string
+		want    error
+		message string
+	}{
+		{http.StatusUnauthorized, `{"error":{"code":401,"message":"API key not valid"}}`, ErrUnauthorized, "API key not valid"},
+		{http.StatusTooManyRequests, `{"message":"daily limit reached"}`, ErrQuotaExceeded, "daily limit reached"},
+		{http.StatusNotFound, `{"error":"cell not found"}`, ErrNotFound, "cell not found"},
+	}
+	for _, tt := range tests {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(tt.code)
+			w.Write([]byte(tt.body))
+		}))
+
+		err := newTestClient(t).Get(context.Background(), "test", srv.URL, nil)
+		srv.Close()
+		if !errors.Is(err, tt.want) {
+			t.Errorf("status %d: error %v is not %v", tt.code, err, tt.want)
+		}
+		var se *StatusError
+		if !errors.As(err, &se) || se.Message != tt.message {
+			t.Errorf("status %d: error %v, want the message %q", tt.code, err, tt.message)
+		}
+		if calls.Load() != 1 {
+			t.Errorf("status %d: %d calls, want no retry", tt.code, calls.Load())
+		}
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newTestClient(t).Get(ctx, "test", srv.URL, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, want the context error", err)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"lat":46.77,"lon":23.62}`))
+	}))
+	path := filepath.Join(t.TempDir(), "http.jsonl")
+	cfg := config.HTTP{Timeout: time.Second, MaxAttempts: 1, Record: path}
+
+	var want, got struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	}
+	rec, err := NewClient(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.SetSecrets([]string{"s3cr3t"})
+	if err := rec.Get(context.Background(), "ip2loc", srv.URL+"/s3cr3t/1.2.3.4?apiKey=other", &want); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cr3t") || strings.Contains(string(b), "other") {
+		t.Errorf("the recording holds the keys:\n%s", b)
+	}
+
+	// The server is gone, the answer comes from the recording
+	cfg.Record, cfg.Replay = "", path
+	replay, err := NewClient(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay.SetSecrets([]string{"s3cr3t"})
+	if err := replay.Get(context.Background(), "ip2loc", srv.URL+"/s3cr3t/1.2.3.4?apiKey=other", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("replayed %+v, want %+v", got, want)
+	}
+	if err := replay.Get(context.Background(), "ip2loc", srv.URL+"/s3cr3t/5.6.7.8", nil); err == nil {
+		t.Error("request not in the recording answered")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection reset"), true},
+		{&StatusError{Code: http.StatusServiceUnavailable}, true},
+		{&StatusError{Code: http.StatusTooManyRequests}, true},
+		{&StatusError{Code: http.StatusRequestTimeout}, true},
+		{&StatusError{Code: http.StatusBadRequest}, false},
+		{fmt.Errorf("wrapped: %w", &StatusError{Code: http.StatusNotFound}), false},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("Retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
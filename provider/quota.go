@@ -0,0 +1,234 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mircearem/locater/atomicfile"
+	"github.com/mircearem/locater/config"
+	"github.com/sirupsen/logrus"
+)
+
+// The counters are written at most this often, and when the quota is closed
+const QUOTA_SAVE_INTERVAL = time.Minute
+
+// Periods of the budgets, the providers reset their limits in utc
+const (
+	DAY_FORMAT   = "2006-01-02"
+	MONTH_FORMAT = "2006-01"
+)
+
+var ErrBudgetExhausted = errors.New("budget exhausted")
+
+// Calls allowed to a provider, 0 for no limit
+type Budget struct {
+	Daily   int
+	Monthly int
+}
+
+// Calls to a provider in the current day and month
+type Usage struct {
+	Provider      string `json:"provider"`
+	Day           string `json:"day"`
+	Daily         int    `json:"daily"`
+	DailyBudget   int    `json:"daily_budget,omitempty"`
+	Month         string `json:"month"`
+	Monthly       int    `json:"monthly"`
+	MonthlyBudget int    `json:"monthly_budget,omitempty"`
+	Near          bool   `json:"near"` // past the slowdown share of a budget
+	Exhausted     bool   `json:"exhausted"`
+}
+
+// Counters of the calls to every provider, kept in a file across
+// restarts so that a restart does not hand out the budgets again
+type Quota struct {
+	cfg config.Quota
+
+	mu      sync.Mutex
+	budgets map[string]Budget
+	usage   map[string]*Usage
+	dirty   bool
+	saved   time.Time
+	now     func() time.Time
+}
+
+// Load the counters of the previous runs, a missing file starts from zero
+func OpenQuota(cfg config.Quota) (*Quota, error) {
+	q := &Quota{
+		cfg:     cfg,
+		budgets: make(map[string]Budget),
+		usage:   make(map[string]*Usage),
+		now:     time.Now,
+	}
+	b, err := os.ReadFile(cfg.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the quota file: %s", err)
+	}
+	var usage []Usage
+	if err := json.Unmarshal(b, &usage); err != nil {
+		return nil, fmt.Errorf("cannot parse the quota file %s: %s", cfg.Path, err)
+	}
+	for i := range usage {
+		q.usage[usage[i].Provider] = &usage[i]
+	}
+	return q, nil
+}
+
+// Replace the budgets, by provider name
+func (q *Quota) SetBudgets(budgets map[string]Budget) {
+	q.mu.Lock()
+	q.budgets = budgets
+	q.mu.Unlock()
+}
+
+// Refuse a call to a provider that spent its budget
+func (q *Quota) Allow(name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.allow(name)
+}
+
+// Count a call to a provider
+func (q *Quota) Count(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.count(name)
+}
+
+// Count a call to a provider unless it spent its budget, concurrent calls
+// cannot go past the budget together
+func (q *Quota) Take(name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.allow(name); err != nil {
+		return err
+	}
+	q.count(name)
+	return nil
+}
+
+// Must be called with the lock held
+func (q *Quota) allow(name string) error {
+	u := q.current(name)
+	b := q.budgets[name]
+	if b.Daily > 0 && u.Daily >= b.Daily {
+		return fmt.Errorf("%s: daily budget of %d calls: %w", name, b.Daily, ErrBudgetExhausted)
+	}
+	if b.Monthly > 0 && u.Monthly >= b.Monthly {
+		return fmt.Errorf("%s: monthly budget of %d calls: %w", name, b.Monthly, ErrBudgetExhausted)
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (q *Quota) count(name string) {
+	u := q.current(name)
+	u.Daily++
+	u.Monthly++
+	q.dirty = true
+	if q.now().Sub(q.saved) >= QUOTA_SAVE_INTERVAL {
+		if err := q.save(); err != nil {
+			logrus.Println(err)
+		}
+	}
+}
+
+// Check if a provider is past the slowdown share of one of its budgets
+func (q *Quota) Near() bool {
+	for _, u := range q.Usage() {
+		if u.Near {
+			return true
+		}
+	}
+	return false
+}
+
+// Counters of every provider called or with a budget, by name
+func (q *Quota) Usage() []Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for name := range q.budgets {
+		q.current(name)
+	}
+
+	usage := make([]Usage, 0, len(q.usage))
+	for name, u := range q.usage {
+		b := q.budgets[name]
+		res := *u
+		res.DailyBudget = b.Daily
+		res.MonthlyBudget = b.Monthly
+		res.Near = q.near(u.Daily, b.Daily) || q.near(u.Monthly, b.Monthly)
+		res.Exhausted = (b.Daily > 0 && u.Daily >= b.Daily) || (b.Monthly > 0 && u.Monthly >= b.Monthly)
+		usage = append(usage, res)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Provider < usage[j].Provider })
+	return usage
+}
+
+// Write the counters not saved yet
+func (q *Quota) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.dirty {
+		return nil
+	}
+	return q.save()
+}
+
+func (q *Quota) near(used, budget int) bool {
+	return budget > 0 && float64(used) >= q.cfg.SlowdownAt*float64(budget)
+}
+
+// Counters of a provider, reset when the day or the month changed. Must
+// be called with the lock held
+func (q *Quota) current(name string) *Usage {
+	now := q.now().UTC()
+	day, month := now.Format(DAY_FORMAT), now.Format(MONTH_FORMAT)
+	u, ok := q.usage[name]
+	if !ok {
+		u = &Usage{Provider: name, Day: day, Month: month}
+		q.usage[name] = u
+	}
+	if u.Day != day {
+		u.Day, u.Daily = day, 0
+	}
+	if u.Month != month {
+		u.Month, u.Monthly = month, 0
+	}
+	return u
+}
+
+// Replace the file, a crash leaves either the old or the new counters.
+// Must be called with the lock held
+func (q *Quota) save() error {
+	usage := make([]Usage, 0, len(q.usage))
+	for _, u := range q.usage {
+		usage = append(usage, Usage{
+			Provider: u.Provider,
+			Day:      u.Day,
+			Daily:    u.Daily,
+			Month:    u.Month,
+			Monthly:  u.Monthly,
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Provider < usage[j].Provider })
+	b, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := atomicfile.WriteFile(q.cfg.Path, b); err != nil {
+		return fmt.Errorf("cannot save the quota: %s", err)
+	}
+	q.dirty = false
+	q.saved = q.now()
+	return nil
+}
@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+)
+
+func TestQuotaBudgets(t *testing.T) {
+	cfg := config.Quota{
+		Path:           filepath.Join(t.TempDir(), "quota.json"),
+		SlowdownAt:     0.5,
+		SlowdownFactor: 4,
+	}
+	q, err := OpenQuota(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 19, 23, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+	q.SetBudgets(map[string]Budget{"geoapify": {Daily: 4, Monthly: 100}})
+
+	for i := 0; i < 2; i++ {
+		if err := q.Allow("geoapify"); err != nil {
+			t.Fatal(err)
+		}
+		q.Count("geoapify")
+	}
+	if !q.Near() {
+		t.Error("half of the daily budget spent, want a slowdown")
+	}
+	q.Count("geoapify")
+	q.Count("geoapify")
+	if err := q.Allow("geoapify"); !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("error %v, want the budget exhausted", err)
+	}
+	// The providers without a budget are only counted
+	q.Count("ipify")
+	if err := q.Allow("ipify"); err != nil {
+		t.Error(err)
+	}
+
+	// The counters survive a restart
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	q, err = OpenQuota(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.now = func() time.Time { return now }
+	q.SetBudgets(map[string]Budget{"geoapify": {Daily: 4, Monthly: 100}})
+	if err := q.Allow("geoapify"); !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("error %v after a restart, want the budget exhausted", err)
+	}
+
+	// The next day renews the daily budget, not the monthly one
+	now = now.Add(2 * time.Hour)
+	if err := q.Allow("geoapify"); err != nil {
+		t.Error(err)
+	}
+	usage := q.Usage()
+	if len(usage) != 2 || usage[0].Provider != "geoapify" || usage[0].Daily != 0 || usage[0].Monthly != 4 {
+		t.Errorf("usage %+v, want 0 calls today and 4 this month for geoapify", usage)
+	}
+}
+
+// Concurrent calls never spend more than the budget
+func TestQuotaTake(t *testing.T) {
+	q, err := OpenQuota(config.Quota{Path: filepath.Join(t.TempDir(), "quota.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.SetBudgets(map[string]Budget{"geoapify": {Daily: 10}})
+
+	var wg sync.WaitGroup
+	var taken atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if q.Take("geoapify") == nil {
+				taken.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := taken.Load(); n != 10 {
+		t.Errorf("%d calls taken, want the budget of 10", n)
+	}
+	if u := q.Usage(); u[0].Daily != 10 {
+		t.Errorf("%d calls counted", u[0].Daily)
+	}
+}
@@ -0,0 +1,249 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replaces the api keys in the recorded requests
+const REDACTED = "REDACTED"
+
+// Query parameters holding credentials, whatever their value
+var secretParams = []string{"key", "apikey", "api_key", "token", "access_token"}
+
+// Request to a provider and its response, a line of the recording
+type Interaction struct {
+	Time         time.Time   `json:"time"`
+	Provider     string      `json:"provider,omitempty"`
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	RequestBody  string      `json:"request_body,omitempty"`
+	Status       int         `json:"status,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	ResponseBody string      `json:"response_body,omitempty"`
+	Error        string      `json:"error,omitempty"` // the request failed without a response
+	Duration     float64     `json:"duration_seconds"`
+}
+
+// Name of the provider of a request, set by the client
+type providerKey struct{}
+
+func withProvider(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, providerKey{}, name)
+}
+
+// Credentials removed from the recorded and the replayed requests
+type secrets struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+func (s *secrets) set(values []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = s.values[:0]
+	for _, v := range values {
+		if v != "" {
+			s.values = append(s.values, v)
+		}
+	}
+}
+
+// Replace the secret values anywhere in the string, and the credential
+// parameters of an url
+func (s *secrets) redact(v string) string {
+	s.mu.RLock()
+	for _, secret := range s.values {
+		v = strings.ReplaceAll(v, secret, REDACTED)
+	}
+	s.mu.RUnlock()
+
+	u, err := url.Parse(v)
+	if err != nil || u.RawQuery == "" {
+		return v
+	}
+	q := u.Query()
+	changed := false
+	for name := range q {
+		for _, p := range secretParams {
+			if strings.EqualFold(name, p) && q.Get(name) != REDACTED {
+				q.Set(name, REDACTED)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Writes every request and response going through it to a JSONL file
+type recorder struct {
+	next    http.RoundTripper
+	secrets *secrets
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newRecorder(path string, next http.RoundTripper, s *secrets) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the http recording: %s", err)
+	}
+	return &recorder{next: next, secrets: s, file: f}, nil
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	res, err := r.next.RoundTrip(req)
+
+	in := Interaction{
+		Time:        start.UTC(),
+		Method:      req.Method,
+		URL:         r.secrets.redact(req.URL.String()),
+		RequestBody: r.secrets.redact(string(reqBody)),
+		Duration:    time.Since(start).Seconds(),
+	}
+	in.Provider, _ = req.Context().Value(providerKey{}).(string)
+	if err != nil {
+		in.Error = err.Error()
+	} else {
+		resBody, err := readBody(&res.Body)
+		if err != nil {
+			return nil, err
+		}
+		in.Status = res.StatusCode
+		in.Header = res.Header
+		in.ResponseBody = string(resBody)
+	}
+	r.write(in)
+	return res, err
+}
+
+func (r *recorder) write(in Interaction) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.file.Write(append(b, '\n'))
+}
+
+// Read a body and put back a reader of the same bytes
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+	*body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// Answers the requests with the recorded responses, without network. The
+// responses to the same request are served in the recorded order, the
+// last one is repeated when they run out
+type replayer struct {
+	secrets *secrets
+
+	mu      sync.Mutex
+	answers map[string][]Interaction
+	served  map[string]int
+}
+
+func newReplayer(path string, s *secrets) (*replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the http recording: %s", err)
+	}
+	defer f.Close()
+
+	r := &replayer{
+		secrets: s,
+		answers: make(map[string][]Interaction),
+		served:  make(map[string]int),
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var in Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &in); err != nil {
+			return nil, fmt.Errorf("cannot parse line %d of the http recording %s: %s", n, path, err)
+		}
+		key := replayKey(in.Method, in.URL, in.RequestBody)
+		r.answers[key] = append(r.answers[key], in)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read the http recording %s: %s", path, err)
+	}
+	return r, nil
+}
+
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	u := r.secrets.redact(req.URL.String())
+	key := replayKey(req.Method, u, r.secrets.redact(string(reqBody)))
+
+	r.mu.Lock()
+	answers := r.answers[key]
+	i := r.served[key]
+	if i < len(answers)-1 {
+		r.served[key]++
+	}
+	r.mu.Unlock()
+	if len(answers) == 0 {
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, u)
+	}
+
+	in := answers[i]
+	if in.Error != "" {
+		return nil, errors.New(in.Error)
+	}
+	header := in.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+		StatusCode:    in.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(in.ResponseBody)),
+		ContentLength: int64(len(in.ResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+func replayKey(method, u, body string) string {
+	return method + " " + u + "\n" + body
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mircearem/locater/api"
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/gpsd"
+	"github.com/mircearem/locater/metrics"
+	"github.com/mircearem/locater/modbus"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/mqtt"
+	"github.com/mircearem/locater/nmea"
+	"github.com/mircearem/locater/outbox"
+	"github.com/mircearem/locater/provider"
+	"github.com/mircearem/locater/sparkplug"
+	"github.com/mircearem/locater/traccar"
+	"github.com/mircearem/locater/tracing"
+	"github.com/mircearem/locater/webhook"
+	"github.com/sirupsen/logrus"
+)
+
+// Run the geolocation server and its api
+func serve(args []string) error {
+	// Load the configuration from the file, the environment and the flags
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	if cfg.Path != "" {
+		logrus.Printf("Configuration loaded from %s", cfg.Path)
+	}
+
+	// Trace the locate cycles and the deliveries
+	shutdown, err := tracing.Setup(cfg.Tracing, cfg.DeviceID)
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+
+	// Outbound messages are queued on disk until they are delivered
+	box, err := outbox.Open(cfg.Outbox)
+	if err != nil {
+		return err
+	}
+	defer box.Close()
+
+	// Calls to the providers are counted against their budgets
+	quota, err := provider.OpenQuota(cfg.Quota)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := quota.Close(); err != nil {
+			logrus.Println(err)
+		}
+	}()
+
+	ctx := context.Background()
+	s, err := geo.NewServer(ctx, cfg, box, quota)
+	if err != nil {
+		return err
+	}
+
+	// The first of the servers to fail stops the daemon, the error is
+	// returned so that the deferred closes still save the state
+	errch := make(chan error, 1)
+	run := func(f func() error) {
+		go func() {
+			if err := f(); err != nil {
+				select {
+				case errch <- err:
+				default:
+				}
+			}
+		}()
+	}
+
+	// Export the backlog of the sinks, the provider budgets and the modem
+	// signal on /metrics
+	if err := metrics.RegisterOutbox(box); err != nil {
+		return err
+	}
+	if err := metrics.RegisterQuota(quota); err != nil {
+		return err
+	}
+	if m := s.Modem(); m != nil {
+		if err := metrics.RegisterModem(m); err != nil {
+			return err
+		}
+	}
+
+	// Publish the locations and the modem snapshots to the broker
+	if cfg.MQTT.Broker != "" {
+		p, err := mqtt.NewPublisher(cfg.MQTT, cfg.DeviceID, s.Modem(), box)
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		s.OnReload("mqtt", func(cfg *config.Config) error { return p.Set(cfg.MQTT) })
+		go p.Run(s.Subscribe())
+	}
+
+	// Report to the SCADA as a Sparkplug B edge node
+	if cfg.Sparkplug.Enabled {
+		n := sparkplug.NewNode(cfg.MQTT, cfg.Sparkplug, cfg.DeviceID, s.Modem())
+		defer n.Close()
+		go n.Run(s.Subscribe())
+	}
+
+	// Serve the location to the PLC over modbus
+	if cfg.Modbus.ListenAddr != "" {
+		mb := modbus.NewServer(cfg.Modbus, s, s.Modem())
+		defer mb.Close()
+		run(mb.Run)
+	}
+
+	// Serve the location to the gpsd clients
+	if cfg.Gpsd.ListenAddr != "" {
+		g := gpsd.NewServer(cfg.Gpsd, s)
+		defer g.Close()
+		locch := s.Subscribe()
+		run(func() error { return g.Run(locch) })
+	}
+
+	// Stream NMEA sentences to the legacy consumers
+	if cfg.NMEA.Output != "" {
+		n := nmea.NewSink(cfg.NMEA, s)
+		defer n.Close()
+		run(n.Run)
+	}
+
+	// Report the fixes to the Traccar server
+	if cfg.Traccar.URL != "" {
+		t, err := traccar.NewClient(cfg.Traccar, cfg.DeviceID, s.Modem(), box)
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+		go t.Run(s.Subscribe())
+	}
+
+	// Post the location events to the webhooks
+	var hooks *webhook.Dispatcher
+	if len(cfg.Webhooks.Endpoints) > 0 {
+		hooks, err = webhook.NewDispatcher(cfg.Webhooks, cfg.DeviceID, box)
+		if err != nil {
+			return err
+		}
+		defer hooks.Close()
+		s.OnReload("webhooks", func(cfg *config.Config) error { return hooks.Set(cfg.Webhooks) })
+		var swapch <-chan modem.SimSwap
+		if m := s.Modem(); m != nil {
+			swapch = m.SubscribeSimSwaps()
+		}
+		go hooks.Run(s.Subscribe(), swapch)
+	}
+
+	a := api.NewServer(cfg.API.ListenAddr, s, hooks, box)
+	run(a.Run)
+
+	// Reload the configuration on SIGHUP
+	sighupch := make(chan os.Signal, 1)
+	signal.Notify(sighupch, syscall.SIGHUP)
+	go func() {
+		for range sighupch {
+			if _, err := s.Reload(); err != nil {
+				logrus.Println(err)
+			}
+		}
+	}()
+
+	// Stop on SIGINT and SIGTERM the same way
+	stopch := make(chan os.Signal, 1)
+	signal.Notify(stopch, os.Interrupt, syscall.SIGTERM)
+
+	run(s.Start)
+	select {
+	case err = <-errch:
+	case sig := <-stopch:
+		logrus.Printf("Received %s, stopping", sig)
+	}
+	s.Stop()
+	return err
+}
@@ -0,0 +1,313 @@
+package sparkplug
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/mqtt"
+	"github.com/sirupsen/logrus"
+)
+
+const NAMESPACE = "spBv1.0"
+
+// Node metrics
+const (
+	METRIC_BDSEQ   = "bdSeq"
+	METRIC_REBIRTH = "Node Control/Rebirth"
+)
+
+// Device metrics
+const (
+	METRIC_LATITUDE  = "Location/Latitude"
+	METRIC_LONGITUDE = "Location/Longitude"
+	METRIC_ACCURACY  = "Location/Accuracy"
+	METRIC_CITY      = "Location/City"
+	METRIC_SOURCE    = "Location/Source"
+	METRIC_OPERATOR  = "Modem/Operator"
+	METRIC_RSSI      = "Modem/RSSI"
+)
+
+// Time to wait before connecting again after a failure
+var reconnectInterval = 5 * time.Second
+
+// Sparkplug B edge node with a single device reporting the location and
+// the modem status. The node death certificate is registered as the last
+// will of every session
+type Node struct {
+	mqtt   config.MQTT
+	cfg    config.Sparkplug
+	device string
+	m      *modem.Modem // optional, the modem metrics are null without it
+	client paho.Client
+
+	bdSeq uint64 // birth/death sequence, one per session
+	seq   uint64 // message sequence, 0 for the node birth
+
+	// Current values of the device metrics, and the ones last published
+	values    map[string]Metric
+	published map[string]any
+
+	lostch    chan error
+	rebirthch chan struct{}
+	quitch    chan struct{}
+	donech    chan struct{}
+}
+
+func NewNode(mqttCfg config.MQTT, cfg config.Sparkplug, device string, m *modem.Modem) *Node {
+	n := &Node{
+		mqtt:      mqttCfg,
+		cfg:       cfg,
+		device:    device,
+		m:         m,
+		values:    make(map[string]Metric),
+		published: make(map[string]any),
+		lostch:    make(chan error, 1),
+		rebirthch: make(chan struct{}, 1),
+		quitch:    make(chan struct{}),
+		donech:    make(chan struct{}),
+	}
+	// The device birth must list every metric, null until known
+	for _, metric := range deviceMetrics(nil, nil) {
+		n.values[metric.Name] = metric
+	}
+	return n
+}
+
+// Publish the births, then the changes of the locations received on the
+// channel and of the modem status, until the node is closed
+func (n *Node) Run(locch <-chan geo.Geolocation) {
+	defer close(n.donech)
+	ticker := time.NewTicker(n.mqtt.ModemInterval)
+	defer ticker.Stop()
+
+	// Connect right away, then after every lost connection
+	retry := time.After(0)
+	for {
+		select {
+		case <-retry:
+			retry = nil
+			if err := n.connect(); err != nil {
+				logrus.Printf("Sparkplug connection failed: %s", err)
+				retry = time.After(reconnectInterval)
+			}
+		case err := <-n.lostch:
+			logrus.Printf("Sparkplug connection lost: %s", err)
+			retry = time.After(reconnectInterval)
+		case <-n.rebirthch:
+			if n.connected() {
+				n.births()
+			}
+		case loc := <-locch:
+			n.update(deviceMetrics(&loc, nil))
+		case <-ticker.C:
+			if n.m == nil {
+				continue
+			}
+			st := n.m.Status()
+			n.update(deviceMetrics(nil, &st))
+		case <-n.quitch:
+			// The broker does not send the last will on a clean disconnect
+			if n.connected() {
+				n.client.Publish(n.topic("NDEATH", false), 0, false, n.death()).WaitTimeout(mqtt.PUBLISH_TIMEOUT)
+				n.client.Disconnect(250)
+			}
+			return
+		}
+	}
+}
+
+// Publish the node death and disconnect
+func (n *Node) Close() {
+	close(n.quitch)
+	<-n.donech
+}
+
+// Start a new session, with the next birth/death sequence in the will
+func (n *Node) connect() error {
+	if n.client != nil {
+		n.client.Disconnect(0)
+		n.bdSeq++
+	}
+
+	opts, err := mqtt.ClientOptions(n.mqtt, n.nodeID())
+	if err != nil {
+		return err
+	}
+	opts.SetAutoReconnect(false).
+		SetCleanSession(true).
+		SetBinaryWill(n.topic("NDEATH", false), n.death(), 1, false).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			select {
+			case n.lostch <- err:
+			default:
+			}
+		})
+	n.client = paho.NewClient(opts)
+
+	t := n.client.Connect()
+	if !t.WaitTimeout(mqtt.PUBLISH_TIMEOUT) {
+		return fmt.Errorf("connect timeout")
+	}
+	if err := t.Error(); err != nil {
+		return err
+	}
+
+	// Rebirth requests from the primary application
+	t = n.client.Subscribe(n.topic("NCMD", false), 1, n.handleCommand)
+	if t.WaitTimeout(mqtt.PUBLISH_TIMEOUT) && t.Error() != nil {
+		return t.Error()
+	}
+	logrus.Printf("Sparkplug edge node %s/%s online", n.cfg.GroupID, n.nodeID())
+
+	n.births()
+	return nil
+}
+
+func (n *Node) connected() bool {
+	return n.client != nil && n.client.IsConnectionOpen()
+}
+
+// Publish the node and device births, with all the current values
+func (n *Node) births() {
+	n.seq = 0
+	now := timestamp()
+
+	node := &Payload{
+		Timestamp: now,
+		Seq:       n.seq,
+		Metrics: []Metric{
+			{Name: METRIC_BDSEQ, Timestamp: now, Type: Int64, Value: int64(n.bdSeq)},
+			{Name: METRIC_REBIRTH, Timestamp: now, Type: Boolean, Value: false},
+		},
+	}
+	n.publish(n.topic("NBIRTH", false), node)
+
+	device := &Payload{Timestamp: now}
+	for _, metric := range deviceMetrics(nil, nil) {
+		current := n.values[metric.Name]
+		current.Timestamp = now
+		device.Metrics = append(device.Metrics, current)
+		n.published[metric.Name] = current.Value
+	}
+	device.Seq = n.nextSeq()
+	n.publish(n.topic("DBIRTH", true), device)
+}
+
+// Record the new values and publish the ones that changed
+func (n *Node) update(metrics []Metric) {
+	now := timestamp()
+	changed := make([]Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.Value == nil {
+			continue
+		}
+		metric.Timestamp = now
+		n.values[metric.Name] = metric
+		if n.published[metric.Name] != metric.Value {
+			changed = append(changed, metric)
+		}
+	}
+	if len(changed) == 0 || !n.connected() {
+		return
+	}
+
+	for _, metric := range changed {
+		n.published[metric.Name] = metric.Value
+	}
+	n.publish(n.topic("DDATA", true), &Payload{
+		Timestamp: now,
+		Seq:       n.nextSeq(),
+		Metrics:   changed,
+	})
+}
+
+func (n *Node) publish(topic string, p *Payload) {
+	t := n.client.Publish(topic, 0, false, p.Marshal())
+	if !t.WaitTimeout(mqtt.PUBLISH_TIMEOUT) {
+		logrus.Printf("Sparkplug publish to %s timed out", topic)
+	} else if err := t.Error(); err != nil {
+		logrus.Printf("Sparkplug publish to %s failed: %s", topic, err)
+	}
+}
+
+// Node commands, only the rebirth request is supported
+func (n *Node) handleCommand(_ paho.Client, msg paho.Message) {
+	p, err := Unmarshal(msg.Payload())
+	if err != nil {
+		logrus.Printf("Sparkplug command decode failed: %s", err)
+		return
+	}
+	for _, metric := range p.Metrics {
+		if metric.Name == METRIC_REBIRTH && metric.Value == true {
+			select {
+			case n.rebirthch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Death certificate, matching the birth of the session
+func (n *Node) death() []byte {
+	p := &Payload{
+		Timestamp: timestamp(),
+		Metrics: []Metric{
+			{Name: METRIC_BDSEQ, Type: Int64, Value: int64(n.bdSeq)},
+		},
+	}
+	return p.Marshal()
+}
+
+// Sequence numbers wrap after 255
+func (n *Node) nextSeq() uint64 {
+	n.seq = (n.seq + 1) % 256
+	return n.seq
+}
+
+func (n *Node) nodeID() string {
+	return strings.ReplaceAll(n.cfg.EdgeNodeID, "{device}", n.device)
+}
+
+// spBv1.0/<group>/<type>/<edge node>[/<device>]
+func (n *Node) topic(messageType string, device bool) string {
+	topic := fmt.Sprintf("%s/%s/%s/%s", NAMESPACE, n.cfg.GroupID, messageType, n.nodeID())
+	if device {
+		topic += "/" + n.cfg.DeviceID
+	}
+	return topic
+}
+
+// Device metrics for a location and a modem status, the values of the
+// missing ones are nil
+func deviceMetrics(loc *geo.Geolocation, st *modem.Status) []Metric {
+	metrics := []Metric{
+		{Name: METRIC_LATITUDE, Type: Double},
+		{Name: METRIC_LONGITUDE, Type: Double},
+		{Name: METRIC_ACCURACY, Type: Double},
+		{Name: METRIC_CITY, Type: String},
+		{Name: METRIC_SOURCE, Type: String},
+		{Name: METRIC_OPERATOR, Type: String},
+		{Name: METRIC_RSSI, Type: Int32},
+	}
+	if loc != nil {
+		metrics[0].Value = loc.Lat
+		metrics[1].Value = loc.Lon
+		metrics[2].Value = loc.Accuracy
+		metrics[3].Value = loc.City
+		metrics[4].Value = loc.Source
+	}
+	if st != nil {
+		metrics[5].Value = st.Network.Operator
+		metrics[6].Value = int32(st.Network.SignalRssi)
+	}
+	return metrics
+}
+
+func timestamp() uint64 {
+	return uint64(time.Now().UnixMilli())
+}
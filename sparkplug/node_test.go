@@ -0,0 +1,108 @@
+package sparkplug
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	in := &Payload{
+		Timestamp: 1700000000000,
+		Seq:       42,
+		Metrics: []Metric{
+			{Name: METRIC_LATITUDE, Type: Double, Value: 46.7712},
+			{Name: METRIC_RSSI, Type: Int32, Value: int32(-71)},
+			{Name: METRIC_BDSEQ, Type: Int64, Value: int64(3)},
+			{Name: METRIC_SOURCE, Type: String, Value: "cell"},
+			{Name: METRIC_REBIRTH, Type: Boolean, Value: true},
+			{Name: METRIC_CITY, Type: String},
+		},
+	}
+	out, err := Unmarshal(in.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Timestamp != in.Timestamp || out.Seq != in.Seq || len(out.Metrics) != len(in.Metrics) {
+		t.Fatalf("unexpected payload: %+v", out)
+	}
+	for i := range in.Metrics {
+		if out.Metrics[i] != in.Metrics[i] {
+			t.Fatalf("expected %+v, got %+v", in.Metrics[i], out.Metrics[i])
+		}
+	}
+}
+
+// The node announces itself and the device, then only sends the metrics
+// that changed
+func TestNodeBirthAndData(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	server.AddHook(new(auth.AllowHook), nil)
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+
+	received := make(chan packets.Packet, 8)
+	server.Subscribe(NAMESPACE+"/#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		received <- pk
+	})
+
+	cfg := config.Default()
+	cfg.MQTT.Broker = "tcp://" + addr
+	n := NewNode(cfg.MQTT, cfg.Sparkplug, "pump-4", nil)
+	locch := make(chan geo.Geolocation)
+	go n.Run(locch)
+	defer n.Close()
+
+	next := func() (string, *Payload) {
+		select {
+		case pk := <-received:
+			p, err := Unmarshal(pk.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pk.TopicName, p
+		case <-time.After(5 * time.Second):
+			t.Fatal("no sparkplug message received")
+		}
+		return "", nil
+	}
+
+	topic, p := next()
+	if topic != "spBv1.0/locater/NBIRTH/pump-4" || p.Seq != 0 {
+		t.Fatalf("expected the node birth, got %s seq %d", topic, p.Seq)
+	}
+	topic, p = next()
+	if topic != "spBv1.0/locater/DBIRTH/pump-4/location" || p.Seq != 1 || len(p.Metrics) != 7 {
+		t.Fatalf("expected the device birth, got %s seq %d with %d metrics", topic, p.Seq, len(p.Metrics))
+	}
+
+	locch <- geo.Geolocation{Lat: 46.77, Lon: 23.59, City: "Cluj-Napoca", Source: geo.SourceCell}
+	topic, p = next()
+	if topic != "spBv1.0/locater/DDATA/pump-4/location" || p.Seq != 2 || len(p.Metrics) != 5 {
+		t.Fatalf("expected the location data, got %s seq %d with %d metrics", topic, p.Seq, len(p.Metrics))
+	}
+
+	// Only the accuracy changes
+	locch <- geo.Geolocation{Lat: 46.77, Lon: 23.59, Accuracy: 800, City: "Cluj-Napoca", Source: geo.SourceCell}
+	_, p = next()
+	if len(p.Metrics) != 1 || p.Metrics[0].Name != METRIC_ACCURACY {
+		t.Fatalf("expected only the accuracy, got %+v", p.Metrics)
+	}
+}
@@ -0,0 +1,199 @@
+package sparkplug
+
+import (
+	"errors"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B metric data types
+type DataType uint32
+
+const (
+	Int32   DataType = 3
+	Int64   DataType = 4
+	UInt64  DataType = 8
+	Float   DataType = 9
+	Double  DataType = 10
+	Boolean DataType = 11
+	String  DataType = 12
+)
+
+// Field numbers of the Sparkplug B protobuf schema
+const (
+	payloadTimestamp = 1
+	payloadMetrics   = 2
+	payloadSeq       = 3
+
+	metricName        = 1
+	metricTimestamp   = 3
+	metricDatatype    = 4
+	metricIsNull      = 7
+	metricIntValue    = 10
+	metricLongValue   = 11
+	metricFloatValue  = 12
+	metricDoubleValue = 13
+	metricBoolValue   = 14
+	metricStringValue = 15
+)
+
+type Metric struct {
+	Name      string
+	Timestamp uint64 // ms since the epoch
+	Type      DataType
+	Value     any // int32, int64, uint64, float32, float64, bool or string, nil for a null metric
+}
+
+type Payload struct {
+	Timestamp uint64 // ms since the epoch
+	Seq       uint64
+	Metrics   []Metric
+}
+
+// Encode the payload in the Sparkplug B protobuf format
+func (p *Payload) Marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, payloadTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.Timestamp)
+	for _, m := range p.Metrics {
+		b = protowire.AppendTag(b, payloadMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.marshal())
+	}
+	b = protowire.AppendTag(b, payloadSeq, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.Seq)
+	return b
+}
+
+func (m *Metric) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, metricName, protowire.BytesType)
+	b = protowire.AppendString(b, m.Name)
+	if m.Timestamp != 0 {
+		b = protowire.AppendTag(b, metricTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Timestamp)
+	}
+	b = protowire.AppendTag(b, metricDatatype, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Type))
+
+	switch v := m.Value.(type) {
+	case nil:
+		b = protowire.AppendTag(b, metricIsNull, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	case int32:
+		// Signed values are sent as their two's complement, in 32 bits
+		b = protowire.AppendTag(b, metricIntValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(uint32(v)))
+	case int64:
+		b = protowire.AppendTag(b, metricLongValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case uint64:
+		b = protowire.AppendTag(b, metricLongValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case float32:
+		b = protowire.AppendTag(b, metricFloatValue, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(v))
+	case float64:
+		b = protowire.AppendTag(b, metricDoubleValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = protowire.AppendTag(b, metricBoolValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, metricStringValue, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+// Decode a Sparkplug B payload, fields that are not used by locater
+// are skipped
+func Unmarshal(b []byte) (*Payload, error) {
+	p := &Payload{}
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+		switch num {
+		case payloadTimestamp:
+			p.Timestamp = v
+		case payloadSeq:
+			p.Seq = v
+		case payloadMetrics:
+			m, err := unmarshalMetric(raw)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, m)
+		}
+		return nil
+	})
+	return p, err
+}
+
+func unmarshalMetric(b []byte) (Metric, error) {
+	m := Metric{}
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+		switch num {
+		case metricName:
+			m.Name = string(raw)
+		case metricTimestamp:
+			m.Timestamp = v
+		case metricDatatype:
+			m.Type = DataType(v)
+		case metricIntValue:
+			m.Value = int32(uint32(v))
+		case metricLongValue:
+			if m.Type == Int64 {
+				m.Value = int64(v)
+			} else {
+				m.Value = v
+			}
+		case metricFloatValue:
+			m.Value = math.Float32frombits(uint32(v))
+		case metricDoubleValue:
+			m.Value = math.Float64frombits(v)
+		case metricBoolValue:
+			m.Value = protowire.DecodeBool(v)
+		case metricStringValue:
+			m.Value = string(raw)
+		}
+		return nil
+	})
+	return m, err
+}
+
+// Call fn for every field of a message, with the numeric value for the
+// scalar types and the content for the length delimited ones
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.New("sparkplug: invalid tag")
+		}
+		b = b[n:]
+
+		var v uint64
+		var raw []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			raw, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errors.New("sparkplug: invalid field value")
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
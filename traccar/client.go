@@ -0,0 +1,155 @@
+package traccar
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/outbox"
+	"github.com/mircearem/locater/provider"
+	"github.com/sirupsen/logrus"
+)
+
+// Delays between the attempts to send a fix
+const (
+	RETRY_BACKOFF     = 5 * time.Second
+	RETRY_MAX_BACKOFF = 5 * time.Minute
+)
+
+// Reports the fixes to a Traccar server with the OsmAnd protocol. The
+// fixes go through the outbox, the ones produced while the server is
+// unreachable are sent in order once it is back
+type Client struct {
+	cfg    config.Traccar
+	device string
+	m      *modem.Modem // optional, no operator and rssi attributes without it
+	client *http.Client
+	sink   *outbox.Sink
+	quitch chan struct{}
+}
+
+func NewClient(cfg config.Traccar, device string, m *modem.Modem, box *outbox.Outbox) (*Client, error) {
+	c := &Client{
+		cfg:    cfg,
+		device: device,
+		m:      m,
+		client: &http.Client{Timeout: cfg.Timeout},
+		quitch: make(chan struct{}),
+	}
+	sink, err := box.Sink("traccar", outbox.Options{
+		MaxEntries: cfg.BufferSize,
+		Backoff:    RETRY_BACKOFF,
+		MaxBackoff: RETRY_MAX_BACKOFF,
+	}, c.deliver)
+	if err != nil {
+		return nil, err
+	}
+	c.sink = sink
+	return c, nil
+}
+
+// Write the locations received on the channel to the outbox until the
+// client is closed
+func (c *Client) Run(locch <-chan geo.Geolocation) {
+	for {
+		select {
+		case loc := <-locch:
+			if err := c.sink.Put(loc.TraceContext(), []byte(c.position(loc).Encode())); err != nil {
+				logrus.Println(err)
+			}
+		case <-c.quitch:
+			return
+		}
+	}
+}
+
+func (c *Client) Close() {
+	close(c.quitch)
+}
+
+// Number of fixes waiting for the server
+func (c *Client) Buffered() int {
+	return c.sink.Pending()
+}
+
+// OsmAnd parameters of a fix, the modem status is the one at the time of
+// the fix. The locater sources do not measure speed, a fixed asset
+// reports 0
+func (c *Client) position(loc geo.Geolocation) url.Values {
+	imei := ""
+	var st *modem.Status
+	if c.m != nil {
+		status := c.m.Status()
+		st = &status
+		imei = status.Info.Imei
+	}
+
+	ts := loc.FixTime()
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	v := url.Values{}
+	v.Set("id", strings.NewReplacer("{device}", c.device, "{imei}", imei).Replace(c.cfg.ID))
+	v.Set("lat", strconv.FormatFloat(loc.Lat, 'f', -1, 64))
+	v.Set("lon", strconv.FormatFloat(loc.Lon, 'f', -1, 64))
+	v.Set("timestamp", strconv.FormatInt(ts.Unix(), 10))
+	v.Set("speed", "0")
+	if loc.Accuracy > 0 {
+		v.Set("accuracy", strconv.FormatFloat(loc.Accuracy, 'f', -1, 64))
+	}
+	// The other parameters are kept by Traccar as attributes
+	if loc.Source != "" {
+		v.Set("source", loc.Source)
+	}
+	if st != nil {
+		if st.Network.Operator != "" {
+			v.Set("operator", st.Network.Operator)
+		}
+		v.Set("rssi", strconv.Itoa(st.Network.SignalRssi))
+	}
+	return v
+}
+
+// Send a fix of the outbox, a fix the server refuses for good does not
+// hold the next ones back
+func (c *Client) deliver(b []byte, attempt int) error {
+	v, err := url.ParseQuery(string(b))
+	if err != nil {
+		return outbox.Permanent(err)
+	}
+	err = c.send(v)
+	if err != nil && !provider.Retryable(err) {
+		return outbox.Permanent(fmt.Errorf("traccar rejected the fix of %s: %s", v.Get("timestamp"), err))
+	}
+	if err != nil && attempt == 1 {
+		logrus.Printf("Traccar report failed, keeping it in the outbox: %s", err)
+	}
+	return err
+}
+
+// The OsmAnd protocol takes the parameters in the query string
+func (c *Client) send(v url.Values) error {
+	u, err := url.Parse(c.cfg.URL)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = v.Encode()
+
+	resp, err := c.client.Post(u.String(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &provider.StatusError{Provider: "traccar", Code: resp.StatusCode}
+	}
+	return nil
+}
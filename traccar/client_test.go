@@ -0,0 +1,84 @@
+package traccar
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/outbox"
+)
+
+func TestStoreAndForward(t *testing.T) {
+	cfg := config.Default().Outbox
+	cfg.Path = filepath.Join(t.TempDir(), "outbox.db")
+	box, err := outbox.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.Close()
+
+	var mu sync.Mutex
+	down := true
+	received := make([]url.Values, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		received = append(received, r.URL.Query())
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(config.Traccar{URL: srv.URL, ID: "{device}", Timeout: time.Second, BufferSize: 10}, "pump-4", nil, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locch := make(chan geo.Geolocation)
+	go c.Run(locch)
+	defer c.Close()
+
+	fix := time.Date(2024, 3, 9, 12, 35, 19, 0, time.UTC)
+	next := fix.Add(time.Minute)
+	locch <- geo.Geolocation{Lat: 46.7712, Lon: 23.6236, Accuracy: 1200, Source: geo.SourceCell, Timestamp: &fix}
+	locch <- geo.Geolocation{Lat: 46.5678, Lon: 23.7812, Source: geo.SourceIP, Timestamp: &next}
+	for i := 0; c.Buffered() != 2; i++ {
+		if i == 500 {
+			t.Fatalf("expected 2 buffered fixes, got %d", c.Buffered())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	c.sink.Wake()
+	for i := 0; c.Buffered() != 0; i++ {
+		if i == 500 {
+			t.Fatal("buffered fixes not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("expected 2 fixes, got %d", len(received))
+	}
+	first := received[0]
+	if first.Get("id") != "pump-4" || first.Get("lat") != "46.7712" || first.Get("timestamp") != "1709987719" ||
+		first.Get("accuracy") != "1200" || first.Get("source") != "cell" || first.Get("speed") != "0" {
+		t.Fatalf("unexpected first fix %v", first)
+	}
+	// Sent in order, without an accuracy when it is unknown
+	if second := received[1]; second.Get("lon") != "23.7812" || second.Has("accuracy") {
+		t.Fatalf("unexpected second fix %v", second)
+	}
+}
@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/mircearem/locater/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer and of the traced service
+const SERVICE_NAME = "locater"
+
+// Exporters of the traces
+const (
+	EXPORTER_OTLP   = "otlp"
+	EXPORTER_STDOUT = "stdout"
+	EXPORTER_FILE   = "file"
+)
+
+// Attributes of the spans
+const (
+	ATTR_PROVIDER      = attribute.Key("locater.provider")
+	ATTR_SOURCE        = attribute.Key("locater.source")
+	ATTR_CACHE         = attribute.Key("locater.cache")
+	ATTR_CACHE_HIT     = attribute.Key("locater.cache.hit")
+	ATTR_STORE         = attribute.Key("locater.store.collection")
+	ATTR_ACCESS_POINTS = attribute.Key("locater.wifi.access_points")
+	ATTR_SINK          = attribute.Key("locater.sink")
+	ATTR_ATTEMPT       = attribute.Key("locater.attempt")
+)
+
+// Install the exporter of the configuration as the global tracer
+// provider. The spans are dropped when no exporter is configured. The
+// returned function flushes the pending spans
+func Setup(cfg config.Tracing, device string) (func(context.Context) error, error) {
+	if cfg.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	switch cfg.Exporter {
+	case EXPORTER_OTLP:
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	case EXPORTER_STDOUT:
+		exporter, err = stdouttrace.New()
+	case EXPORTER_FILE:
+		file, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open the trace file: %s", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the %s trace exporter: %s", cfg.Exporter, err)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(SERVICE_NAME),
+		semconv.ServiceInstanceID(device),
+	)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// Start a span, a child of the span of the context if there is one
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(SERVICE_NAME).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End a span, recording the error if the step failed
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// W3C traceparent of the span of the context, empty without a span. It
+// is kept with the work done later, like an outbox entry
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Context continuing the trace of a traceparent, the spans started from
+// it are children of the remote span
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
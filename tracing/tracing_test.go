@@ -0,0 +1,39 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mircearem/locater/config"
+)
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(config.Tracing{Exporter: EXPORTER_FILE, File: path, SampleRatio: 1}, "test-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, root := Start(context.Background(), "locate", ATTR_SOURCE.String("ip"))
+	_, span := Start(ctx, "ip lookup", ATTR_PROVIDER.String("ipify"))
+	End(span, errors.New("ipify response fail"))
+	End(root, nil)
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, want := range []string{`"Name":"locate"`, `"Name":"ip lookup"`, `"ipify"`, `"ipify response fail"`, `"test-device"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("traces do not contain %s:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mircearem/locater/atomicfile"
+)
+
+// Dead letters kept in the file, the oldest are dropped past this
+const DEAD_LETTER_SIZE = 1000
+
+var ErrNotFound = errors.New("no such dead letter")
+
+// Delivery of an event to an endpoint
+type Delivery struct {
+	ID        string    `json:"id"`
+	Endpoint  string    `json:"endpoint,omitempty"` // name of the endpoint, empty in the older dead letters
+	URL       string    `json:"url"`
+	Event     string    `json:"event"`
+	Body      string    `json:"body"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	FailedAt  time.Time `json:"failed_at,omitempty"`
+}
+
+// Deliveries that failed every attempt, saved to a file on every change
+type deadLetters struct {
+	path string
+
+	mu      sync.Mutex
+	letters []Delivery
+}
+
+// Load the dead letters left by the previous run, a missing file is empty
+func openDeadLetters(path string) (*deadLetters, error) {
+	q := &deadLetters{path: path, letters: make([]Delivery, 0)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the dead letter file: %s", err)
+	}
+	if err := json.Unmarshal(b, &q.letters); err != nil {
+		return nil, fmt.Errorf("cannot parse the dead letter file %s: %s", path, err)
+	}
+	return q, nil
+}
+
+func (q *deadLetters) add(d Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.letters = append(q.letters, d)
+	if len(q.letters) > DEAD_LETTER_SIZE {
+		q.letters = q.letters[len(q.letters)-DEAD_LETTER_SIZE:]
+	}
+	return q.save()
+}
+
+// Remove a dead letter to deliver it again
+func (q *deadLetters) take(id string) (Delivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, d := range q.letters {
+		if d.ID == id {
+			q.letters = append(q.letters[:i], q.letters[i+1:]...)
+			return d, q.save()
+		}
+	}
+	return Delivery{}, ErrNotFound
+}
+
+// Remove all the dead letters
+func (q *deadLetters) takeAll() ([]Delivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	letters := q.letters
+	q.letters = make([]Delivery, 0)
+	return letters, q.save()
+}
+
+// Oldest first
+func (q *deadLetters) list() []Delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append(make([]Delivery, 0, len(q.letters)), q.letters...)
+}
+
+// Replace the file, a crash leaves either the old or the new content.
+// Must be called with the lock held
+func (q *deadLetters) save() error {
+	b, err := json.MarshalIndent(q.letters, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(q.path, b); err != nil {
+		return fmt.Errorf("cannot save the dead letters: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,475 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/outbox"
+	"github.com/mircearem/locater/provider"
+	"github.com/sirupsen/logrus"
+)
+
+// Events sent to the endpoints
+const (
+	// Every reported location
+	EVENT_LOCATION = "location.updated"
+	// The address differs from the previous location
+	EVENT_MOVED = "location.changed"
+	// The location comes from another source than the previous one
+	EVENT_SOURCE = "source.changed"
+	// Another sim card is in the modem, sent with the last location
+	EVENT_SIM_SWAP = "sim.swapped"
+)
+
+// Headers of the deliveries, the signature is sha256=<hex hmac of the body>
+const (
+	EVENT_HEADER     = "X-Locater-Event"
+	DELIVERY_HEADER  = "X-Locater-Delivery"
+	SIGNATURE_HEADER = "X-Locater-Signature"
+)
+
+// Defaults of the endpoint settings left empty
+const (
+	DEFAULT_TIMEOUT      = 10 * time.Second
+	DEFAULT_MAX_ATTEMPTS = 5
+	DEFAULT_BACKOFF      = time.Second
+	MAX_BACKOFF          = 5 * time.Minute
+)
+
+// Body of the deliveries, and data of the templates
+type Event struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"event"`
+	Device    string           `json:"device"`
+	Timestamp time.Time        `json:"timestamp"`
+	Location  geo.Geolocation  `json:"location"`
+	Previous  *geo.Geolocation `json:"previous,omitempty"`
+	Sim       *modem.SimSwap   `json:"sim,omitempty"`
+}
+
+type endpoint struct {
+	name    string // the configured one, or the position in the list
+	cfg     config.Webhook
+	tmpl    *template.Template
+	events  map[string]bool
+	sources map[string]bool
+	client  *http.Client
+	sink    *outbox.Sink
+}
+
+// Sends the location events to the configured endpoints. Each endpoint
+// has its own outbox sink, so that a slow one does not hold back the
+// others and the pending deliveries survive a restart
+type Dispatcher struct {
+	cfg    config.Webhooks
+	device string
+	box    *outbox.Outbox
+	dead   *deadLetters
+	last   *geo.Geolocation
+	quitch chan struct{}
+
+	mu        sync.RWMutex
+	endpoints []*endpoint
+	sinks     map[string]*outbox.Sink // by endpoint name, kept when an endpoint is removed
+}
+
+func NewDispatcher(cfg config.Webhooks, device string, box *outbox.Outbox) (*Dispatcher, error) {
+	dead, err := openDeadLetters(cfg.DeadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dispatcher{
+		cfg:    cfg,
+		device: device,
+		box:    box,
+		dead:   dead,
+		sinks:  make(map[string]*outbox.Sink),
+		quitch: make(chan struct{}),
+	}
+	if err := d.setEndpoints(cfg.Endpoints); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Change the endpoints after a configuration reload. An endpoint keeps
+// its pending deliveries when its name stays, the retry delays of its
+// outbox are the ones of the start. The deliveries pending for a removed
+// endpoint become dead letters
+func (d *Dispatcher) Set(cfg config.Webhooks) error {
+	if cfg.DeadLetterFile != d.cfg.DeadLetterFile {
+		return errors.New("the dead letter file cannot change while running")
+	}
+	if err := d.setEndpoints(cfg.Endpoints); err != nil {
+		return err
+	}
+	d.cfg = cfg
+	return nil
+}
+
+// Build the endpoints, the running ones are replaced only once they are
+// all valid
+func (d *Dispatcher) setEndpoints(webhooks []config.Webhook) error {
+	endpoints := make([]*endpoint, 0, len(webhooks))
+	for i, w := range webhooks {
+		for _, ev := range w.Events {
+			if ev != EVENT_LOCATION && ev != EVENT_MOVED && ev != EVENT_SOURCE && ev != EVENT_SIM_SWAP {
+				return fmt.Errorf("webhooks.endpoints[%d].events: unknown event %q", i, ev)
+			}
+		}
+		if w.Timeout == 0 {
+			w.Timeout = DEFAULT_TIMEOUT
+		}
+		if w.MaxAttempts == 0 {
+			w.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+		}
+		if w.Backoff == 0 {
+			w.Backoff = DEFAULT_BACKOFF
+		}
+		name := w.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		e := &endpoint{
+			name:    name,
+			cfg:     w,
+			events:  set(w.Events),
+			sources: set(w.Sources),
+			client:  &http.Client{Timeout: w.Timeout},
+		}
+		if w.Template != "" {
+			tmpl, err := template.New(w.URL).Funcs(template.FuncMap{"json": toJSON}).Parse(w.Template)
+			if err != nil {
+				return fmt.Errorf("webhooks.endpoints[%d].template: %s", i, err)
+			}
+			e.tmpl = tmpl
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range endpoints {
+		// Named after the endpoint, several endpoints can share an url
+		sink, ok := d.sinks[e.name]
+		if !ok {
+			var err error
+			sink, err = d.box.Sink("webhook "+e.name, outbox.Options{
+				Backoff:    e.cfg.Backoff,
+				MaxBackoff: MAX_BACKOFF,
+				Expired:    d.expired,
+			}, d.deliverer(e.name))
+			if err != nil {
+				return err
+			}
+			d.sinks[e.name] = sink
+		}
+		e.sink = sink
+	}
+	d.endpoints = endpoints
+	// Deliver what a removed endpoint left, to the dead letters
+	for name, sink := range d.sinks {
+		if d.find(name, "") == nil {
+			sink.Wake()
+		}
+	}
+	return nil
+}
+
+// Send the events of the locations and of the sim swaps received on the
+// channels until the dispatcher is closed. The swap channel is nil
+// without a modem
+func (d *Dispatcher) Run(locch <-chan geo.Geolocation, swapch <-chan modem.SimSwap) {
+	for {
+		select {
+		case loc := <-locch:
+			ctx := loc.TraceContext()
+			for _, ev := range d.events(loc) {
+				d.dispatch(ctx, ev)
+			}
+		case swap := <-swapch:
+			ev := Event{
+				ID:        newID(),
+				Type:      EVENT_SIM_SWAP,
+				Device:    d.device,
+				Timestamp: time.Now().UTC(),
+				Sim:       &swap,
+			}
+			if d.last != nil {
+				ev.Location = *d.last
+			}
+			d.dispatch(context.Background(), ev)
+		case <-d.quitch:
+			return
+		}
+	}
+}
+
+// Stop dispatching, the pending deliveries stay in the outbox
+func (d *Dispatcher) Close() {
+	close(d.quitch)
+}
+
+// Deliveries that failed every attempt, oldest first
+func (d *Dispatcher) DeadLetters() []Delivery {
+	return d.dead.list()
+}
+
+// Deliver a dead letter again, with all the attempts of its endpoint
+func (d *Dispatcher) Replay(id string) error {
+	for _, del := range d.dead.list() {
+		if del.ID != id {
+			continue
+		}
+		e := d.endpoint(del)
+		if e == nil {
+			return fmt.Errorf("%s is no longer a configured endpoint", del.URL)
+		}
+		del, err := d.dead.take(id)
+		if err != nil {
+			return err
+		}
+		d.enqueue(context.Background(), e, del)
+		return nil
+	}
+	return ErrNotFound
+}
+
+// Deliver all the dead letters again, the ones of the endpoints that are
+// no longer configured stay in the dead letters
+func (d *Dispatcher) ReplayAll() (int, error) {
+	letters, err := d.dead.takeAll()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, del := range letters {
+		e := d.endpoint(del)
+		if e == nil {
+			if err := d.dead.add(del); err != nil {
+				return n, err
+			}
+			continue
+		}
+		d.enqueue(context.Background(), e, del)
+		n++
+	}
+	return n, nil
+}
+
+// Events of a new location, compared to the previous one
+func (d *Dispatcher) events(loc geo.Geolocation) []Event {
+	prev := d.last
+	d.last = &loc
+
+	types := []string{EVENT_LOCATION}
+	if prev != nil {
+		if prev.Name != loc.Name || prev.Street != loc.Street || prev.City != loc.City || prev.Country != loc.Country {
+			types = append(types, EVENT_MOVED)
+		}
+		if prev.Source != loc.Source {
+			types = append(types, EVENT_SOURCE)
+		}
+	}
+
+	events := make([]Event, 0, len(types))
+	for _, t := range types {
+		events = append(events, Event{
+			ID:        newID(),
+			Type:      t,
+			Device:    d.device,
+			Timestamp: time.Now().UTC(),
+			Location:  loc,
+			Previous:  prev,
+		})
+	}
+	return events
+}
+
+// Queue an event for the endpoints that want it, the deliveries continue
+// the trace of the context
+func (d *Dispatcher) dispatch(ctx context.Context, ev Event) {
+	d.mu.RLock()
+	endpoints := d.endpoints
+	d.mu.RUnlock()
+	for _, e := range endpoints {
+		if len(e.events) > 0 && !e.events[ev.Type] {
+			continue
+		}
+		// The sim swaps are not tied to a source
+		if len(e.sources) > 0 && ev.Sim == nil && !e.sources[ev.Location.Source] {
+			continue
+		}
+
+		body, err := e.body(ev)
+		if err != nil {
+			logrus.Printf("Webhook %s payload failed: %s", e.cfg.URL, err)
+			continue
+		}
+		d.enqueue(ctx, e, Delivery{
+			ID:       newID(),
+			Endpoint: e.name,
+			URL:      e.cfg.URL,
+			Event:    ev.Type,
+			Body:     string(body),
+		})
+	}
+}
+
+// Write a delivery to the outbox of its endpoint
+func (d *Dispatcher) enqueue(ctx context.Context, e *endpoint, del Delivery) {
+	del.Attempts = 0
+	del.Endpoint = e.name
+	b, err := json.Marshal(del)
+	if err == nil {
+		err = e.sink.Put(ctx, b)
+	}
+	if err != nil {
+		d.bury(del, err)
+	}
+}
+
+// Delivery of the outbox entries of an endpoint, retried with a growing
+// delay until it succeeds, fails for good, or runs out of attempts. The
+// endpoint is looked up on every attempt, its settings can be reloaded
+func (d *Dispatcher) deliverer(name string) outbox.DeliverFunc {
+	return func(b []byte, attempt int) error {
+		var del Delivery
+		if err := json.Unmarshal(b, &del); err != nil {
+			return outbox.Permanent(err)
+		}
+		d.mu.RLock()
+		e := d.find(name, "")
+		d.mu.RUnlock()
+		if e == nil {
+			err := errors.New("no longer a configured endpoint")
+			d.bury(del, err)
+			return outbox.Permanent(err)
+		}
+		del.Attempts = attempt
+		err := e.send(del)
+		if err == nil {
+			return nil
+		}
+		if del.Attempts >= e.cfg.MaxAttempts || !provider.Retryable(err) {
+			d.bury(del, err)
+			return outbox.Permanent(err)
+		}
+		return err
+	}
+}
+
+// Keep a failed delivery for a replay
+func (d *Dispatcher) bury(del Delivery, err error) {
+	logrus.Printf("Webhook delivery %s to %s failed after %d attempts: %s", del.ID, del.URL, del.Attempts, err)
+	del.LastError = err.Error()
+	del.FailedAt = time.Now().UTC()
+	if err := d.dead.add(del); err != nil {
+		logrus.Println(err)
+	}
+}
+
+// Keep a delivery that stayed in the outbox past its max age
+func (d *Dispatcher) expired(b []byte) {
+	var del Delivery
+	if err := json.Unmarshal(b, &del); err != nil {
+		logrus.Println(err)
+		return
+	}
+	d.bury(del, errors.New("expired in the outbox"))
+}
+
+// Endpoint of a delivery, by url for the dead letters without a name
+func (d *Dispatcher) endpoint(del Delivery) *endpoint {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.find(del.Endpoint, del.URL)
+}
+
+// Endpoint by name, or by url without a name. The lock must be held
+func (d *Dispatcher) find(name, url string) *endpoint {
+	for _, e := range d.endpoints {
+		if name != "" && e.name == name || name == "" && e.cfg.URL == url {
+			return e
+		}
+	}
+	return nil
+}
+
+// Body of an event, the template output or the event as JSON
+func (e *endpoint) body(ev Event) ([]byte, error) {
+	if e.tmpl == nil {
+		return json.Marshal(ev)
+	}
+	var b bytes.Buffer
+	if err := e.tmpl.Execute(&b, ev); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (e *endpoint) send(del Delivery) error {
+	req, err := http.NewRequest(http.MethodPost, e.cfg.URL, bytes.NewBufferString(del.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EVENT_HEADER, del.Event)
+	req.Header.Set(DELIVERY_HEADER, del.ID)
+	if e.cfg.Secret != "" {
+		req.Header.Set(SIGNATURE_HEADER, Sign(e.cfg.Secret, []byte(del.Body)))
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &provider.StatusError{Provider: "webhook", Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// Signature header of a body, for the receivers to check against
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func set(values []string) map[string]bool {
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,313 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mircearem/locater/config"
+	"github.com/mircearem/locater/geo"
+	"github.com/mircearem/locater/modem"
+	"github.com/mircearem/locater/outbox"
+)
+
+func openOutbox(t *testing.T, path string) *outbox.Outbox {
+	cfg := config.Default().Outbox
+	cfg.Path = path
+	box, err := outbox.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return box
+}
+
+// Wait for a condition checked every few milliseconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	for i := 0; !cond(); i++ {
+		if i == 500 {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRetryAndSignature(t *testing.T) {
+	var calls atomic.Int32
+	bodych := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get(SIGNATURE_HEADER); sig != Sign("s3cret", body) {
+			t.Errorf("unexpected signature %q", sig)
+		}
+		var ev Event
+		json.Unmarshal(body, &ev)
+		bodych <- ev
+	}))
+	defer srv.Close()
+
+	box := openOutbox(t, filepath.Join(t.TempDir(), "outbox.db"))
+	defer box.Close()
+	d, err := NewDispatcher(config.Webhooks{
+		Endpoints: []config.Webhook{{
+			URL:     srv.URL,
+			Events:  []string{EVENT_MOVED},
+			Secret:  "s3cret",
+			Backoff: 10 * time.Millisecond,
+		}},
+		DeadLetterFile: filepath.Join(t.TempDir(), "deadletters.json"),
+	}, "device-1", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	locch := make(chan geo.Geolocation)
+	go d.Run(locch, nil)
+	locch <- geo.Geolocation{City: "Cluj-Napoca", Source: geo.SourceIP}
+	locch <- geo.Geolocation{City: "Turda", Source: geo.SourceIP}
+
+	select {
+	case ev := <-bodych:
+		if ev.Type != EVENT_MOVED || ev.Device != "device-1" || ev.Location.City != "Turda" || ev.Previous.City != "Cluj-Napoca" {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	var delivered atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"city":"Turda"}` {
+			t.Errorf("unexpected body %s", body)
+		}
+		delivered.Add(1)
+	}))
+	defer srv.Close()
+
+	cfg := config.Webhooks{
+		Endpoints: []config.Webhook{{
+			URL:      srv.URL,
+			Events:   []string{EVENT_LOCATION},
+			Sources:  []string{geo.SourceCell},
+			Template: `{"city":{{json .Location.City}}}`,
+		}},
+		DeadLetterFile: filepath.Join(t.TempDir(), "deadletters.json"),
+	}
+	dir := t.TempDir()
+	box := openOutbox(t, filepath.Join(dir, "outbox.db"))
+	d, err := NewDispatcher(cfg, "device-1", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locch := make(chan geo.Geolocation)
+	go d.Run(locch, nil)
+	// Filtered out by the source
+	locch <- geo.Geolocation{City: "Cluj-Napoca", Source: geo.SourceIP}
+	locch <- geo.Geolocation{City: "Turda", Source: geo.SourceCell}
+
+	// A client error is not retried
+	eventually(t, "the dead letter", func() bool { return len(d.DeadLetters()) == 1 })
+	d.Close()
+	box.Close()
+
+	// The dead letters survive a restart
+	box = openOutbox(t, filepath.Join(dir, "outbox.db"))
+	defer box.Close()
+	d, err = NewDispatcher(cfg, "device-1", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	letters := d.DeadLetters()
+	if len(letters) != 1 || letters[0].Attempts != 1 || letters[0].LastError != "webhook: unexpected status 400" {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+
+	if err := d.Replay("unknown"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	fail.Store(false)
+	if err := d.Replay(letters[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the replay", func() bool { return delivered.Load() == 1 })
+	if n := len(d.DeadLetters()); n != 0 {
+		t.Fatalf("expected no dead letters after the replay, got %d", n)
+	}
+}
+
+func TestSimSwap(t *testing.T) {
+	bodych := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		json.NewDecoder(r.Body).Decode(&ev)
+		bodych <- ev
+	}))
+	defer srv.Close()
+
+	box := openOutbox(t, filepath.Join(t.TempDir(), "outbox.db"))
+	defer box.Close()
+	// The swap is not filtered out by the sources
+	d, err := NewDispatcher(config.Webhooks{
+		Endpoints: []config.Webhook{{
+			URL:     srv.URL,
+			Events:  []string{EVENT_SIM_SWAP},
+			Sources: []string{geo.SourceCell},
+		}},
+		DeadLetterFile: filepath.Join(t.TempDir(), "deadletters.json"),
+	}, "device-1", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	locch := make(chan geo.Geolocation)
+	swapch := make(chan modem.SimSwap)
+	go d.Run(locch, swapch)
+	locch <- geo.Geolocation{City: "Turda", Source: geo.SourceIP}
+	swapch <- modem.SimSwap{Previous: "8940010000123456789", Iccid: "8940100000987654321"}
+
+	select {
+	case ev := <-bodych:
+		if ev.Type != EVENT_SIM_SWAP || ev.Sim == nil || ev.Sim.Iccid != "8940100000987654321" || ev.Location.City != "Turda" {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+}
+
+// Endpoints sharing an url have their own outbox
+func TestSameURL(t *testing.T) {
+	bodych := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodych <- string(body)
+	}))
+	defer srv.Close()
+
+	box := openOutbox(t, filepath.Join(t.TempDir(), "outbox.db"))
+	defer box.Close()
+	d, err := NewDispatcher(config.Webhooks{
+		Endpoints: []config.Webhook{{
+			URL:      srv.URL,
+			Events:   []string{EVENT_LOCATION},
+			Template: `{"city":{{json .Location.City}}}`,
+		}, {
+			Name:     "source",
+			URL:      srv.URL,
+			Events:   []string{EVENT_LOCATION},
+			Template: `{"source":{{json .Location.Source}}}`,
+		}},
+		DeadLetterFile: filepath.Join(t.TempDir(), "deadletters.json"),
+	}, "device-1", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	locch := make(chan geo.Geolocation)
+	go d.Run(locch, nil)
+	locch <- geo.Geolocation{City: "Turda", Source: geo.SourceIP}
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case body := <-bodych:
+			got[body] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not delivered")
+		}
+	}
+	if !got[`{"city":"Turda"}`] || !got[`{"source":"ip"}`] {
+		t.Fatalf("unexpected bodies %v", got)
+	}
+}
+
+// A reload moves the endpoint and the removed one leaves dead letters
+func TestSet(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer old.Close()
+	bodych := make(chan Event, 1)
+	moved := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		json.NewDecoder(r.Body).Decode(&ev)
+		bodych <- ev
+	}))
+	defer moved.Close()
+
+	box := openOutbox(t, filepath.Join(t.TempDir(), "outbox.db"))
+	defer box.Close()
+	cfg := config.Webhooks{
+		Endpoints: []config.Webhook{
+			{Name: "backend", URL: old.URL, Backoff: 20 * time.Millisecond},
+			{Name: "legacy", URL: old.URL, Backoff: 20 * time.Millisecond},
+		},
+		DeadLetterFile: filepath.Join(t.TempDir(), "deadletters.json"),
+	}
+	d, err := NewDispatcher(cfg, "device-1", box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	locch := make(chan geo.Geolocation)
+	go d.Run(locch, nil)
+	locch <- geo.Geolocation{City: "Turda", Source: geo.SourceIP}
+	eventually(t, "the pending deliveries", func() bool {
+		for _, st := range box.Stats() {
+			if st.Failed == 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	cfg.Endpoints = []config.Webhook{{Name: "backend", URL: moved.URL}}
+	if err := d.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-bodych:
+		if ev.Location.City != "Turda" {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending delivery not sent to the new url")
+	}
+	eventually(t, "the dead letter", func() bool { return len(d.DeadLetters()) == 1 })
+	if del := d.DeadLetters()[0]; del.Endpoint != "legacy" {
+		t.Fatalf("unexpected dead letter %+v", del)
+	}
+
+	cfg.DeadLetterFile = filepath.Join(t.TempDir(), "other.json")
+	if err := d.Set(cfg); err == nil {
+		t.Fatal("dead letter file changed while running")
+	}
+}